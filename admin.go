@@ -0,0 +1,135 @@
+package jsonpathfilter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/PaesslerAG/jsonpath"
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI serves an admin endpoint for trying out expressions against a
+// sample document, e.g. to validate expressions in CI:
+//
+//	POST /jsonpath-filter/test
+//	{"expression": "$.a", "document": {"a": 1}, "engine": "jsonpath"}
+//
+// It responds with {"result": <result>, "matched": true|false}, or with a
+// 400 error of the form {"error": "...", "expression": "..."}. engine is
+// optional and defaults to "jsonpath". Bodies over maxTestBodySize are
+// rejected with 413, and evaluations taking longer than testEvalTimeout
+// fail with 504. Like all admin endpoints, it is subject to the admin
+// API's access controls.
+type adminAPI struct{}
+
+const (
+	// maxTestBodySize bounds the size of test request bodies.
+	maxTestBodySize = 1 << 20
+
+	// testEvalTimeout bounds the evaluation of test expressions.
+	testEvalTimeout = 5 * time.Second
+)
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.jsonpath_filter",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/jsonpath-filter/test",
+			Handler: caddy.AdminHandlerFunc(a.handleTest),
+		},
+	}
+}
+
+// testRequest is the body of a test request.
+type testRequest struct {
+	Expression string          `json:"expression"`
+	Document   json.RawMessage `json:"document"`
+	Engine     string          `json:"engine,omitempty"`
+}
+
+// testResult is the body of a successful test response.
+type testResult struct {
+	Result  interface{} `json:"result"`
+	Matched bool        `json:"matched"`
+}
+
+// handleTest evaluates the expression of a test request.
+func (a adminAPI) handleTest(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	var req testRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTestBodySize)).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return caddy.APIError{
+				HTTPStatus: http.StatusRequestEntityTooLarge,
+				Err:        fmt.Errorf("request body larger than %d bytes", tooLarge.Limit),
+			}
+		}
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request: %v", err),
+		}
+	}
+	if req.Expression == "" || len(req.Document) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        errors.New("expression and document are required"),
+		}
+	}
+	compile := jsonpath.New
+	switch req.Engine {
+	case "", "jsonpath":
+	case "jq":
+		compile = compileJQ
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("unrecognized engine %q", req.Engine),
+		}
+	}
+	data, _, err := decodeJSON(req.Document, false)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding document: %v", err),
+		}
+	}
+
+	m := &ResponseFilter{exprs: newExprCache(0, compile), EvalTimeout: caddy.Duration(testEvalTimeout)}
+	result, err := m.bounded(r.Context(), func(ctx context.Context) (interface{}, error) {
+		return m.eval(ctx, req.Expression, data)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil && !errors.Is(err, errNoMatch) {
+		status := http.StatusBadRequest
+		if errors.Is(err, errEvalTimeout) {
+			status = http.StatusGatewayTimeout
+		}
+		w.WriteHeader(status)
+		return json.NewEncoder(w).Encode(errorBody{Error: err.Error(), Code: errorCode(err), Expression: req.Expression})
+	}
+	return json.NewEncoder(w).Encode(testResult{Result: result, Matched: err == nil})
+}
+
+// Interface guards
+var _ caddy.AdminRouter = (*adminAPI)(nil)
@@ -0,0 +1,54 @@
+package jsonpathfilter
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestAdminTest(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+		want   string
+	}{
+		{"match", http.MethodPost, `{"expression":"$.a","document":{"a":1}}`, http.StatusOK, `{"result":1,"matched":true}`},
+		{"no match", http.MethodPost, `{"expression":"$.b","document":{"a":1}}`, http.StatusOK, `{"result":null,"matched":false}`},
+		{"jq", http.MethodPost, `{"expression":".a + 1","document":{"a":1},"engine":"jq"}`, http.StatusOK, `{"result":2,"matched":true}`},
+		{"syntax error", http.MethodPost, `{"expression":"$[","document":{"a":1}}`, http.StatusBadRequest, `"expression":"$["`},
+		{"unknown engine", http.MethodPost, `{"expression":"$.a","document":{},"engine":"xpath"}`, http.StatusBadRequest, ""},
+		{"missing document", http.MethodPost, `{"expression":"$.a"}`, http.StatusBadRequest, ""},
+		{"malformed body", http.MethodPost, `{"expression":`, http.StatusBadRequest, ""},
+		{"body too large", http.MethodPost, `{"expression":"$.a","document":"` + strings.Repeat("x", maxTestBodySize) + `"}`, http.StatusRequestEntityTooLarge, ""},
+		{"method", http.MethodGet, "", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/jsonpath-filter/test", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			status := http.StatusOK
+			err := adminAPI{}.handleTest(rr, req)
+			var apiErr caddy.APIError
+			switch {
+			case errors.As(err, &apiErr):
+				status = apiErr.HTTPStatus
+			case err != nil:
+				t.Fatalf("handleTest: %v", err)
+			default:
+				status = rr.Code
+			}
+			if status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+			if got := strings.TrimSpace(rr.Body.String()); tt.want != "" && !strings.Contains(got, tt.want) {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
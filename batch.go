@@ -0,0 +1,60 @@
+package jsonpathfilter
+
+import (
+	"context"
+	"errors"
+)
+
+// Batch configures filtering of batched responses such as
+// {"responses": [{"status": 200, "body": {...}}, ...]}, where each
+// sub-response carries its own document.
+type Batch struct {
+	// Items is the top-level member holding the array of sub-responses.
+	// Defaults to "responses".
+	Items string `json:"items,omitempty"`
+
+	// Body is the member of each sub-response holding the document to
+	// filter. Defaults to "body".
+	Body string `json:"body,omitempty"`
+}
+
+// transformBatch applies exprs to the body of every sub-response in data
+// and returns data with the bodies replaced by the results. Bodies that
+// match nothing become null. Bodies that fail to evaluate are left as
+// they are with on_error passthrough, become null with on_error empty and
+// otherwise fail the whole batch. Sub-responses without an object or
+// array body are left alone. It reports false if data is not a batch.
+func (m *ResponseFilter) transformBatch(ctx context.Context, exprs []string, data interface{}) (interface{}, bool, error) {
+	doc, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, false, nil
+	}
+	items, ok := doc[m.Batch.Items].([]interface{})
+	if !ok {
+		return nil, false, nil
+	}
+	for _, item := range items {
+		sub, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch sub[m.Batch.Body].(type) {
+		case map[string]interface{}, []interface{}:
+		default:
+			continue
+		}
+		result, err := m.transform(ctx, exprs, sub[m.Batch.Body])
+		switch {
+		case err == nil:
+			sub[m.Batch.Body] = result
+		case errors.Is(err, errNoMatch):
+			sub[m.Batch.Body] = nil
+		case m.OnError == "passthrough":
+		case m.OnError == "empty":
+			sub[m.Batch.Body] = nil
+		default:
+			return nil, true, err
+		}
+	}
+	return doc, true, nil
+}
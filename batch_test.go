@@ -0,0 +1,43 @@
+package jsonpathfilter
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	const doc = `{"responses":[{"status":200,"body":{"a":{"b":1},"c":2}},` +
+		`{"status":502,"body":"bad gateway"},{"status":200,"body":{"a":3}}]}`
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		expr   string
+		status int
+		want   string
+	}{
+		{"filtered", ResponseFilter{Batch: new(Batch)}, "$.a", http.StatusOK,
+			`{"responses":[{"body":{"b":1},"status":200},{"body":"bad gateway","status":502},{"body":3,"status":200}]}`},
+		{"no match", ResponseFilter{Batch: new(Batch)}, "$.c", http.StatusOK,
+			`{"responses":[{"body":2,"status":200},{"body":"bad gateway","status":502},{"body":null,"status":200}]}`},
+		{"error fails", ResponseFilter{Batch: new(Batch), Engine: "jq"}, ".a.b", http.StatusBadRequest, ""},
+		{"error passthrough", ResponseFilter{Batch: new(Batch), Engine: "jq", OnError: "passthrough"}, ".a.b", http.StatusOK,
+			`{"responses":[{"body":1,"status":200},{"body":"bad gateway","status":502},{"body":{"a":3},"status":200}]}`},
+		{"error empty", ResponseFilter{Batch: new(Batch), Engine: "jq", OnError: "empty"}, ".a.b", http.StatusOK,
+			`{"responses":[{"body":1,"status":200},{"body":"bad gateway","status":502},{"body":null,"status":200}]}`},
+		{"not a batch", ResponseFilter{Batch: &Batch{Items: "results"}}, "$.a", http.StatusOK, doc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, "/?jsonpath_filter="+url.QueryEscape(tt.expr), respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
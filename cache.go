@@ -0,0 +1,175 @@
+package jsonpathfilter
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/caddyserver/caddy/v2"
+)
+
+// sharedExprs holds the configured expressions of all handler instances,
+// keyed by engine and expression, so that instances with the same
+// expressions, including those of a reloaded configuration, compile
+// them only once. Entries are reference-counted and dropped when the
+// last instance using them is cleaned up.
+var sharedExprs = caddy.NewUsagePool()
+
+// sharedExpr is a compiled expression in sharedExprs.
+type sharedExpr struct {
+	eval gval.Evaluable
+}
+
+// Destruct implements caddy.Destructor.
+func (sharedExpr) Destruct() error { return nil }
+
+// exprCache is a size-bounded LRU cache of compiled JSONPath expressions.
+// It is safe for concurrent use. Compiled expressions are Go closures, so
+// the cache lives in memory only and cannot be persisted across restarts;
+// configured expressions are taken from sharedExprs during provisioning
+// and kept apart from the LRU entries until the cache is released.
+type exprCache struct {
+	mu      sync.Mutex
+	max     int
+	compile func(string) (gval.Evaluable, error)
+	ll      *list.List
+	items   map[string]*list.Element
+	pinned  map[string]gval.Evaluable
+	shared  []string
+}
+
+type exprCacheEntry struct {
+	expr string
+	eval gval.Evaluable
+}
+
+// newExprCache returns a cache holding at most max expressions compiled
+// with compile, such as jsonpath.New. A max of zero or less disables
+// caching.
+func newExprCache(max int, compile func(string) (gval.Evaluable, error)) *exprCache {
+	return &exprCache{
+		max:     max,
+		compile: compile,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// get returns the compiled form of expr, compiling and caching it on a
+// miss. Expressions that fail to compile are not cached.
+func (c *exprCache) get(expr string) (gval.Evaluable, error) {
+	c.mu.Lock()
+	if eval, ok := c.pinned[expr]; ok {
+		c.mu.Unlock()
+		return eval, nil
+	}
+	if c.max <= 0 {
+		c.mu.Unlock()
+		return c.compile(expr)
+	}
+	if el, ok := c.items[expr]; ok {
+		c.ll.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*exprCacheEntry).eval, nil
+	}
+	c.mu.Unlock()
+
+	eval, err := c.compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[expr]; ok {
+		// compiled concurrently by another request
+		c.ll.MoveToFront(el)
+		return el.Value.(*exprCacheEntry).eval, nil
+	}
+	c.items[expr] = c.ll.PushFront(&exprCacheEntry{expr: expr, eval: eval})
+	for c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*exprCacheEntry).expr)
+	}
+	return eval, nil
+}
+
+// share pins expr, compiled by the engine kind, taking the compiled form
+// from sharedExprs or adding it there. Expressions that fail to compile
+// are not pinned, so that get reports the error.
+func (c *exprCache) share(kind, expr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pinned[expr]; ok {
+		return
+	}
+	key := kind + "\x00" + expr
+	v, _, err := sharedExprs.LoadOrNew(key, func() (caddy.Destructor, error) {
+		eval, err := c.compile(expr)
+		return sharedExpr{eval}, err
+	})
+	if err != nil {
+		return
+	}
+	if c.pinned == nil {
+		c.pinned = make(map[string]gval.Evaluable)
+	}
+	c.pinned[expr] = v.(sharedExpr).eval
+	c.shared = append(c.shared, key)
+}
+
+// release unpins all expressions and returns them to sharedExprs.
+func (c *exprCache) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range c.shared {
+		_, _ = sharedExprs.Delete(key)
+	}
+	c.pinned, c.shared = nil, nil
+}
+
+// patternCache is a size-bounded LRU cache of compiled regular
+// expressions. It is safe for concurrent use.
+type patternCache struct {
+	mu    sync.Mutex
+	max   int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// newPatternCache returns a cache holding at most max patterns. A max of
+// zero or less disables caching.
+func newPatternCache(max int) *patternCache {
+	return &patternCache{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the compiled form of expr, compiling and caching it on a
+// miss. Patterns that fail to compile are not cached.
+func (c *patternCache) get(expr string) (*regexp.Regexp, error) {
+	if c.max <= 0 {
+		return regexp.Compile(expr)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[expr]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	c.items[expr] = c.ll.PushFront(re)
+	for c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*regexp.Regexp).String())
+	}
+	return re, nil
+}
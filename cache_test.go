@@ -0,0 +1,68 @@
+package jsonpathfilter
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestSharedExprs(t *testing.T) {
+	const expr = "$.shared.expression"
+	key := "jsonpath\x00" + expr
+	var handlers []*ResponseFilter
+	for i := 0; i < 2; i++ {
+		m := &ResponseFilter{DefaultExpression: expr, Filters: map[string]string{"same": expr}}
+		provision(t, m)
+		handlers = append(handlers, m)
+	}
+	if refs, _ := sharedExprs.References(key); refs != 2 {
+		t.Fatalf("references after provisioning two handlers = %d, want 2", refs)
+	}
+	if _, loaded, err := sharedExprs.LoadOrNew(key, func() (caddy.Destructor, error) {
+		t.Error("shared expression compiled again")
+		return sharedExpr{}, nil
+	}); err != nil || !loaded {
+		t.Errorf("LoadOrNew = %t, %v, want the shared expression", loaded, err)
+	}
+	sharedExprs.Delete(key)
+
+	for i, m := range handlers {
+		rr := serve(t, m, "/", respond(http.StatusOK, "application/json", `{"shared":{"expression":1}}`))
+		if got := rr.Body.String(); got != "1" {
+			t.Errorf("handler %d: body = %q, want %q", i, got, "1")
+		}
+	}
+
+	for i, want := range []int{1, 0} {
+		if err := handlers[i].Cleanup(); err != nil {
+			t.Fatalf("Cleanup: %v", err)
+		}
+		if refs, _ := sharedExprs.References(key); refs != want {
+			t.Errorf("references after cleaning up %d handlers = %d, want %d", i+1, refs, want)
+		}
+	}
+	// handlers keep working after cleanup, compiling on demand
+	rr := serve(t, handlers[0], "/", respond(http.StatusOK, "application/json", `{"shared":{"expression":2}}`))
+	if got := rr.Body.String(); got != "2" {
+		t.Errorf("after cleanup: body = %q, want %q", got, "2")
+	}
+}
+
+func TestSharedExprsInvalid(t *testing.T) {
+	const expr = "$.shared["
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	m := &ResponseFilter{Filters: map[string]string{"broken": expr}}
+	if err := m.Provision(ctx); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	defer m.Cleanup()
+	if _, ok := sharedExprs.References("jsonpath\x00" + expr); ok {
+		t.Error("malformed expression was shared")
+	}
+	if err := m.Validate(); err == nil {
+		t.Error("Validate accepted a malformed expression")
+	}
+}
@@ -0,0 +1,728 @@
+package jsonpathfilter
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+)
+
+func init() {
+	httpcaddyfile.RegisterHandlerDirective("jsonpath_filter", parseCaddyfile)
+	// Run inside encode, so that responses are filtered before they are
+	// compressed
+	httpcaddyfile.RegisterDirectiveOrder("jsonpath_filter", httpcaddyfile.After, "encode")
+}
+
+// parseCaddyfile sets up the handler from a jsonpath_filter directive.
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := new(ResponseFilter)
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return m, err
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	jsonpath_filter {
+//	    query_param <name>
+//	    content_types <media_types...>
+//	    strip_headers <names...>
+//	    header <name>
+//	    expression <placeholder_expression>
+//	    expression_prefix <expression>
+//	    default_expression <expression>
+//	    cache_size <n>
+//	    max_expression_length <n>
+//	    allow <expressions...> {
+//	        <expression>
+//	    }
+//	    allow_prefix <paths...>
+//	    tenant_allow <header> [deny_unknown] {
+//	        <tenant> <expressions...>
+//	    }
+//	    max_body_size <size> [reject]
+//	    sniff_body
+//	    min_body_size <size>
+//	    multi object|array
+//	    partial_results
+//	    pretty
+//	    canonical
+//	    empty_status <code>
+//	    null_to_empty_array [always|auto]
+//	    error_format json|text|problem
+//	    only_paths <patterns...>
+//	    except_paths <patterns...>
+//	    ndjson
+//	    ndjson_output lines|array
+//	    raw
+//	    direction request|response
+//	    remove <expressions...>
+//	    root <expression>
+//	    wrap_array [<key>]
+//	    include_headers
+//	    require_accept_json
+//	    enable_header <name> [<value>]
+//	    bypass_param <name>[=<value>]
+//	    strip_control_params
+//	    preserve_order
+//	    allow_trailing_data
+//	    debug_header
+//	    on_error fail|passthrough|empty
+//	    redact_errors
+//	    envelope [<result_key> [<count_key>]]
+//	    array_envelope [<data_key> [<total_key>]]
+//	    with_status [<headers...>]
+//	    group_by <field> [<missing_key>]
+//	    batch [<items> [<body>]]
+//	    template <template>
+//	    result_cache {
+//	        ttl <duration>
+//	        max_entries <n>
+//	        cache_ttl <duration>
+//	    }
+//	    paginate
+//	    range_items
+//	    total_count
+//	    merge <json_object> [elements]
+//	    stream
+//	    bypass_cidrs <ranges...>
+//	    trusted_proxies <ranges...>
+//	    fields_param [<name>]
+//	    then_param [<name>]
+//	    key_pattern <regexp>
+//	    key_pattern_param [<name>]
+//	    engine jsonpath|jq
+//	    allow_engine_override [<ranges...>]
+//	    allow_debug_diff [<ranges...>]
+//	    flatten
+//	    distinct
+//	    round <decimals>
+//	    eval_timeout <duration>
+//	    max_depth <n>
+//	    max_matches <n> [reject]
+//	    output_content_type <media_type>
+//	    when <expression>
+//	    strict_content_type
+//	    methods <methods...>
+//	    include_paths
+//	    status_expressions [lock] {
+//	        <status|class> <expression>
+//	    }
+//	    format json|csv|lines|json-seq|msgpack [strict]
+//	    compress [<min_length>]
+//	    cache_control <value> [passthrough]
+//	    set_header <name> <value> [passthrough]
+//	    validate_schema <path> [passthrough]
+//	    etag
+//	    first
+//	    last
+//	    require_response_header <name> [<value>]
+//	    remove_keys <names...>
+//	    escape_html true|false
+//	    filters {
+//	        <name> <expression>
+//	    }
+//	    filters_file <path>
+//	    filter_param <name> [strict]
+//	    filter_arg_param <name>
+//	    filter_placeholder <placeholder>
+//	    sort_param [<name>]
+//	    jsonp [<param>]
+//	}
+//
+// Unknown subdirectives and unexpected arguments are errors.
+func (m *ResponseFilter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "query_param":
+				if err = singleArg(d, &m.QueryParam); err == nil && m.QueryParam == "" {
+					return d.Err("query_param must not be empty")
+				}
+			case "content_types":
+				err = listArgs(d, &m.ContentTypes)
+			case "strip_headers":
+				err = listArgs(d, &m.StripHeaders)
+			case "header":
+				err = singleArg(d, &m.Header)
+			case "expression":
+				err = singleArg(d, &m.Expression)
+			case "expression_prefix":
+				err = singleArg(d, &m.ExpressionPrefix)
+			case "default_expression":
+				err = singleArg(d, &m.DefaultExpression)
+			case "cache_size":
+				err = intArg(d, &m.CacheSize)
+			case "max_expression_length":
+				err = intArg(d, &m.MaxExpressionLength)
+			case "allow":
+				m.Allow = append(m.Allow, d.RemainingArgs()...)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					m.Allow = append(m.Allow, d.Val())
+					m.Allow = append(m.Allow, d.RemainingArgs()...)
+				}
+				if len(m.Allow) == 0 {
+					return d.ArgErr()
+				}
+			case "allow_prefix":
+				err = listArgs(d, &m.AllowPrefix)
+			case "tenant_allow":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.TenantHeader = d.Val()
+				if d.NextArg() {
+					if d.Val() != "deny_unknown" {
+						return d.Errf("unrecognized tenant_allow option '%s'", d.Val())
+					}
+					m.DenyUnknownTenants = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.TenantAllow == nil {
+					m.TenantAllow = make(map[string][]string)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					tenant := d.Val()
+					m.TenantAllow[tenant] = append(m.TenantAllow[tenant], d.RemainingArgs()...)
+				}
+			case "max_body_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("parsing max_body_size: %v", err)
+				}
+				m.MaxBodySize = int64(size)
+				if d.NextArg() {
+					if d.Val() != "reject" {
+						return d.Errf("unrecognized max_body_size option '%s'", d.Val())
+					}
+					m.RejectLargeBody = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "sniff_body":
+				err = flag(d, &m.SniffBody)
+			case "min_body_size":
+				var s string
+				if err = singleArg(d, &s); err == nil {
+					size, perr := humanize.ParseBytes(s)
+					if perr != nil {
+						return d.Errf("parsing min_body_size: %v", perr)
+					}
+					m.MinBodySize = int64(size)
+				}
+			case "multi":
+				err = singleArg(d, &m.Multi)
+			case "partial_results":
+				err = flag(d, &m.PartialResults)
+			case "pretty":
+				err = flag(d, &m.Pretty)
+			case "canonical":
+				err = flag(d, &m.Canonical)
+			case "empty_status":
+				err = intArg(d, &m.EmptyStatus)
+			case "null_to_empty_array":
+				m.NullToEmptyArray = "auto"
+				if d.NextArg() {
+					m.NullToEmptyArray = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "error_format":
+				err = singleArg(d, &m.ErrorFormat)
+			case "only_paths":
+				err = listArgs(d, &m.OnlyPaths)
+			case "except_paths":
+				err = listArgs(d, &m.ExceptPaths)
+			case "ndjson":
+				err = flag(d, &m.NDJSON)
+			case "ndjson_output":
+				err = singleArg(d, &m.NDJSONOutput)
+			case "raw":
+				err = flag(d, &m.Raw)
+			case "direction":
+				err = singleArg(d, &m.Direction)
+			case "remove":
+				err = listArgs(d, &m.Remove)
+			case "root":
+				err = singleArg(d, &m.Root)
+			case "wrap_array":
+				m.WrapArray = "items"
+				if d.NextArg() {
+					m.WrapArray = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "include_headers":
+				err = flag(d, &m.IncludeHeaders)
+			case "require_accept_json":
+				err = flag(d, &m.RequireAcceptJSON)
+			case "enable_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.EnableHeader = d.Val()
+				if d.NextArg() {
+					m.EnableHeaderValue = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "bypass_param":
+				var param string
+				if err := singleArg(d, &param); err != nil {
+					return err
+				}
+				m.BypassParam, m.BypassParamValue, _ = strings.Cut(param, "=")
+			case "strip_control_params":
+				err = flag(d, &m.StripControlParams)
+			case "preserve_order":
+				err = flag(d, &m.PreserveOrder)
+			case "allow_trailing_data":
+				err = flag(d, &m.AllowTrailingData)
+			case "debug_header":
+				err = flag(d, &m.DebugHeader)
+			case "redact_errors":
+				err = flag(d, &m.RedactErrors)
+			case "on_error":
+				err = singleArg(d, &m.OnError)
+			case "envelope":
+				m.Envelope = new(Envelope)
+				if d.NextArg() {
+					m.Envelope.ResultKey = d.Val()
+				}
+				if d.NextArg() {
+					m.Envelope.CountKey = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "array_envelope":
+				m.ArrayEnvelope = new(ArrayEnvelope)
+				if d.NextArg() {
+					m.ArrayEnvelope.DataKey = d.Val()
+				}
+				if d.NextArg() {
+					m.ArrayEnvelope.TotalKey = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "with_status":
+				m.WithStatus = &StatusEnvelope{Headers: d.RemainingArgs()}
+			case "group_by":
+				m.GroupBy = new(GroupBy)
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.GroupBy.Field = d.Val()
+				if d.NextArg() {
+					m.GroupBy.MissingKey = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "batch":
+				m.Batch = new(Batch)
+				if d.NextArg() {
+					m.Batch.Items = d.Val()
+				}
+				if d.NextArg() {
+					m.Batch.Body = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "template":
+				err = singleArg(d, &m.Template)
+			case "result_cache":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ResultCache = new(ResultCache)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "ttl":
+						err = durationArg(d, &m.ResultCache.TTL)
+					case "cache_ttl":
+						err = durationArg(d, &m.ResultCache.CacheTTL)
+					case "max_entries":
+						err = intArg(d, &m.ResultCache.MaxEntries)
+					default:
+						return d.Errf("unrecognized result_cache option '%s'", d.Val())
+					}
+					if err != nil {
+						return err
+					}
+				}
+			case "paginate":
+				err = flag(d, &m.Paginate)
+			case "range_items":
+				err = flag(d, &m.RangeItems)
+			case "total_count":
+				err = flag(d, &m.TotalCount)
+			case "merge":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if !json.Valid([]byte(d.Val())) {
+					return d.Errf("merge patch is not valid JSON: %s", d.Val())
+				}
+				m.Merge = &Merge{Patch: json.RawMessage(d.Val())}
+				if d.NextArg() {
+					if d.Val() != "elements" {
+						return d.Errf("unrecognized merge option '%s'", d.Val())
+					}
+					m.Merge.Elements = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "stream":
+				err = flag(d, &m.Stream)
+			case "bypass_cidrs":
+				err = listArgs(d, &m.BypassCIDRs)
+			case "trusted_proxies":
+				err = listArgs(d, &m.TrustedProxies)
+			case "fields_param":
+				m.FieldsParam = "fields"
+				if d.NextArg() {
+					m.FieldsParam = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "then_param":
+				m.ThenParam = "jsonpath_filter2"
+				if d.NextArg() {
+					m.ThenParam = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "key_pattern":
+				err = singleArg(d, &m.KeyPattern)
+			case "key_pattern_param":
+				m.KeyPatternParam = "key_pattern"
+				if d.NextArg() {
+					m.KeyPatternParam = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "engine":
+				err = singleArg(d, &m.Engine)
+			case "allow_engine_override":
+				m.AllowEngineOverride = true
+				m.EngineOverrideCIDRs = append(m.EngineOverrideCIDRs, d.RemainingArgs()...)
+			case "allow_debug_diff":
+				m.AllowDebugDiff = true
+				m.DebugDiffCIDRs = append(m.DebugDiffCIDRs, d.RemainingArgs()...)
+			case "flatten":
+				err = flag(d, &m.Flatten)
+			case "distinct":
+				err = flag(d, &m.Distinct)
+			case "round":
+				var decimals int
+				if err = intArg(d, &decimals); err == nil {
+					m.Round = &decimals
+				}
+			case "eval_timeout":
+				err = durationArg(d, &m.EvalTimeout)
+			case "max_depth":
+				err = intArg(d, &m.MaxDepth)
+			case "max_matches":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.MaxMatches, err = strconv.Atoi(d.Val()); err != nil {
+					return d.Errf("invalid max_matches %q: %v", d.Val(), err)
+				}
+				if d.NextArg() {
+					if d.Val() != "reject" {
+						return d.Errf("unrecognized max_matches option '%s'", d.Val())
+					}
+					m.RejectExcessMatches = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "output_content_type":
+				err = singleArg(d, &m.OutputContentType)
+			case "when":
+				err = singleArg(d, &m.When)
+			case "strict_content_type":
+				err = flag(d, &m.StrictContentType)
+			case "methods":
+				err = listArgs(d, &m.Methods)
+			case "include_paths":
+				err = flag(d, &m.IncludePaths)
+			case "status_expressions":
+				if d.NextArg() {
+					if d.Val() != "lock" {
+						return d.Errf("unrecognized status_expressions option '%s'", d.Val())
+					}
+					m.LockStatusExpressions = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.StatusExpressions == nil {
+					m.StatusExpressions = make(map[string]string)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					status := d.Val()
+					var expr string
+					if err := singleArg(d, &expr); err != nil {
+						return err
+					}
+					m.StatusExpressions[status] = expr
+				}
+			case "format":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Format = d.Val()
+				if d.NextArg() {
+					if d.Val() != "strict" {
+						return d.Errf("unrecognized format option '%s'", d.Val())
+					}
+					m.StrictFormat = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "cache_control":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.CacheControl = d.Val()
+				if d.NextArg() {
+					if d.Val() != "passthrough" {
+						return d.Errf("unrecognized cache_control option '%s'", d.Val())
+					}
+					m.CacheControlPassThrough = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "set_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				value := d.Val()
+				if d.NextArg() {
+					if d.Val() != "passthrough" {
+						return d.Errf("unrecognized set_header option '%s'", d.Val())
+					}
+					m.SetHeadersPassThrough = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.SetHeaders == nil {
+					m.SetHeaders = make(map[string]string)
+				}
+				m.SetHeaders[name] = value
+			case "validate_schema":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ValidateSchema = d.Val()
+				if d.NextArg() {
+					if d.Val() != "passthrough" {
+						return d.Errf("unrecognized validate_schema option '%s'", d.Val())
+					}
+					m.SchemaPassThrough = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "etag":
+				err = flag(d, &m.ETag)
+			case "compress":
+				m.Compress = true
+				if d.NextArg() {
+					size, err := humanize.ParseBytes(d.Val())
+					if err != nil {
+						return d.Errf("parsing compress min_length: %v", err)
+					}
+					m.CompressMinLength = int(size)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "first":
+				err = flag(d, &m.First)
+			case "last":
+				err = flag(d, &m.Last)
+			case "require_response_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				var value string
+				if d.NextArg() {
+					value = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.RequireResponseHeader == nil {
+					m.RequireResponseHeader = make(map[string]string)
+				}
+				m.RequireResponseHeader[name] = value
+			case "remove_keys":
+				err = listArgs(d, &m.RemoveKeys)
+			case "filters":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.Filters == nil {
+					m.Filters = make(map[string]string)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					name := d.Val()
+					var expr string
+					if err := singleArg(d, &expr); err != nil {
+						return err
+					}
+					m.Filters[name] = expr
+				}
+			case "filters_file":
+				err = singleArg(d, &m.FiltersFile)
+			case "filter_arg_param":
+				err = singleArg(d, &m.FilterArgParam)
+			case "filter_placeholder":
+				err = singleArg(d, &m.FilterPlaceholder)
+			case "filter_param":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.FilterParam = d.Val()
+				if d.NextArg() {
+					if d.Val() != "strict" {
+						return d.Errf("unrecognized filter_param option '%s'", d.Val())
+					}
+					m.StrictFilterParam = true
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "sort_param":
+				m.SortParam = "sort"
+				if d.NextArg() {
+					m.SortParam = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "jsonp":
+				m.JSONPParam = "callback"
+				if d.NextArg() {
+					m.JSONPParam = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "escape_html":
+				var s string
+				if err = singleArg(d, &s); err == nil {
+					escape, perr := strconv.ParseBool(s)
+					if perr != nil {
+						return d.Errf("invalid escape_html %q: %v", s, perr)
+					}
+					m.EscapeHTML = &escape
+				}
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flag sets a subdirective without arguments.
+func flag(d *caddyfile.Dispenser, dst *bool) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	*dst = true
+	return nil
+}
+
+// singleArg reads the only argument of a subdirective.
+func singleArg(d *caddyfile.Dispenser, dst *string) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	*dst = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// listArgs appends the arguments of a subdirective, of which there must
+// be at least one. The subdirective may be repeated.
+func listArgs(d *caddyfile.Dispenser, dst *[]string) error {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return d.ArgErr()
+	}
+	*dst = append(*dst, args...)
+	return nil
+}
+
+// intArg reads the only, integer argument of a subdirective.
+func intArg(d *caddyfile.Dispenser, dst *int) error {
+	name := d.Val()
+	var s string
+	if err := singleArg(d, &s); err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return d.Errf("invalid %s %q: %v", name, s, err)
+	}
+	*dst = n
+	return nil
+}
+
+// durationArg reads the only, duration argument of a subdirective.
+func durationArg(d *caddyfile.Dispenser, dst *caddy.Duration) error {
+	name := d.Val()
+	var s string
+	if err := singleArg(d, &s); err != nil {
+		return err
+	}
+	dur, err := caddy.ParseDuration(s)
+	if err != nil {
+		return d.Errf("invalid %s %q: %v", name, s, err)
+	}
+	*dst = caddy.Duration(dur)
+	return nil
+}
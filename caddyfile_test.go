@@ -0,0 +1,103 @@
+package jsonpathfilter
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		err   string
+	}{
+		{"empty", `jsonpath_filter`, `{}`, ""},
+		{"empty block", `jsonpath_filter {
+		}`, `{}`, ""},
+		{"options", `jsonpath_filter {
+			query_param q
+			content_types application/json application/vnd.api+json
+			strip_headers ETag Last-Modified
+			header X-Filter
+			default_expression $.data
+			cache_size 64
+			max_body_size 1MiB reject
+			pretty
+		}`, `{"query_param":"q","content_types":["application/json","application/vnd.api+json"],"strip_headers":["ETag","Last-Modified"],"header":"X-Filter","default_expression":"$.data","cache_size":64,"max_body_size":1048576,"reject_large_body":true,"pretty":true}`, ""},
+		{"allow block", `jsonpath_filter {
+			allow $.a {
+				$.b
+			}
+		}`, `{"allow":["$.a","$.b"]}`, ""},
+		{"unknown subdirective", `jsonpath_filter {
+			query_parm q
+		}`, "", "unrecognized subdirective 'query_parm'"},
+		{"directive argument", `jsonpath_filter $.a`, "", "wrong argument count"},
+		{"missing argument", `jsonpath_filter {
+			query_param
+		}`, "", "wrong argument count"},
+		{"extra argument", `jsonpath_filter {
+			header X-A X-B
+		}`, "", "wrong argument count"},
+		{"invalid cache size", `jsonpath_filter {
+			cache_size many
+		}`, "", "invalid cache_size"},
+		{"invalid max body size", `jsonpath_filter {
+			max_body_size huge
+		}`, "", "parsing max_body_size"},
+		{"enable header", `jsonpath_filter {
+			enable_header X-Canary
+		}`, `{"enable_header":"X-Canary"}`, ""},
+		{"enable header value", `jsonpath_filter {
+			enable_header X-Canary on
+		}`, `{"enable_header":"X-Canary","enable_header_value":"on"}`, ""},
+		{"enable header extra argument", `jsonpath_filter {
+			enable_header X-Canary on off
+		}`, "", "wrong argument count"},
+		{"round", `jsonpath_filter {
+			round 0
+		}`, `{"round":0}`, ""},
+		{"bypass param", `jsonpath_filter {
+			bypass_param expand
+		}`, `{"bypass_param":"expand"}`, ""},
+		{"bypass param value", `jsonpath_filter {
+			bypass_param expand=true
+		}`, `{"bypass_param":"expand","bypass_param_value":"true"}`, ""},
+		{"set header", `jsonpath_filter {
+			set_header X-Filtered-By jsonpath
+			set_header X-User {http.request.header.X-Name} passthrough
+		}`, `{"set_headers":{"X-Filtered-By":"jsonpath","X-User":"{http.request.header.X-Name}"},"set_headers_pass_through":true}`, ""},
+		{"set header missing value", `jsonpath_filter {
+			set_header X-Filtered-By
+		}`, "", "wrong argument count"},
+		{"set header unknown option", `jsonpath_filter {
+			set_header X-Filtered-By jsonpath always
+		}`, "", "unrecognized set_header option 'always'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m ResponseFilter
+			err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("UnmarshalCaddyfile = %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UnmarshalCaddyfile: %v", err)
+			}
+			got, err := json.Marshal(&m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("config = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package jsonpathfilter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// parseCIDRs parses CIDR ranges. A bare IP address is a range holding
+// only that address, and "private_ranges" stands for all private and
+// loopback ranges.
+func parseCIDRs(ranges []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ranges))
+	for _, s := range ranges {
+		if s == "private_ranges" {
+			private, err := parseCIDRs(caddyhttp.PrivateRangesCIDR())
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, private...)
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether one of nets contains ip.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that sent r, or nil if it
+// cannot be determined. If the connection comes from one of the trusted
+// proxies, the X-Forwarded-For chain is walked from right to left and the
+// first address that is not a trusted proxy is returned, so clients
+// cannot spoof their address by prepending entries. Without an
+// X-Forwarded-For header, X-Real-IP is used.
+func (m *ResponseFilter) clientIP(r *http.Request) net.IP {
+	ip := parseIP(r.RemoteAddr)
+	if ip == nil || !containsIP(m.trustedNets, ip) {
+		return ip
+	}
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		if realIP := parseIP(r.Header.Get("X-Real-IP")); realIP != nil {
+			return realIP
+		}
+		return ip
+	}
+	chain := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := parseIP(chain[i])
+		if hop == nil {
+			// Entries left of a malformed one cannot be trusted
+			return ip
+		}
+		ip = hop
+		if !containsIP(m.trustedNets, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// parseIP parses an IP address, optionally with a port or zone, as found
+// in RemoteAddr and forwarding headers.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s, _, _ = strings.Cut(s, "%")
+	return net.ParseIP(s)
+}
+
+// isBypassed reports whether r comes from a client in BypassCIDRs.
+func (m *ResponseFilter) isBypassed(r *http.Request) bool {
+	if len(m.bypassNets) == 0 {
+		return false
+	}
+	ip := m.clientIP(r)
+	return ip != nil && containsIP(m.bypassNets, ip)
+}
+
+// debugDiff reports whether r asks for the effect of the filter with the
+// debug_diff flag and AllowDebugDiff permits it.
+func (m *ResponseFilter) debugDiff(r *http.Request) bool {
+	if !m.AllowDebugDiff || !queryFlag(r, "debug_diff") {
+		return false
+	}
+	if len(m.diffNets) == 0 {
+		return true
+	}
+	ip := m.clientIP(r)
+	return ip != nil && containsIP(m.diffNets, ip)
+}
+
+// engineKey is the request context key of the engine selected by the
+// client.
+type engineKey struct{}
+
+// exprEngine is an expression engine and the cache of the expressions it
+// compiled.
+type exprEngine struct {
+	name  string
+	exprs *exprCache
+}
+
+// engine returns the engine in effect for the request with context ctx:
+// the one the client selected, as permitted by selectEngine, or else the
+// configured one.
+func (m *ResponseFilter) engine(ctx context.Context) exprEngine {
+	if e, ok := ctx.Value(engineKey{}).(exprEngine); ok {
+		return e
+	}
+	return exprEngine{m.Engine, m.exprs}
+}
+
+// selectEngine returns r, with the engine it selects with the engine
+// query parameter in its context if AllowEngineOverride permits it.
+func (m *ResponseFilter) selectEngine(r *http.Request) *http.Request {
+	if !m.AllowEngineOverride {
+		return r
+	}
+	engine := r.URL.Query().Get("engine")
+	exprs, ok := m.engines[engine]
+	if !ok || engine == m.Engine {
+		return r
+	}
+	if len(m.overrideNets) > 0 {
+		if ip := m.clientIP(r); ip == nil || !containsIP(m.overrideNets, ip) {
+			return r
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), engineKey{}, exprEngine{engine, exprs}))
+}
+
+// checkEngine returns an error if the client selected an engine that
+// cannot compile the configured expressions applied to r: Root, When and
+// exprs, unless they come from the client.
+func (m *ResponseFilter) checkEngine(r *http.Request, exprs []string, fromClient bool) error {
+	eng, ok := r.Context().Value(engineKey{}).(exprEngine)
+	if !ok {
+		return nil
+	}
+	configured := []string{m.Root, m.When}
+	if !fromClient {
+		configured = append(configured, exprs...)
+	}
+	for _, expr := range configured {
+		if expr == "" {
+			continue
+		}
+		if err := m.checkSyntax(eng, expr); err != nil {
+			return withCode(codeInvalidRequest, fmt.Errorf("engine %s cannot evaluate configured expression %q", eng.name, expr))
+		}
+	}
+	return nil
+}
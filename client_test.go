@@ -0,0 +1,147 @@
+package jsonpathfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestEngineOverride(t *testing.T) {
+	const doc = `{"a":1,"b":{"a":2}}`
+	tests := []struct {
+		name       string
+		m          ResponseFilter
+		target     string
+		remoteAddr string
+		status     int
+		want       string
+	}{
+		{"default engine", ResponseFilter{}, "/?jsonpath_filter=$.a", "10.0.0.1:1234", http.StatusOK, "1"},
+		{"permitted", ResponseFilter{}, "/?engine=jq&jsonpath_filter=.a", "10.0.0.1:1234", http.StatusOK, "1"},
+		{"ignored for client", ResponseFilter{}, "/?engine=jq&jsonpath_filter=$.a", "192.0.2.1:1234", http.StatusOK, "1"},
+		{"ignored when disallowed", ResponseFilter{AllowEngineOverride: false}, "/?engine=jq&jsonpath_filter=$.a", "10.0.0.1:1234", http.StatusOK, "1"},
+		{"unknown engine", ResponseFilter{}, "/?engine=xpath&jsonpath_filter=$.a", "10.0.0.1:1234", http.StatusOK, "1"},
+		{"configured engine", ResponseFilter{}, "/?engine=jsonpath&jsonpath_filter=$.a", "10.0.0.1:1234", http.StatusOK, "1"},
+		{"from jq", ResponseFilter{Engine: "jq"}, "/?engine=jsonpath&jsonpath_filter=$.b.a", "10.0.0.1:1234", http.StatusOK, "2"},
+		{"root", ResponseFilter{Root: "$"}, "/?engine=jq&jsonpath_filter=.a", "10.0.0.1:1234", http.StatusBadRequest, ""},
+		{"default expression", ResponseFilter{DefaultExpression: "$.b"}, "/?engine=jq", "10.0.0.1:1234", http.StatusBadRequest, ""},
+		{"client expression", ResponseFilter{DefaultExpression: "$.b"}, "/?engine=jq&jsonpath_filter=.b.a", "10.0.0.1:1234", http.StatusOK, "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			if tt.name != "ignored when disallowed" {
+				m.AllowEngineOverride = true
+				m.EngineOverrideCIDRs = []string{"10.0.0.0/8"}
+			}
+			provision(t, &m)
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.RemoteAddr = tt.remoteAddr
+			rr := serveRequest(t, &m, req, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if tt.want != "" && rr.Body.String() != tt.want {
+				t.Errorf("body = %s, want %s", rr.Body, tt.want)
+			}
+
+			// The override must not stick to the handler
+			target := "/?jsonpath_filter=" + url.QueryEscape(map[string]string{"jsonpath": "$", "jq": "."}[m.Engine])
+			if rr := serve(t, &m, target, respond(http.StatusOK, "application/json", `[1]`)); rr.Body.String() != "[1]" {
+				t.Errorf("next request: body = %s, want [1]", rr.Body)
+			}
+		})
+	}
+}
+
+func TestBypassCIDRs(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	tests := []struct {
+		name       string
+		remoteAddr string
+		bypassed   bool
+	}{
+		{"inside", "10.1.2.3:1234", true},
+		{"outside", "192.0.2.1:1234", false},
+		{"bare address", "198.51.100.7:1234", true},
+		{"ipv6 inside", "[fd00::1]:1234", true},
+		{"ipv6 outside", "[2001:db8::1]:1234", false},
+		{"ipv6 zone", "[fd00::1%eth0]:1234", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{BypassCIDRs: []string{"10.0.0.0/8", "198.51.100.7", "fd00::/8"}}
+			provision(t, m)
+			req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.a", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rr := serveRequest(t, m, req, respond(http.StatusOK, "application/json", doc))
+			want := "1"
+			if tt.bypassed {
+				want = doc
+			}
+			if got := rr.Body.String(); got != want {
+				t.Errorf("body = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    []string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{"untrusted spoof", nil, "192.0.2.1:1234", []string{"10.0.0.1"}, "", "192.0.2.1"},
+		{"untrusted real ip", nil, "192.0.2.1:1234", nil, "10.0.0.1", "192.0.2.1"},
+		{"trusted", []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"spoofed chain", []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"10.0.0.1, 198.51.100.1"}, "", "198.51.100.1"},
+		{"proxy chain", []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"198.51.100.1, 172.16.0.2"}, "", "198.51.100.1"},
+		{"repeated headers", []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"198.51.100.1", "172.16.0.2"}, "", "198.51.100.1"},
+		{"all trusted", []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"172.16.0.3"}, "", "172.16.0.3"},
+		{"malformed entry", []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"10.0.0.1, bogus, 172.16.0.2"}, "", "172.16.0.2"},
+		{"real ip", []string{"172.16.0.0/12"}, "172.16.0.1:1234", nil, "198.51.100.1", "198.51.100.1"},
+		{"forwarded wins", []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"198.51.100.1"}, "10.0.0.1", "198.51.100.1"},
+		{"private ranges", []string{"private_ranges"}, "[::1]:1234", []string{"2001:db8::1"}, "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{TrustedProxies: tt.trusted}
+			provision(t, m)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := m.clientIP(req).String(); got != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// A spoofed header only bypasses the filter through a trusted proxy
+	const doc = `{"a":1}`
+	for _, tt := range []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.1:1234", "1"},
+		{"172.16.0.1:1234", doc},
+	} {
+		m := &ResponseFilter{BypassCIDRs: []string{"10.0.0.0/8"}, TrustedProxies: []string{"172.16.0.0/12"}}
+		provision(t, m)
+		req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.a", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		if got := serveRequest(t, m, req, respond(http.StatusOK, "application/json", doc)).Body.String(); got != tt.want {
+			t.Errorf("from %s: body = %s, want %s", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package jsonpathfilter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// errDecodedTooLarge reports that a body decompressed to more than the
+// size limit.
+var errDecodedTooLarge = errors.New("decoded body too large")
+
+// decodeBody returns body decoded according to the Content-Encoding
+// header value enc. An empty or "identity" encoding returns body as is.
+// If max is positive, no more than max+1 decoded bytes are read, and
+// errDecodedTooLarge is returned for bodies decoding to more than max.
+func decodeBody(enc string, body []byte, max int64) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch normalizeEncoding(enc) {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	case "br":
+		r = io.NopCloser(brotli.NewReader(bytes.NewReader(body)))
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", enc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if max <= 0 {
+		return io.ReadAll(r)
+	}
+	decoded, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > max {
+		return nil, errDecodedTooLarge
+	}
+	return decoded, nil
+}
+
+// encodeBody compresses body with the Content-Encoding enc. It is the
+// inverse of decodeBody.
+func encodeBody(enc string, body []byte) ([]byte, error) {
+	if n := normalizeEncoding(enc); n == "" || n == "identity" {
+		return body, nil
+	}
+	var buf bytes.Buffer
+	w, err := newEncoder(enc, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newEncoder returns a writer compressing to w with the Content-Encoding
+// enc. Closing it does not close w.
+func newEncoder(enc string, w io.Writer) (io.WriteCloser, error) {
+	switch normalizeEncoding(enc) {
+	case "", "identity":
+		return nopCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "deflate":
+		return zlib.NewWriter(w), nil
+	case "br":
+		return brotli.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", enc)
+	}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// acceptsGzip reports whether the Accept-Encoding header of r admits gzip
+// with a non-zero q-value. An explicit gzip entry takes precedence over
+// "*", so that "gzip;q=0, *" refuses gzip.
+func acceptsGzip(r *http.Request) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			switch normalizeEncoding(name) {
+			case "gzip":
+				gzipQ = qValue(params)
+			case "*":
+				anyQ = qValue(params)
+			}
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// qValue returns the q-value in the parameters params of an
+// Accept-Encoding entry: 1 if there is none, 0 if it is malformed.
+func qValue(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		q, ok := strings.CutPrefix(strings.ToLower(strings.TrimSpace(param)), "q=")
+		if !ok {
+			continue
+		}
+		qv, err := strconv.ParseFloat(q, 64)
+		if err != nil || qv < 0 {
+			return 0
+		}
+		return qv
+	}
+	return 1
+}
+
+func normalizeEncoding(enc string) string {
+	return strings.ToLower(strings.TrimSpace(enc))
+}
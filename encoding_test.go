@@ -0,0 +1,250 @@
+package jsonpathfilter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func gzipBytes(tb testing.TB, b []byte) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		tb.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeBodyLimit(t *testing.T) {
+	doc := []byte(`{"a":"` + strings.Repeat("x", 1000) + `"}`)
+	encoded := map[string][]byte{"identity": doc}
+	for _, enc := range []string{"gzip", "deflate", "br"} {
+		var err error
+		if encoded[enc], err = encodeBody(enc, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for enc, body := range encoded {
+		for _, tt := range []struct {
+			max int64
+			err error
+		}{
+			{0, nil},
+			{int64(len(doc)), nil},
+			{int64(len(doc)) - 1, errDecodedTooLarge},
+		} {
+			decoded, err := decodeBody(enc, body, tt.max)
+			if enc == "identity" {
+				// Identity bodies were limited as they were recorded
+				tt.err = nil
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s with limit %d: err = %v, want %v", enc, tt.max, err, tt.err)
+			}
+			if tt.err == nil && !bytes.Equal(decoded, doc) {
+				t.Errorf("%s with limit %d: decoded %d bytes, want %d", enc, tt.max, len(decoded), len(doc))
+			}
+		}
+	}
+}
+
+func TestGzipBomb(t *testing.T) {
+	// 4 MiB of JSON compressing to a few KiB
+	doc := []byte(`{"a":1,"pad":"` + strings.Repeat("0", 4<<20) + `"}`)
+	bomb := gzipBytes(t, doc)
+	tests := []struct {
+		name   string
+		reject bool
+		status int
+	}{
+		{"pass through", false, http.StatusOK},
+		{"reject", true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{MaxBodySize: 64 << 10, RejectLargeBody: tt.reject}
+			provision(t, m)
+			if int64(len(bomb)) > m.MaxBodySize {
+				t.Fatalf("compressed body is %d bytes, want it under the limit", len(bomb))
+			}
+			var calls int
+			next := countingUpstream(&calls, map[string]string{"Content-Encoding": "gzip"}, bomb)
+			rr := serve(t, m, "/?jsonpath_filter=$.a", next)
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if !tt.reject && !bytes.Equal(rr.Body.Bytes(), bomb) {
+				t.Errorf("body is %d bytes, want the %d compressed upstream bytes", rr.Body.Len(), len(bomb))
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header []string
+		want   bool
+	}{
+		{nil, false},
+		{[]string{"gzip"}, true},
+		{[]string{"GZIP"}, true},
+		{[]string{"br, gzip;q=0.5"}, true},
+		{[]string{"gzip;q=0"}, false},
+		{[]string{"gzip; Q=0.0"}, false},
+		{[]string{"gzip;q=bogus"}, false},
+		{[]string{"*"}, true},
+		{[]string{"*;q=0"}, false},
+		{[]string{"gzip;q=0, *"}, false},
+		{[]string{"*, gzip;q=0"}, false},
+		{[]string{"gzip", "*;q=0"}, true},
+		{[]string{"br", "gzip;q=0", "*"}, false},
+		{[]string{"identity"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.header, " | "), func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/", nil)
+			for _, v := range tt.header {
+				r.Header.Add("Accept-Encoding", v)
+			}
+			if got := acceptsGzip(r); got != tt.want {
+				t.Errorf("acceptsGzip = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	for _, enc := range []string{"gzip", "deflate", "br", "GZIP"} {
+		t.Run(enc, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			body, err := encodeBody(enc, []byte(doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var calls int
+			rr := serve(t, m, "/?jsonpath_filter=$.a", countingUpstream(&calls, map[string]string{"Content-Encoding": enc}, body))
+			if got := rr.Header().Get("Content-Encoding"); got != enc {
+				t.Errorf("Content-Encoding = %q, want %q", got, enc)
+			}
+			if got, want := rr.Header().Get("Content-Length"), strconv.Itoa(rr.Body.Len()); got != want {
+				t.Errorf("Content-Length = %q, want %q", got, want)
+			}
+			decoded, err := decodeBody(enc, rr.Body.Bytes(), 0)
+			if err != nil {
+				t.Fatalf("decoding filtered body: %v", err)
+			}
+			if string(decoded) != "1" {
+				t.Errorf("decoded body = %q, want %q", decoded, "1")
+			}
+		})
+	}
+	t.Run("corrupt", func(t *testing.T) {
+		m := new(ResponseFilter)
+		provision(t, m)
+		var calls int
+		rr := serve(t, m, "/?jsonpath_filter=$.a", countingUpstream(&calls, map[string]string{"Content-Encoding": "gzip"}, []byte(doc)))
+		if got := rr.Body.String(); got != doc {
+			t.Errorf("body = %q, want the original %q", got, doc)
+		}
+	})
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat("x", 600)
+	doc := `{"small":"x","large":"` + large + `"}`
+	tests := []struct {
+		name           string
+		m              ResponseFilter
+		target         string
+		acceptEncoding string
+		upstreamGzip   bool
+		encoding       string
+		want           string
+	}{
+		{"above threshold", ResponseFilter{Compress: true}, "/?jsonpath_filter=$.large", "gzip, br", false, "gzip", large},
+		{"below threshold", ResponseFilter{Compress: true}, "/?jsonpath_filter=$.small", "gzip", false, "", "x"},
+		{"custom threshold", ResponseFilter{Compress: true, CompressMinLength: 1}, "/?jsonpath_filter=$.small", "gzip", false, "gzip", "x"},
+		{"not accepted", ResponseFilter{Compress: true}, "/?jsonpath_filter=$.large", "br", false, "", large},
+		{"upstream compressed", ResponseFilter{Compress: true}, "/?jsonpath_filter=$.large", "gzip", true, "gzip", large},
+		{"disabled", ResponseFilter{}, "/?jsonpath_filter=$.large", "gzip", false, "", large},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			body, hdr := []byte(doc), map[string]string{}
+			if tt.upstreamGzip {
+				body, hdr["Content-Encoding"] = gzipBytes(t, body), "gzip"
+			}
+			var calls int
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rr := serveRequest(t, &m, req, countingUpstream(&calls, hdr, body))
+			if got := rr.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			if got, want := rr.Header().Get("Content-Length"), strconv.Itoa(rr.Body.Len()); got != want {
+				t.Errorf("Content-Length = %q, want %q", got, want)
+			}
+			decoded, err := decodeBody(tt.encoding, rr.Body.Bytes(), 0)
+			if err != nil {
+				t.Fatalf("decoding filtered body: %v", err)
+			}
+			if got, want := string(decoded), `"`+tt.want+`"`; got != want {
+				t.Errorf("decoded body = %.20q, want %.20q", got, want)
+			}
+		})
+	}
+}
+
+func TestBrotli(t *testing.T) {
+	const doc = `{"items":[{"id":1},{"id":2}],"meta":{"page":1}}`
+	var buf bytes.Buffer
+	bw := brotli.NewWriter(&buf)
+	bw.Write([]byte(doc))
+	bw.Close()
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     string
+	}{
+		{"brotli", "br", buf.Bytes(), `[1,2]`},
+		{"unsupported", "zstd", []byte("not really zstd"), "not really zstd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			var calls int
+			rr := serve(t, m, "/?jsonpath_filter=$.items[*].id", countingUpstream(&calls, map[string]string{"Content-Encoding": tt.encoding}, tt.body))
+			if got := rr.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			body := rr.Body.Bytes()
+			if tt.encoding == "br" {
+				var err error
+				if body, err = io.ReadAll(brotli.NewReader(bytes.NewReader(body))); err != nil {
+					t.Fatalf("decoding filtered body: %v", err)
+				}
+			}
+			if string(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
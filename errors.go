@@ -0,0 +1,248 @@
+package jsonpathfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/itchyny/gojq"
+)
+
+// exprError is an error that occurred while compiling or evaluating
+// the expression Expr.
+type exprError struct {
+	Expr string
+	Err  error
+}
+
+func (e *exprError) Error() string { return e.Err.Error() }
+
+func (e *exprError) Unwrap() error { return e.Err }
+
+// panicError is a panic recovered while compiling or evaluating an
+// expression, with the stack trace of the panicking goroutine.
+type panicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *panicError) Error() string { return fmt.Sprintf("evaluation panicked: %v", e.Value) }
+
+// syntaxError is an error compiling a malformed expression. Pos is the
+// 1-based position of the offending token in the expression, or 0 if the
+// parser did not report it.
+type syntaxError struct {
+	Err error
+	Pos int
+}
+
+func (e *syntaxError) Error() string { return e.Err.Error() }
+
+func (e *syntaxError) Unwrap() error { return e.Err }
+
+// parsePosition matches the line and column of JSONPath parse errors, as
+// in "parsing error: $[\t:1:3 - 1:3 unexpected EOF".
+var parsePosition = regexp.MustCompile(`\t:\d+:(\d+) - \d+:\d+ `)
+
+// newSyntaxError wraps the compile error err, extracting the position
+// reported by the JSONPath or jq parser.
+func newSyntaxError(err error) *syntaxError {
+	se := &syntaxError{Err: err}
+	var pe *gojq.ParseError
+	if errors.As(err, &pe) {
+		se.Pos = pe.Offset - len(pe.Token) + 1
+	} else if m := parsePosition.FindStringSubmatch(err.Error()); m != nil {
+		se.Pos, _ = strconv.Atoi(m[1])
+	}
+	return se
+}
+
+// Error codes identify the kind of failure in JSON error responses, for
+// clients and gateways that classify errors.
+const (
+	// codeInvalidExpression: an expression is malformed (422).
+	codeInvalidExpression = "invalid_expression"
+	// codeEvaluationError: an expression failed to evaluate (400).
+	codeEvaluationError = "evaluation_error"
+	// codeTimeout: evaluation exceeded eval_timeout (504).
+	codeTimeout = "timeout"
+	// codeTooDeep: the document is too deep for recursive descent (400).
+	codeTooDeep = "too_deep"
+	// codeNotAllowed: the expression is not on the allow list (403).
+	codeNotAllowed = "not_allowed"
+	// codeNotJSON: the upstream response cannot be filtered (406).
+	codeNotJSON = "not_json"
+	// codeTooLarge: the upstream body exceeds max_body_size (413).
+	codeTooLarge = "too_large"
+	// codeTooManyMatches: the result exceeds max_matches (400).
+	codeTooManyMatches = "too_many_matches"
+	// codeNotTabular: the result cannot be written as CSV (406).
+	codeNotTabular = "not_tabular"
+	// codeNotArray: the result cannot be written as lines (406).
+	codeNotArray = "not_array"
+	// codeInvalidRequest: a query parameter is invalid (400).
+	codeInvalidRequest = "invalid_request"
+	// codeUpstreamError: the upstream failed and redact_errors is set (5xx).
+	codeUpstreamError = "upstream_error"
+	// codeSchemaMismatch: the result does not match validate_schema (500).
+	codeSchemaMismatch = "schema_mismatch"
+	// codeRangeNotSatisfiable: the items range starts past the end (416).
+	codeRangeNotSatisfiable = "range_not_satisfiable"
+)
+
+// codedError attaches an error code to Err.
+type codedError struct {
+	Code string
+	Err  error
+}
+
+func (e *codedError) Error() string { return e.Err.Error() }
+
+func (e *codedError) Unwrap() error { return e.Err }
+
+// withCode returns err with the error code code.
+func withCode(code string, err error) error {
+	return &codedError{code, err}
+}
+
+// errorCode returns the error code of err: the one attached with
+// withCode, else the one implied by the kind of expression error, else
+// codeInvalidRequest.
+func errorCode(err error) string {
+	var ce *codedError
+	var se *syntaxError
+	var ee *exprError
+	switch {
+	case errors.As(err, &ce):
+		return ce.Code
+	case errors.As(err, &se):
+		return codeInvalidExpression
+	case errors.Is(err, errEvalTimeout):
+		return codeTimeout
+	case errors.Is(err, errTooDeep):
+		return codeTooDeep
+	case errors.As(err, &ee):
+		return codeEvaluationError
+	default:
+		return codeInvalidRequest
+	}
+}
+
+// errEvalTimeout reports that evaluating the expressions took longer than
+// the configured timeout.
+var errEvalTimeout = errors.New("expression evaluation timed out")
+
+// errTooDeep reports that an expression with recursive descent was
+// applied to a document nested deeper than the configured limit.
+var errTooDeep = errors.New("document too deeply nested for recursive descent")
+
+// evalStatus returns the status code of an error response for the failed
+// evaluation err.
+func evalStatus(err error) int {
+	var se *syntaxError
+	switch {
+	case errors.Is(err, errEvalTimeout):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &se):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
+
+// errorBody is the JSON error response body. Code is one of the error
+// codes above; Position is the 1-based position of a syntax error in
+// Expression.
+type errorBody struct {
+	Error      string `json:"error"`
+	Code       string `json:"code"`
+	Expression string `json:"expression,omitempty"`
+	Position   int    `json:"position,omitempty"`
+}
+
+// problemBody is the body of an error response in the RFC 7807 problem
+// details format. The error code, expression and position are extension
+// members.
+type problemBody struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail"`
+	Code       string `json:"code"`
+	Expression string `json:"expression,omitempty"`
+	Position   int    `json:"position,omitempty"`
+}
+
+// writeError writes an error response with the given status, formatted
+// according to the configured error format. If err is an *exprError the
+// offending expression is echoed back, together with the position of a
+// *syntaxError. Upstream headers describing the original body are removed
+// first, as are the total count and truncation headers; all other
+// headers, notably CORS headers set by the upstream or earlier handlers,
+// are kept, so that browsers expose the real status to scripts. Errors
+// written before the upstream is called, as in request mode, only carry
+// the latter.
+func (m *ResponseFilter) writeError(w http.ResponseWriter, r *http.Request, status int, err error) error {
+	hdr := w.Header()
+	for _, name := range bodyHeaders {
+		hdr.Del(name)
+	}
+	hdr.Del("Content-Encoding")
+	takeTrailers(hdr)
+	hdr.Del("Trailer")
+	if m.TotalCount {
+		hdr.Del(totalCountHeader)
+	}
+	if m.MaxMatches > 0 {
+		hdr.Del(truncatedHeader)
+	}
+	m.setDebugHeader(hdr, "error")
+	traceError(r, err)
+
+	var expr string
+	var ee *exprError
+	if errors.As(err, &ee) {
+		expr = ee.Expr
+	}
+	var pos int
+	var se *syntaxError
+	if errors.As(err, &se) {
+		pos = se.Pos
+	}
+
+	if m.ErrorFormat == "text" {
+		msg := err.Error()
+		if expr != "" {
+			msg = fmt.Sprintf("JSONPath error: %v", err)
+		}
+		http.Error(w, msg, status)
+		return nil
+	}
+
+	var v interface{} = errorBody{Error: err.Error(), Code: errorCode(err), Expression: expr, Position: pos}
+	ct := "application/json"
+	if m.ErrorFormat == "problem" {
+		v = problemBody{
+			Type:       "about:blank",
+			Title:      http.StatusText(status),
+			Status:     status,
+			Detail:     err.Error(),
+			Code:       errorCode(err),
+			Expression: expr,
+			Position:   pos,
+		}
+		ct = "application/problem+json"
+	}
+	body, merr := json.Marshal(v)
+	if merr != nil {
+		return merr
+	}
+	hdr.Set("Content-Type", ct)
+	hdr.Set("Content-Length", strconv.Itoa(len(body)))
+	hdr.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, werr := w.Write(body)
+	return m.abortBody(werr)
+}
@@ -0,0 +1,170 @@
+package jsonpathfilter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestErrorFormat(t *testing.T) {
+	tests := []struct {
+		format      string
+		contentType string
+	}{
+		{"", "application/json"},
+		{"json", "application/json"},
+		{"text", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			m := &ResponseFilter{ErrorFormat: tt.format}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter=$[", respond(http.StatusOK, "application/json", `{"a":1}`))
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if tt.format == "text" {
+				if !strings.HasPrefix(rr.Body.String(), "JSONPath error: ") {
+					t.Errorf("body = %q, want a JSONPath error", rr.Body.String())
+				}
+				return
+			}
+			var body errorBody
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding %s: %v", rr.Body, err)
+			}
+			if body.Error == "" || body.Expression != "$[" || body.Code != codeInvalidExpression {
+				t.Errorf("body = %+v, want an invalid_expression error for $[", body)
+			}
+		})
+	}
+}
+
+func TestProblemErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  []string
+		target string
+		status int
+		code   string
+	}{
+		{"syntax error", nil, "/?jsonpath_filter=$[", http.StatusUnprocessableEntity, codeInvalidExpression},
+		{"not allowed", []string{"$.a"}, "/?jsonpath_filter=$.b", http.StatusForbidden, codeNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{ErrorFormat: "problem", Allow: tt.allow}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", `{"a":1}`))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Header().Get("Content-Type"); got != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want %q", got, "application/problem+json")
+			}
+			var body map[string]interface{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding %s: %v", rr.Body, err)
+			}
+			for _, member := range []string{"type", "title", "status", "detail"} {
+				if _, ok := body[member]; !ok {
+					t.Errorf("body = %s, missing member %q", rr.Body, member)
+				}
+			}
+			if body["type"] != "about:blank" || body["title"] != http.StatusText(tt.status) || body["status"] != float64(tt.status) {
+				t.Errorf("body = %s, want type about:blank, title %q and status %d", rr.Body, http.StatusText(tt.status), tt.status)
+			}
+			if detail, _ := body["detail"].(string); detail == "" {
+				t.Errorf("detail = %v, want the error message", body["detail"])
+			}
+			if body["code"] != tt.code {
+				t.Errorf("code = %v, want %s", body["code"], tt.code)
+			}
+		})
+	}
+}
+
+func TestErrorCORS(t *testing.T) {
+	const origin = "https://app.example.com"
+	tests := []struct {
+		name     string
+		m        ResponseFilter
+		target   string
+		upstream bool
+		status   int
+	}{
+		{"syntax error", ResponseFilter{}, "/?jsonpath_filter=$[", false, http.StatusUnprocessableEntity},
+		{"invalid offset", ResponseFilter{Paginate: true}, "/?jsonpath_filter=$.a&offset=x", true, http.StatusBadRequest},
+		{"evaluation error", ResponseFilter{Engine: "jq"}, "/?jsonpath_filter=.a.b", true, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := httptest.NewRecorder()
+			var next caddyhttp.Handler = respond(http.StatusOK, "application/json", `{"a":1}`)
+			if tt.upstream {
+				var calls int
+				next = countingUpstream(&calls, map[string]string{"Access-Control-Allow-Origin": origin}, []byte(`{"a":1}`))
+			} else {
+				rr.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if err := m.ServeHTTP(rr, req, next); err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Origin"); got != origin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, origin)
+			}
+		})
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	const doc = `{"a":[1,2,3],"o":{"x":{"y":1}}}`
+	tests := []struct {
+		name        string
+		m           ResponseFilter
+		target      string
+		contentType string
+		status      int
+		code        string
+	}{
+		{"invalid expression", ResponseFilter{}, "/?jsonpath_filter=$[", "application/json", http.StatusUnprocessableEntity, codeInvalidExpression},
+		{"evaluation error", ResponseFilter{Engine: "jq"}, "/?jsonpath_filter=.a.b", "application/json", http.StatusBadRequest, codeEvaluationError},
+		{"too deep", ResponseFilter{MaxDepth: 1}, "/?jsonpath_filter=$..y", "application/json", http.StatusBadRequest, codeTooDeep},
+		{"not allowed", ResponseFilter{Allow: []string{"$.o"}}, "/?jsonpath_filter=$.a", "application/json", http.StatusForbidden, codeNotAllowed},
+		{"not json", ResponseFilter{StrictContentType: true}, "/?jsonpath_filter=$.a", "text/html", http.StatusNotAcceptable, codeNotJSON},
+		{"too large", ResponseFilter{MaxBodySize: 8, RejectLargeBody: true}, "/?jsonpath_filter=$.a", "application/json", http.StatusRequestEntityTooLarge, codeTooLarge},
+		{"too many matches", ResponseFilter{MaxMatches: 2, RejectExcessMatches: true}, "/?jsonpath_filter=$.a", "application/json", http.StatusBadRequest, codeTooManyMatches},
+		{"not tabular", ResponseFilter{Format: "csv", StrictFormat: true}, "/?jsonpath_filter=$.o", "application/json", http.StatusNotAcceptable, codeNotTabular},
+		{"invalid request", ResponseFilter{Paginate: true}, "/?jsonpath_filter=$.a&offset=x", "application/json", http.StatusBadRequest, codeInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, tt.target, respond(http.StatusOK, tt.contentType, doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			var body errorBody
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding %s: %v", rr.Body, err)
+			}
+			if body.Code != tt.code || body.Error == "" {
+				t.Errorf("body = %+v, want code %s", body, tt.code)
+			}
+		})
+	}
+}
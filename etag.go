@@ -0,0 +1,44 @@
+package jsonpathfilter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// weakETag returns a weak entity tag for the filtered output body. It is
+// weak because the body may still be compressed, which does not change
+// its meaning.
+func weakETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified reports whether r is a GET or HEAD request whose
+// If-None-Match header matches etag, using the weak comparison.
+func notModified(r *http.Request, etag string) bool {
+	if etag == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	opaque := strings.TrimPrefix(etag, "W/")
+	for _, value := range r.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == opaque {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeNotModified responds with 304 Not Modified, keeping the ETag and
+// caching headers in hdr but not those describing the omitted body.
+func writeNotModified(w http.ResponseWriter, hdr http.Header) error {
+	hdr.Del("Content-Encoding")
+	hdr.Del("Content-Length")
+	hdr.Del("Trailer")
+	w.WriteHeader(http.StatusNotModified)
+	return nil
+}
@@ -0,0 +1,48 @@
+package jsonpathfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestETag(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	etag := weakETag([]byte("1"))
+	tests := []struct {
+		name        string
+		target      string
+		ifNoneMatch string
+		status      int
+		etag        string
+	}{
+		{"no condition", "/?jsonpath_filter=$.a", "", http.StatusOK, etag},
+		{"matching", "/?jsonpath_filter=$.a", etag, http.StatusNotModified, etag},
+		{"strong form", "/?jsonpath_filter=$.a", etag[len("W/"):], http.StatusNotModified, etag},
+		{"in list", "/?jsonpath_filter=$.a", `"other", ` + etag, http.StatusNotModified, etag},
+		{"any", "/?jsonpath_filter=$.a", "*", http.StatusNotModified, etag},
+		{"not matching", "/?jsonpath_filter=$.a", `W/"other"`, http.StatusOK, etag},
+		{"other filter", "/?jsonpath_filter=$.b", etag, http.StatusOK, weakETag([]byte("2"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{ETag: true}
+			provision(t, m)
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			var calls int
+			rr := serveRequest(t, m, req, countingUpstream(&calls, map[string]string{"ETag": `"upstream"`}, []byte(doc)))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Header().Get("ETag"); got != tt.etag {
+				t.Errorf("ETag = %q, want %q", got, tt.etag)
+			}
+			if tt.status == http.StatusNotModified && (rr.Body.Len() != 0 || rr.Header().Get("Content-Length") != "") {
+				t.Errorf("304 response has body %q and Content-Length %q", rr.Body.String(), rr.Header().Get("Content-Length"))
+			}
+		})
+	}
+}
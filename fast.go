@@ -0,0 +1,198 @@
+package jsonpathfilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+// simpleSelector matches expressions selecting a single node by a chain
+// of plain member names and element indexes, such as $.items,
+// $.data.items[0].name or $[0].
+var simpleSelector = regexp.MustCompile(`^\$(?:\.[A-Za-z_][A-Za-z0-9_]*|\[[0-9]+\])+$`)
+
+// selectorStep matches one member name or element index of a simple
+// selector.
+var selectorStep = regexp.MustCompile(`\.([A-Za-z_][A-Za-z0-9_]*)|\[([0-9]+)\]`)
+
+// errNotSelectable reports that a document is not of the kind a simple
+// selector applies to.
+var errNotSelectable = errors.New("document does not match selector")
+
+// boundedSelect runs selectFast under the evaluation timeout, like
+// transform. A timeout is reported as a handled errEvalTimeout.
+func (m *ResponseFilter) boundedSelect(ctx context.Context, exprs []string, body []byte) (result interface{}, order keyOrder, handled bool, err error) {
+	type selection struct {
+		result  interface{}
+		order   keyOrder
+		handled bool
+	}
+	v, err := m.bounded(ctx, func(context.Context) (interface{}, error) {
+		result, order, handled, err := m.selectFast(m.engine(ctx), exprs, body)
+		return selection{result, order, handled}, err
+	})
+	if errors.Is(err, errEvalTimeout) {
+		return nil, nil, true, err
+	}
+	s := v.(selection)
+	return s.result, s.order, s.handled, err
+}
+
+// selectFast evaluates a single simple selector against body by scanning
+// it, without decoding the members or elements that are not selected, so
+// that large siblings of the selected node cost neither decoding nor
+// allocations. handled is false if exprs, the engine eng or the
+// configuration need the general path, which then yields the same result. Otherwise the selected
+// value and its key order are returned, or errNoMatch, or an error if
+// body is not JSON.
+func (m *ResponseFilter) selectFast(eng exprEngine, exprs []string, body []byte) (result interface{}, order keyOrder, handled bool, err error) {
+	if len(exprs) != 1 || eng.name != "jsonpath" || m.IncludePaths || m.Root != "" || m.When != "" ||
+		m.WrapArray != "" || m.IncludeHeaders || m.Batch != nil || len(m.removePaths) > 0 || len(m.removeKeys) > 0 {
+		return nil, nil, false, nil
+	}
+	if !simpleSelector.MatchString(exprs[0]) {
+		return nil, nil, false, nil
+	}
+	if !json.Valid(body) {
+		return nil, nil, true, errors.New("invalid JSON")
+	}
+	raw := body
+	for _, step := range selectorStep.FindAllStringSubmatch(exprs[0], -1) {
+		index := -1
+		if step[2] != "" {
+			if index, err = strconv.Atoi(step[2]); err != nil {
+				return nil, nil, false, nil
+			}
+		}
+		raw, err = selectRaw(raw, step[1], index)
+		if errors.Is(err, errNotSelectable) {
+			return nil, nil, false, nil
+		}
+		if err != nil {
+			return nil, nil, true, err
+		}
+	}
+	result, order, err = decodeJSON(raw, m.PreserveOrder)
+	return result, order, true, err
+}
+
+// selectRaw returns the encoded member key of the JSON object body, or
+// the element index of the JSON array body if index is not negative, as
+// a slice of body. Of duplicate keys the last one counts, as when
+// decoding. It returns errNotSelectable if body is not an object, or
+// array respectively, and errNoMatch if the member or element does not
+// exist. body must be valid JSON.
+func selectRaw(body []byte, key string, index int) (json.RawMessage, error) {
+	open := byte('{')
+	if index >= 0 {
+		open = '['
+	}
+	i := skipSpace(body, 0)
+	if i == len(body) || body[i] != open {
+		return nil, errNotSelectable
+	}
+	var found json.RawMessage
+	for n := 0; ; n++ {
+		i = skipSpace(body, i+1)
+		if body[i] == '}' || body[i] == ']' {
+			break
+		}
+		selected := n == index
+		if index < 0 {
+			end := skipString(body, i)
+			selected = isKey(body[i:end], key)
+			i = skipSpace(body, end) + 1
+		}
+		start := skipSpace(body, i)
+		end := skipValue(body, start)
+		if selected {
+			found = body[start:end]
+			if index >= 0 {
+				break
+			}
+		}
+		if i = skipSpace(body, end); body[i] != ',' {
+			break
+		}
+	}
+	if found == nil {
+		return nil, errNoMatch
+	}
+	return found, nil
+}
+
+// isKey reports whether the encoded JSON string s denotes key. Only keys
+// with escape sequences are decoded.
+func isKey(s []byte, key string) bool {
+	if bytes.IndexByte(s, '\\') < 0 {
+		return string(s[1:len(s)-1]) == key
+	}
+	var decoded string
+	return json.Unmarshal(s, &decoded) == nil && decoded == key
+}
+
+// skipSpace returns the offset of the first non-whitespace byte of body
+// at or after i, or len(body).
+func skipSpace(body []byte, i int) int {
+	for i < len(body) {
+		switch body[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipString returns the offset just past the JSON string starting at
+// body[i].
+func skipString(body []byte, i int) int {
+	for i++; i < len(body); i++ {
+		switch body[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return i
+}
+
+// skipValue returns the offset just past the JSON value starting at
+// body[i]. body must be valid JSON.
+func skipValue(body []byte, i int) int {
+	switch body[i] {
+	case '"':
+		return skipString(body, i)
+	case '{', '[':
+		depth := 0
+		for i < len(body) {
+			switch body[i] {
+			case '"':
+				i = skipString(body, i)
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				if depth--; depth == 0 {
+					return i + 1
+				}
+			}
+			i++
+		}
+		return i
+	}
+	// Numbers, true, false and null end at a delimiter
+	for i < len(body) {
+		switch body[i] {
+		case ',', '}', ']', ' ', '\t', '\n', '\r':
+			return i
+		}
+		i++
+	}
+	return i
+}
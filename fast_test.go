@@ -0,0 +1,153 @@
+package jsonpathfilter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSelectFast(t *testing.T) {
+	const doc = `{"a":{"b":[10,{"c":"x"}],"big":[1,2,3]} , "d":null,"ef":1,"f":2,"f":3,"s":"}]"}`
+	tests := []struct {
+		expr    string
+		handled bool
+	}{
+		{"$.a", true},
+		{"$.a.b[1].c", true},
+		{"$.a.b[0]", true},
+		{"$.d", true},
+		{"$.ef", true},
+		{"$.f", true},
+		{"$.s", true},
+		{"$.missing", true},
+		{"$.a.b[5]", true},
+		{"$.a.b.c", false},
+		{"$[0]", false},
+		{"$.a.*", false},
+		{"$..c", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			got, _, handled, err := m.selectFast(m.engine(context.Background()), []string{tt.expr}, []byte(doc))
+			if handled != tt.handled {
+				t.Fatalf("handled = %t, want %t", handled, tt.handled)
+			}
+			if !handled {
+				return
+			}
+			data, _, derr := decodeJSON([]byte(doc), false)
+			if derr != nil {
+				t.Fatal(derr)
+			}
+			want, werr := m.transform(context.Background(), []string{tt.expr}, data)
+			if errors.Is(werr, errNoMatch) != errors.Is(err, errNoMatch) {
+				t.Fatalf("err = %v, want %v", err, werr)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("result = %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+// largeDocument returns the encoding of {"id":1,"items":[...]} with n
+// items, and of the items array alone.
+func largeDocument(tb testing.TB, n int) (object, array []byte) {
+	tb.Helper()
+	items := make([]interface{}, n)
+	for i := range items {
+		items[i] = map[string]interface{}{"id": i, "name": "item " + strconv.Itoa(i), "tags": []string{"a", "b"}}
+	}
+	array, err := json.Marshal(items)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	object = append([]byte(`{"id":1,"items":`), array...)
+	return append(object, '}'), array
+}
+
+// benchmarkSelect compares selectFast on body to decoding body and
+// evaluating expr on the general path.
+func benchmarkSelect(b *testing.B, expr string, body []byte) {
+	m := new(ResponseFilter)
+	provision(b, m)
+	exprs := []string{expr}
+	b.Run("fast", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			if _, _, handled, err := m.selectFast(m.engine(context.Background()), exprs, body); !handled || err != nil {
+				b.Fatalf("selectFast = %t, %v", handled, err)
+			}
+		}
+	})
+	b.Run("decode", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			data, _, err := decodeJSON(body, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := m.transform(context.Background(), exprs, data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkSelectFast measures simple top-level selectors on a large
+// document.
+func BenchmarkSelectFast(b *testing.B) {
+	object, array := largeDocument(b, 10000)
+	b.Run("member", func(b *testing.B) { benchmarkSelect(b, "$.id", object) })
+	b.Run("index", func(b *testing.B) { benchmarkSelect(b, "$[0]", array) })
+}
+
+// BenchmarkSelectNested measures nested member and index paths whose
+// target is small but has a large sibling before and after it.
+func BenchmarkSelectNested(b *testing.B) {
+	_, array := largeDocument(b, 10000)
+	var body []byte
+	body = append(body, `{"before":`...)
+	body = append(body, array...)
+	body = append(body, `,"meta":{"info":{"tags":["x","y"],"name":"small"}},"after":`...)
+	body = append(body, array...)
+	body = append(body, '}')
+	b.Run("member", func(b *testing.B) { benchmarkSelect(b, "$.meta.info.name", body) })
+	b.Run("index", func(b *testing.B) { benchmarkSelect(b, "$.meta.info.tags[1]", body) })
+}
+
+func TestSelectRaw(t *testing.T) {
+	tests := []struct {
+		body  string
+		key   string
+		index int
+		want  string
+		err   error
+	}{
+		{`{"a":1,"b":[2]}`, "b", -1, `[2]`, nil},
+		{` { "a" : "x,}" , "b" : 2 } `, "b", -1, `2`, nil},
+		{`{"a":1,"a":2}`, "a", -1, `2`, nil},
+		{`{"a":1}`, "a", -1, `1`, nil},
+		{`{"a\"":1}`, `a"`, -1, `1`, nil},
+		{`{}`, "a", -1, "", errNoMatch},
+		{`[1,{"a":[]},3]`, "", 1, `{"a":[]}`, nil},
+		{`[ 1 , 2 ]`, "", 1, `2`, nil},
+		{`[]`, "", 0, "", errNoMatch},
+		{`[1]`, "a", -1, "", errNotSelectable},
+		{`{"a":1}`, "", 0, "", errNotSelectable},
+		{`"a"`, "a", -1, "", errNotSelectable},
+	}
+	for _, tt := range tests {
+		got, err := selectRaw([]byte(tt.body), tt.key, tt.index)
+		if !errors.Is(err, tt.err) || string(got) != tt.want {
+			t.Errorf("selectRaw(%s, %q, %d) = %s, %v, want %s, %v", tt.body, tt.key, tt.index, got, err, tt.want, tt.err)
+		}
+	}
+}
@@ -2,23 +2,791 @@ package jsonpathfilter
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/PaesslerAG/jsonpath"
 	"github.com/caddyserver/caddy/v2"
-	"github.com/caddyserver/caddy/v2/caddyhttp"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
+const (
+	debugHeader                = "X-JSONPath-Filter"
+	totalCountHeader           = "X-Total-Count"
+	truncatedHeader            = "X-Truncated"
+	defaultQueryParam          = "jsonpath_filter"
+	defaultCacheSize           = 1000
+	defaultMaxExpressionLength = 4096
+	defaultMinLength           = 512
+
+	// maxFilterArgs bounds the number of arguments of a named filter.
+	maxFilterArgs = 100
+)
+
+var defaultContentTypes = []string{"application/json", "+json"}
+
+// bodyHeaders describe the upstream body and are invalid once it has
+// been filtered.
+var bodyHeaders = []string{"Etag", "Content-Md5"}
+
 func init() {
 	caddy.RegisterModule(ResponseFilter{})
 }
 
-// ResponseFilter filters JSON responses using the "jsonpath_filter" query parameter.
-type ResponseFilter struct{}
+// ResponseFilter filters JSON responses using a JSONPath expression taken
+// from a query parameter ("jsonpath_filter" by default).
+//
+// Environment placeholders such as {env.TENANT_ID} in configured
+// expressions, i.e. in ExpressionPrefix, DefaultExpression, Allow,
+// AllowPrefix, TenantAllow, Remove, Root, When, StatusExpressions and
+// Filters, are replaced once during provisioning. Client-supplied
+// expressions are never expanded.
+type ResponseFilter struct {
+	// QueryParam is the name of the query parameter holding the JSONPath
+	// expression. Defaults to "jsonpath_filter".
+	QueryParam string `json:"query_param,omitempty"`
+
+	// ContentTypes lists the upstream media types that are filtered.
+	// Entries starting with "+" match any media type with that structured
+	// syntax suffix, e.g. "+json" matches application/hal+json. Entries
+	// containing "*" or "?" are glob patterns matched against the whole
+	// media type, e.g. "application/*+json" or "application/json*".
+	// Responses whose type matches no entry are streamed through
+	// verbatim. Media types are compared case-insensitively, so
+	// Application/JSON is filtered too. Defaults to "application/json" and
+	// "+json".
+	ContentTypes []string `json:"content_types,omitempty"`
+
+	// StripHeaders lists upstream response headers that are removed from
+	// filtered responses, e.g. headers describing the original body.
+	StripHeaders []string `json:"strip_headers,omitempty"`
+
+	// Header is the name of a request header holding the JSONPath
+	// expression. It is consulted only when the query parameter is absent
+	// or empty, so the lookup order is: query parameter, header, none.
+	// Without an expression the response is passed through.
+	Header string `json:"header,omitempty"`
+
+	// Expression is an expression built from placeholders, such as
+	// {http.request.header.X-Fields}, that are replaced per request. It is
+	// consulted after the query parameter and header; if it expands to an
+	// empty string, the default expression applies. As placeholders may
+	// hold client input, it is subject to the allow list.
+	Expression string `json:"expression,omitempty"`
+
+	// ExpressionPrefix is a JSONPath prepended to expressions from the
+	// query parameter or header, so that with "$.data" the client sends
+	// .items[*], items[*] or $.items[*] to apply $.data.items[*]. The
+	// allow list and errors refer to the combined expression. Unlike
+	// Root, the prefix is part of the expression itself.
+	ExpressionPrefix string `json:"expression_prefix,omitempty"`
+
+	// DefaultExpression is applied when the request supplies no
+	// expression. If empty, such responses are passed through.
+	DefaultExpression string `json:"default_expression,omitempty"`
+
+	// CacheSize bounds the number of compiled expressions kept in memory.
+	// Defaults to 1000; a negative value disables the cache.
+	CacheSize int `json:"cache_size,omitempty"`
+
+	// MaxExpressionLength bounds the length, in bytes, of client-supplied
+	// expressions, including ExpressionPrefix; longer ones are rejected
+	// with 400 Bad Request before they are compiled. Defaults to 4096; a
+	// negative value disables the limit.
+	MaxExpressionLength int `json:"max_expression_length,omitempty"`
+
+	// Allow lists the client-supplied expressions that may be applied.
+	// Other expressions are rejected with 403 Forbidden. When empty, and
+	// AllowPrefix is too, all expressions are allowed. The default
+	// expression is not checked.
+	Allow []string `json:"allow,omitempty"`
+
+	// AllowPrefix lists JSONPath paths, such as $.public, that client
+	// expressions may start with in addition to those in Allow, e.g.
+	// $.public.items[0] or $['public']..name but not $.publicity. Prefixes
+	// are compared by path segments, not characters, and may not have
+	// filters; expressions with slices or unions, or whose filters refer
+	// to the root with $, are never allowed by a prefix. Prefixes require
+	// the jsonpath engine and do not apply to tenants with TenantAllow.
+	AllowPrefix []string `json:"allow_prefix,omitempty"`
+
+	// TenantHeader names the request header identifying the tenant, such
+	// as X-Tenant or X-API-Key, for TenantAllow.
+	TenantHeader string `json:"tenant_header,omitempty"`
+
+	// TenantAllow maps tenants to the client-supplied expressions they may
+	// apply, replacing Allow for requests from that tenant; an empty list
+	// allows none. Requests from other tenants, or without TenantHeader,
+	// are checked against Allow.
+	TenantAllow map[string][]string `json:"tenant_allow,omitempty"`
+
+	// DenyUnknownTenants rejects all client-supplied expressions of
+	// requests from tenants missing from TenantAllow, instead of checking
+	// them against Allow.
+	DenyUnknownTenants bool `json:"deny_unknown_tenants,omitempty"`
+
+	// MaxBodySize is the largest recorded upstream body, in bytes, that
+	// is parsed and filtered. Larger bodies are passed through unfiltered,
+	// or rejected with 413 if RejectLargeBody is set. Zero means no limit.
+	// Bodies are counted as they arrive, so the limit also bounds the
+	// memory used for bodies without a Content-Length, such as chunked
+	// ones: once it is exceeded, the rest of the body is streamed through
+	// or discarded. Compressed bodies are checked again as they are
+	// decompressed, so that the limit also applies to the decoded size.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+
+	// RejectLargeBody makes bodies over MaxBodySize fail with 413 Content
+	// Too Large instead of being passed through.
+	RejectLargeBody bool `json:"reject_large_body,omitempty"`
+
+	// SniffBody streams responses of a filterable content type through
+	// unbuffered if the first non-whitespace byte of their body cannot
+	// start a JSON value, e.g. HTML mislabeled as JSON, instead of
+	// buffering the whole body only to fail decoding it. The response
+	// header is held back until that byte arrives, or the upstream
+	// flushes. Bodies with a content encoding are not sniffed.
+	SniffBody bool `json:"sniff_body,omitempty"`
+
+	// MinBodySize is the smallest recorded upstream body, in bytes, that
+	// is parsed and filtered; smaller bodies are passed through unfiltered
+	// since filtering would hardly save anything. Zero, the default,
+	// filters bodies of any size.
+	MinBodySize int64 `json:"min_body_size,omitempty"`
+
+	// Multi controls how the results are combined when the query
+	// parameter is repeated. "object" (the default) returns an object
+	// keyed by expression; "array" returns the results in request order.
+	// A single expression always returns its raw result.
+	Multi string `json:"multi,omitempty"`
+
+	// PartialResults reports the failure of one of several expressions
+	// in its place among the results, as {"error":"...","code":"..."},
+	// instead of failing the whole request, so that clients get what
+	// they can. Malformed expressions are reported the same way. Only if
+	// all expressions fail is the first error handled as usual.
+	PartialResults bool `json:"partial_results,omitempty"`
+
+	// Pretty indents filtered output with two spaces. Clients can also
+	// request it per request with the "pretty" query flag. Pass-through
+	// responses are never reformatted.
+	Pretty bool `json:"pretty,omitempty"`
+
+	// Canonical writes JSON results in the canonical form of RFC 8785,
+	// with sorted keys, no whitespace and minimal string escaping, so
+	// that equal results are byte-identical regardless of the upstream
+	// key order or Go version, e.g. for content-addressed caching. It
+	// overrides Pretty, the "pretty" flag and EscapeHTML, disables
+	// Stream and cannot be combined with PreserveOrder.
+	Canonical bool `json:"canonical,omitempty"`
+
+	// EmptyStatus is the status code written when an expression matches
+	// nothing or yields an empty array. A missing key or index counts as
+	// no match and is written as null; a genuine JSON null value is not
+	// considered empty. Defaults to the upstream status.
+	EmptyStatus int `json:"empty_status,omitempty"`
+
+	// NullToEmptyArray makes null results, including no match, yield []
+	// instead: "always" for every expression, "auto" only for a single
+	// expression that can match several nodes, i.e. one with a wildcard
+	// such as [*], a filter or recursive descent (..). It applies before
+	// EmptyStatus. Empty, the default, leaves null results alone.
+	NullToEmptyArray string `json:"null_to_empty_array,omitempty"`
+
+	// ValidateSchema is the path of a JSON Schema file the filtered
+	// result must conform to, e.g. to catch upstream contract drift. It
+	// is loaded at provision time and supports the common validation
+	// keywords but not references. Results that do not conform are
+	// answered with a 500 error naming the first violation, or passed
+	// through with SchemaPassThrough. Described results and NDJSON
+	// records are not validated.
+	ValidateSchema string `json:"validate_schema,omitempty"`
+
+	// SchemaPassThrough responds with the original upstream response
+	// instead of an error if the result does not conform to
+	// ValidateSchema.
+	SchemaPassThrough bool `json:"schema_pass_through,omitempty"`
+
+	// ErrorFormat selects the error response body: "json" (the default)
+	// writes {"error":"...","code":"...","expression":"..."}, "text"
+	// writes plain text and "problem" writes RFC 7807 problem details as
+	// application/problem+json, with type about:blank, the status text as
+	// title, the message as detail and the code and expression as
+	// extension members. The code is one of invalid_expression,
+	// evaluation_error, timeout, too_deep, not_allowed, not_json,
+	// too_large, too_many_matches, not_tabular, not_array,
+	// invalid_request, upstream_error, schema_mismatch and
+	// range_not_satisfiable.
+	ErrorFormat string `json:"error_format,omitempty"`
+
+	// OnlyPaths restricts filtering to request paths matching one of these
+	// glob patterns. "*" matches any sequence of characters, including
+	// slashes, and "?" matches a single character.
+	OnlyPaths []string `json:"only_paths,omitempty"`
+
+	// ExceptPaths excludes request paths matching one of these glob
+	// patterns from filtering. It takes precedence over OnlyPaths.
+	ExceptPaths []string `json:"except_paths,omitempty"`
+
+	// NDJSON enables filtering of newline-delimited JSON responses
+	// (application/x-ndjson). The expressions are applied to every record
+	// and the results are written one per line, in order. Blank lines are
+	// skipped.
+	NDJSON bool `json:"ndjson,omitempty"`
+
+	// NDJSONOutput selects how filtered NDJSON records are written:
+	// "lines" (the default) keeps the input format, "array" collects the
+	// results into a single JSON array of OutputContentType.
+	NDJSONOutput string `json:"ndjson_output,omitempty"`
+
+	// Raw writes scalar results as plain text (text/plain) instead of
+	// JSON, e.g. a string without quotes. Arrays and objects are still
+	// written as JSON. Clients can also request it with the "raw" query
+	// flag.
+	Raw bool `json:"raw,omitempty"`
+
+	// Direction selects what is filtered: "response" (the default) filters
+	// upstream responses, "request" filters JSON request bodies before
+	// they are passed to the next handler. In the request direction,
+	// MaxBodySize and RejectLargeBody apply to the request body, of
+	// which no more than MaxBodySize+1 bytes are read into memory.
+	Direction string `json:"direction,omitempty"`
+
+	// Remove lists JSONPath expressions whose matched nodes are deleted
+	// from the document before the filter expressions are applied. If no
+	// expression is supplied, the whole document is returned without the
+	// removed nodes. Only names, indexes, wildcards, recursive descent
+	// and filter predicates are supported.
+	Remove []string `json:"remove,omitempty"`
+
+	// Root is a JSONPath expression selecting the sub-document that the
+	// filter expressions are evaluated against, e.g. "$.data" for
+	// enveloped payloads. If it matches nothing, the result is empty.
+	Root string `json:"root,omitempty"`
+
+	// WrapArray is the key under which a top-level array document is
+	// wrapped into an object before Root and the filter expressions are
+	// applied, so that e.g. $.items works on a bare array if it is
+	// "items". Remove and When see the unwrapped document. Empty, the
+	// default, disables wrapping; the Caddyfile defaults the key to
+	// "items".
+	WrapArray string `json:"wrap_array,omitempty"`
+
+	// IncludeHeaders evaluates everything against the document
+	// {"headers": {...}, "body": <body>} instead of the body alone, so
+	// that expressions such as $.headers["X-Request-Id"] can select
+	// upstream response headers. Header names are in canonical form, e.g.
+	// X-Request-Id for x-request-id, and values are strings; repeated
+	// headers are joined with ", ". NDJSON records are not affected.
+	IncludeHeaders bool `json:"include_headers,omitempty"`
+
+	// RequireAcceptJSON only filters requests whose Accept header admits
+	// a JSON response, i.e. lists a filterable media type, MessagePack,
+	// application/* or */* with a non-zero q-value. A missing Accept header admits
+	// anything.
+	RequireAcceptJSON bool `json:"require_accept_json,omitempty"`
+
+	// EnableHeader, if set, only filters requests carrying this header,
+	// e.g. one set by a canary router to roll filtering out gradually.
+	// Other requests, and with EnableHeaderValue those whose header has a
+	// different value, are passed through even if they have an
+	// expression.
+	EnableHeader string `json:"enable_header,omitempty"`
+
+	// EnableHeaderValue is the value EnableHeader must have. Empty, the
+	// default, accepts any value.
+	EnableHeaderValue string `json:"enable_header_value,omitempty"`
+
+	// BypassParam, if set, passes requests carrying this query parameter
+	// through unfiltered, e.g. ?expand=true to get the full document
+	// instead of the default expression; with BypassParamValue, only if
+	// the parameter has that value.
+	BypassParam string `json:"bypass_param,omitempty"`
+
+	// BypassParamValue is the value BypassParam must have. Empty, the
+	// default, accepts any value, including none.
+	BypassParamValue string `json:"bypass_param_value,omitempty"`
+
+	// StripControlParams removes the query parameters this handler acts
+	// on, such as QueryParam, FieldsParam, "limit" or "pretty", from the
+	// request passed to the upstream, so that they neither reach the
+	// application nor fragment its caches. The handler itself still sees
+	// the original query.
+	StripControlParams bool `json:"strip_control_params,omitempty"`
+
+	// PreserveOrder keeps the upstream key order of objects in the
+	// filtered output instead of sorting keys alphabetically. It costs
+	// a slower, token-based decode.
+	PreserveOrder bool `json:"preserve_order,omitempty"`
+
+	// AllowTrailingData filters the first JSON value of upstream bodies
+	// that are followed by other data, such as log lines or a second
+	// document, dropping the rest. By default such bodies are not JSON
+	// and are passed through.
+	AllowTrailingData bool `json:"allow_trailing_data,omitempty"`
+
+	// DebugHeader adds an X-JSONPath-Filter response header telling
+	// whether filtering was applied, e.g. "applied", "skipped; non-json"
+	// or "error". It is off by default to avoid leaking internals.
+	DebugHeader bool `json:"debug_header,omitempty"`
+
+	// OnError selects the response when an expression fails to compile
+	// or evaluate: "fail" (the default) writes a 400 error, "passthrough"
+	// returns the original response, with the upstream status rather than
+	// 200 so that upstream errors are not masked, and "empty" returns
+	// null. Errors are logged in every mode; panics in the expression
+	// engine count as such errors and are logged with their stack trace.
+	// With "fail", malformed client-supplied expressions are rejected
+	// with 422 Unprocessable Entity, giving the parser's message and the
+	// position of the offending token.
+	OnError string `json:"on_error,omitempty"`
+
+	// RedactErrors replaces the body of upstream responses with a 5xx
+	// status by a generic error, {"error":"upstream error"} with code
+	// upstream_error in the configured ErrorFormat, so that error details
+	// never reach clients, whether or not an expression was supplied. The
+	// upstream status is kept. This also holds for requests that are not
+	// subject to filtering, e.g. because of Methods, BypassCIDRs or the
+	// bypass parameter, and in the request Direction.
+	RedactErrors bool `json:"redact_errors,omitempty"`
+
+	// Envelope, if set, wraps the filtered result in an object together
+	// with the number of matches.
+	Envelope *Envelope `json:"envelope,omitempty"`
+
+	// Batch, if set, treats responses as batches of sub-responses and
+	// applies the filter expressions to each sub-response's body instead
+	// of the whole document, keeping the batch structure. When sees the
+	// whole batch, and options acting on the result, such as Envelope or
+	// First, act on the reassembled batch. Responses that are not batches
+	// are passed through.
+	Batch *Batch `json:"batch,omitempty"`
+
+	// ArrayEnvelope, if set, wraps array results only, as in {"data":
+	// [...], "total": <n>}, and leaves other results as they are. The
+	// total is counted before pagination, like TotalCount. It cannot be
+	// combined with Envelope.
+	ArrayEnvelope *ArrayEnvelope `json:"array_envelope,omitempty"`
+
+	// WithStatus, if set, wraps the result, after Envelope or
+	// ArrayEnvelope if either is set, in an object together with the
+	// response status and selected headers, as in {"status": 200,
+	// "headers": {...}, "data": <filtered>}.
+	WithStatus *StatusEnvelope `json:"with_status,omitempty"`
+
+	// GroupBy, if set, turns array results into an object mapping each
+	// value of a member of their elements, such as category, to the
+	// elements having it, e.g. {"books": [...], "games": [...]}. It applies
+	// after sorting and pagination; other results are left as they are.
+	GroupBy *GroupBy `json:"group_by,omitempty"`
+
+	// Template is a Go text/template that the filtered result is rendered
+	// through, available as ".". The "json" function encodes a value as
+	// JSON. Execution errors are handled according to OnError.
+	Template string `json:"template,omitempty"`
+
+	// ResultCache, if set, caches filtered responses so that unchanged
+	// upstream responses are not parsed and filtered again.
+	ResultCache *ResultCache `json:"result_cache,omitempty"`
+
+	// Paginate enables the "offset" and "limit" query parameters, which
+	// select a window of array results, e.g. ?offset=20&limit=10. An
+	// offset past the end yields an empty array. Other results are not
+	// affected. Off by default, since upstreams often use these parameters
+	// themselves.
+	Paginate bool `json:"paginate,omitempty"`
+
+	// RangeItems honors "Range: items=<first>-[<last>]" request headers
+	// for array results, the HTTP idiom for pagination: the selected
+	// elements are returned with status 206 and a header such as
+	// "Content-Range: items 0-99/250", in place of the window of the
+	// "offset" and "limit" parameters. A range starting past the end
+	// fails with 416. Array results carry "Accept-Ranges: items"; other
+	// results, responses other than 200 and malformed ranges, including
+	// multiple ones, ignore the header.
+	RangeItems bool `json:"range_items,omitempty"`
+
+	// TotalCount sets an X-Total-Count response header to the number of
+	// elements of an array result, counted before pagination. For other
+	// results the header is removed.
+	TotalCount bool `json:"total_count,omitempty"`
+
+	// Merge, if set, is a JSON Merge Patch applied to object results.
+	Merge *Merge `json:"merge,omitempty"`
+
+	// Stream writes array results element by element instead of encoding
+	// them as a whole first, which bounds memory use for large arrays.
+	// Streamed responses have no Content-Length and are not cached.
+	Stream bool `json:"stream,omitempty"`
+
+	// BypassCIDRs lists client IP ranges, such as internal monitoring,
+	// that always receive the unfiltered upstream response. Bare IP
+	// addresses are accepted as well.
+	BypassCIDRs []string `json:"bypass_cidrs,omitempty"`
+
+	// TrustedProxies lists the IP ranges of proxies whose X-Forwarded-For
+	// and X-Real-IP headers are trusted to identify the client, for
+	// BypassCIDRs; "private_ranges" covers all private ranges. Without
+	// it, the connection's remote address is used.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// FieldsParam is the name of a query parameter listing, comma
+	// separated, the top-level members to keep of an object result or of
+	// each object element of an array result, e.g. ?fields=id,name. It
+	// applies after the filter expressions, if any. Empty, the default,
+	// disables projection; the Caddyfile defaults the name to "fields".
+	FieldsParam string `json:"fields_param,omitempty"`
+
+	// ThenParam is the name of a query parameter holding a second-stage
+	// expression applied to the result of the filter expressions, e.g.
+	// ?jsonpath_filter=$.items&jsonpath_filter2=$[*].name. Results that
+	// are neither objects nor arrays are returned as they are, and a
+	// result matching nothing stays so. The expression, like the first,
+	// has its own EvalTimeout and is subject to MaxExpressionLength but
+	// not to Allow, as it only sees the already filtered result. Empty,
+	// the default, disables it; the Caddyfile defaults the name to
+	// "jsonpath_filter2".
+	ThenParam string `json:"then_param,omitempty"`
+
+	// KeyPattern is a regular expression that the top-level keys of an
+	// object result, or of each object element of an array result, must
+	// match to be kept, e.g. "^meta_". Like FieldsParam, it applies after
+	// the filter expressions, if any.
+	KeyPattern string `json:"key_pattern,omitempty"`
+
+	// KeyPatternParam is the name of a query parameter overriding
+	// KeyPattern per request. Client patterns are compiled once and kept
+	// in a cache of CacheSize entries; invalid ones are rejected with 400
+	// Bad Request. Empty, the default, ignores the query; the Caddyfile
+	// defaults the name to "key_pattern".
+	KeyPatternParam string `json:"key_pattern_param,omitempty"`
+
+	// Engine selects the query language of the expressions, including
+	// the default expression, root and allow list: "jsonpath" (the
+	// default) or "jq". A jq program with several outputs yields an array
+	// of them, and one without output counts as no match. jq results do
+	// not retain the upstream key order. Remove always uses JSONPath.
+	Engine string `json:"engine,omitempty"`
+
+	// AllowEngineOverride lets clients select the engine per request with
+	// the "engine" query parameter, e.g. ?engine=jq, to try out another
+	// engine without changing the configuration. The override applies to
+	// all expressions of the request, so requests selecting an engine that
+	// cannot compile the configured ones applied to them, such as Root,
+	// When or DefaultExpression, fail with 400 Bad Request. Unknown
+	// engines are ignored.
+	// It cannot be combined with IncludePaths, ExpressionPrefix or
+	// AllowPrefix, which require the jsonpath engine.
+	AllowEngineOverride bool `json:"allow_engine_override,omitempty"`
+
+	// EngineOverrideCIDRs restricts AllowEngineOverride to clients in these
+	// IP ranges; the engine parameter of other clients is ignored. Empty,
+	// the default, permits all clients.
+	EngineOverrideCIDRs []string `json:"engine_override_cidrs,omitempty"`
+
+	// AllowDebugDiff lets clients ask with the "debug_diff" query flag for
+	// a description of the effect of the filter instead of its result:
+	// {"original_size":n,"filtered_size":m,"removed_top_level_keys":[...]},
+	// with the sizes of the upstream body and of the compact JSON result
+	// in bytes. It is a developer aid and off by default.
+	AllowDebugDiff bool `json:"allow_debug_diff,omitempty"`
+
+	// DebugDiffCIDRs restricts AllowDebugDiff to clients in these IP
+	// ranges; the flag is ignored for other clients. Empty, the default,
+	// permits all clients.
+	DebugDiffCIDRs []string `json:"debug_diff_cidrs,omitempty"`
+
+	// Flatten concatenates the array elements of an array result, e.g. of
+	// a recursive descent like $..prices, into a single array. Only one
+	// level is flattened; deeper arrays are kept as they are.
+	Flatten bool `json:"flatten,omitempty"`
+
+	// Distinct removes duplicate elements from array results, after
+	// Flatten, keeping the first occurrence of each, e.g. to turn
+	// $..category into a set. Scalars are compared by value, objects and
+	// arrays by their JSON encoding, regardless of key order; this encodes
+	// every such element, which is costly for large arrays of objects.
+	// Clients can also request it with the "distinct" query flag.
+	Distinct bool `json:"distinct,omitempty"`
+
+	// Round, if set, rounds the floating-point numbers in the result to
+	// this many decimal places, e.g. 2 turns 3.14159 into 3.14; exact
+	// halves round to even, so 0 turns 2.5 into 2. Integral
+	// numbers, and integers kept exactly because they are beyond the
+	// float64 range, are left as they are.
+	Round *int `json:"round,omitempty"`
+
+	// EvalTimeout bounds the time spent evaluating the expressions against
+	// a document or NDJSON record, including simple selectors scanned
+	// without decoding the document. Exceeding it fails with 504 Gateway
+	// Timeout, or as configured by OnError. jq programs are stopped when
+	// it expires, but JSONPath evaluation cannot be interrupted: it goes on
+	// in the background until it completes, so the timeout bounds the
+	// response time, not the CPU time spent. Zero, the default, means no
+	// limit.
+	EvalTimeout caddy.Duration `json:"eval_timeout,omitempty"`
+
+	// MaxDepth rejects expressions with recursive descent (..) with 400
+	// Bad Request, or as configured by OnError, if the document, or NDJSON
+	// record, nests objects and arrays deeper than this. The document
+	// {"a":[1]} has a depth of 2. Zero, the default, means no limit.
+	MaxDepth int `json:"max_depth,omitempty"`
+
+	// MaxMatches bounds the number of elements of an array result, e.g.
+	// of $..*, before pagination. Longer results are truncated, with an
+	// X-Truncated: true response header, or rejected with 400 Bad Request
+	// if RejectExcessMatches is set. Zero, the default, means no limit.
+	MaxMatches int `json:"max_matches,omitempty"`
+
+	// RejectExcessMatches rejects results exceeding MaxMatches instead of
+	// truncating them.
+	RejectExcessMatches bool `json:"reject_excess_matches,omitempty"`
+
+	// OutputContentType is the Content-Type of filtered JSON and template
+	// output, e.g. to add a charset or use a vendor type. Raw text and
+	// NDJSON output keep their own types. Defaults to "application/json".
+	OutputContentType string `json:"output_content_type,omitempty"`
+
+	// When is an expression that is evaluated against the document before
+	// anything else; the document is only filtered if the result is
+	// truthy, and passed through unchanged otherwise. null, false, 0, "",
+	// empty arrays and objects and a missing key or index are falsy,
+	// anything else is truthy. With the JSONPath engine, comparisons such
+	// as $.type == "list" yield a boolean and filters such as
+	// $.items[?(@.id == 1)] an array of the matches. Evaluation errors are
+	// logged and count as falsy. NDJSON records are not checked.
+	When string `json:"when,omitempty"`
+
+	// StrictContentType rejects successful (2xx) upstream responses that
+	// are not of a filterable content type with 406 Not Acceptable if the
+	// request supplied an expression, instead of passing them through, so
+	// that clients notice that their filter was not applied.
+	StrictContentType bool `json:"strict_content_type,omitempty"`
+
+	// Methods lists the request methods whose responses are filtered;
+	// responses to other methods are streamed through. Method names are
+	// case-insensitive. Defaults to all methods but HEAD.
+	Methods []string `json:"methods,omitempty"`
+
+	// IncludePaths makes expressions that can match several nodes, i.e.
+	// those with wildcards, filters or recursive descent, return an object
+	// mapping the normalized path of every match, e.g. $['items'][0]['id'],
+	// to its value instead of an array of values. Expressions selecting a
+	// single node return their plain value. Paths are relative to Root.
+	// Only the JSONPath subset supported by Remove is covered; other
+	// expressions, such as slices, return plain values as well.
+	IncludePaths bool `json:"include_paths,omitempty"`
+
+	// StatusExpressions maps upstream status codes, such as "404", or
+	// status classes, such as "4xx", to the expression applied to
+	// responses with that status, e.g. to filter error bodies differently
+	// from successful ones. An exact code takes precedence over its class.
+	// The selected expression overrides the default expression; a
+	// client-supplied expression takes precedence over it unless
+	// LockStatusExpressions is set.
+	StatusExpressions map[string]string `json:"status_expressions,omitempty"`
+
+	// LockStatusExpressions makes StatusExpressions take precedence over
+	// client-supplied expressions.
+	LockStatusExpressions bool `json:"lock_status_expressions,omitempty"`
+
+	// Format selects the output format: "json" (the default); "csv",
+	// which writes arrays of flat objects as text/csv with a header row;
+	// "lines", which writes each element of an array result on its own
+	// line as text/plain, e.g. for shell pipelines. Scalars are written as
+	// with Raw and objects and arrays as compact JSON; strings containing
+	// newlines span several lines. "json-seq" writes each element of an
+	// array result, or any other result, as an RFC 7464 JSON text
+	// sequence record, prefixed with the record separator 0x1E and
+	// followed by a newline, as application/json-seq. "msgpack" writes
+	// any result as application/msgpack; it is also chosen if the Accept
+	// header ranks application/msgpack above JSON. Clients can also
+	// choose the format with the "format" query parameter. Results that
+	// are not tabular, or not arrays for "lines", are written as JSON, or
+	// rejected with 406 Not Acceptable if StrictFormat is set.
+	Format string `json:"format,omitempty"`
+
+	// StrictFormat rejects results that cannot be written in the selected
+	// format instead of falling back to JSON.
+	StrictFormat bool `json:"strict_format,omitempty"`
+
+	// Compress gzips filtered output of at least CompressMinLength bytes
+	// if the upstream response was not compressed and the client accepts
+	// gzip. Caddy's encode handler leaves such responses alone, so this
+	// is only needed where encode is not used. Streamed output, whose
+	// size is not known in advance, is gzipped element by element
+	// whatever its size.
+	Compress bool `json:"compress,omitempty"`
+
+	// CompressMinLength is the smallest output, in bytes, that Compress
+	// compresses. Defaults to 512.
+	CompressMinLength int `json:"compress_min_length,omitempty"`
+
+	// CacheControl, if set, is written as the Cache-Control header of
+	// filtered responses, replacing the upstream one. The request headers
+	// that select the expression, Header and TenantHeader, are added to
+	// Vary. The query parameter cannot be listed in Vary: responses are
+	// only distinguished by caches that key on the full URL, including
+	// the query string verbatim. Shared caches or CDNs that drop, sort or
+	// otherwise normalize the query would serve one expression's result
+	// for another, so behind those use a private or no-store value, or
+	// configure the cache to key on the whole query.
+	CacheControl string `json:"cache_control,omitempty"`
+
+	// CacheControlPassThrough applies CacheControl to responses passed
+	// through unfiltered, too.
+	CacheControlPassThrough bool `json:"cache_control_pass_through,omitempty"`
+
+	// SetHeaders maps names of response headers to the values they are
+	// set to on filtered responses, replacing upstream ones, e.g.
+	// {"X-Filtered-By": "jsonpath"}. Values may contain placeholders,
+	// which are replaced for each request.
+	SetHeaders map[string]string `json:"set_headers,omitempty"`
+
+	// SetHeadersPassThrough applies SetHeaders to responses passed through
+	// unfiltered, too.
+	SetHeadersPassThrough bool `json:"set_headers_pass_through,omitempty"`
+
+	// ETag sets a weak ETag computed over the filtered output on 200
+	// responses, replacing the upstream one, and answers GET and HEAD
+	// requests whose If-None-Match matches it with 304 Not Modified. The
+	// filtered body is still computed, but not transferred. Streamed
+	// output has no ETag.
+	ETag bool `json:"etag,omitempty"`
+
+	// First returns only the first element of array results; an empty
+	// array counts as no match and yields null. Other results are not
+	// affected. Clients can also request it with the "first" query flag.
+	First bool `json:"first,omitempty"`
+
+	// Last is like First, but returns the last element of array results.
+	// It cannot be combined with First; requests asking for both, e.g.
+	// with the "last" query flag, are rejected with 400 Bad Request.
+	Last bool `json:"last,omitempty"`
+
+	// RequireResponseHeader maps upstream response header names to the
+	// value they must have for the response to be filtered, e.g. to only
+	// filter responses of the backend that sets "X-App: catalog". If any
+	// of the headers is missing or has a different value, the response is
+	// streamed through. An empty value only requires the header to be
+	// present.
+	RequireResponseHeader map[string]string `json:"require_response_header,omitempty"`
+
+	// RemoveKeys lists key names, such as "password", that are deleted
+	// from every object in the document, at any depth and including
+	// objects nested in arrays. Like Remove, this happens before the
+	// filter expressions are applied, and without an expression the whole
+	// document is returned without the removed keys.
+	RemoveKeys []string `json:"remove_keys,omitempty"`
+
+	// EscapeHTML controls whether <, > and & in strings of the filtered
+	// output are escaped as \u003c, \u003e and \u0026, as json.Marshal
+	// does. Defaults to true; set it to false to keep URLs and markup
+	// readable. Pass-through responses are never re-encoded.
+	EscapeHTML *bool `json:"escape_html,omitempty"`
+
+	// Filters maps names to canned expressions that clients select with
+	// the FilterParam query parameter, e.g. ?view=summary, instead of
+	// sending an expression. A named filter is used if the request has no
+	// expression in QueryParam; like DefaultExpression, it is not subject
+	// to Allow.
+	//
+	// Filters may take arguments: the placeholders {0}, {1} and so on are
+	// replaced by the values of the repeated FilterArgParam query
+	// parameter, so that $.items[?(@.category=="{0}")] applies to
+	// ?filter=byCategory&arg=books. Placeholders must appear inside
+	// double-quoted strings, and arguments are escaped so that they
+	// cannot end the string. Requests passing more or fewer arguments
+	// than a filter takes are rejected with 400 Bad Request.
+	Filters map[string]string `json:"filters,omitempty"`
+
+	// FiltersFile is the path of a JSON file holding an object that maps
+	// further filter names to expressions, e.g. {"summary": "$.items[*].id"},
+	// for filter tables maintained outside the configuration. It is read
+	// when the configuration is loaded, so changes take effect on reload;
+	// a file that cannot be read or parsed fails provisioning. Entries in
+	// Filters take precedence over those of the same name in the file.
+	FiltersFile string `json:"filters_file,omitempty"`
+
+	// FilterParam is the query parameter naming one of Filters. Defaults
+	// to "filter".
+	FilterParam string `json:"filter_param,omitempty"`
+
+	// FilterArgParam is the query parameter holding the arguments of
+	// named filters. Defaults to "arg".
+	FilterArgParam string `json:"filter_arg_param,omitempty"`
+
+	// StrictFilterParam rejects requests naming an unknown filter with
+	// 400 Bad Request. By default the name is ignored and the request is
+	// handled as if it had none.
+	StrictFilterParam bool `json:"strict_filter_param,omitempty"`
+
+	// FilterPlaceholder names one of Filters by a placeholder, such as
+	// "{re.view.1}" capturing the last segment of /api/catalog/view/summary
+	// with a path_regexp matcher named view, for requests without
+	// FilterParam. A placeholder that does not resolve names no filter.
+	FilterPlaceholder string `json:"filter_placeholder,omitempty"`
+
+	// SortParam is the name of a query parameter naming, prefixed with
+	// "-" for descending order, the member by which the objects of an
+	// array result are sorted, e.g. ?sort=-createdAt. Numbers sort before
+	// strings, which sort before booleans; elements missing the member,
+	// or having it set to null, go last in either order. Other results
+	// are not affected. Empty, the default, disables sorting; the
+	// Caddyfile defaults the name to "sort".
+	SortParam string `json:"sort_param,omitempty"`
+
+	// JSONPParam is the name of a query parameter holding a JSONP
+	// callback, e.g. ?callback=render. If present, JSON output is written
+	// as render(<json>); with Content-Type application/javascript.
+	// Callback names must be JavaScript identifiers, optionally dotted,
+	// of at most 128 characters; others are rejected with 400 Bad Request.
+	// Empty, the default, disables JSONP; the Caddyfile defaults the name
+	// to "callback".
+	JSONPParam string `json:"jsonp_param,omitempty"`
+
+	exprs         *exprCache
+	allowed       map[string]struct{}
+	tenants       map[string]map[string]struct{}
+	contentTypes  []*regexp.Regexp
+	onlyPaths     []*regexp.Regexp
+	exceptPaths   []*regexp.Regexp
+	removePaths   [][]segment
+	allowPrefixes [][]segment
+	removeKeys    map[string]struct{}
+	filterArity   map[string]int
+	controlParams map[string]struct{}
+	keyPattern    *regexp.Regexp
+	patterns      *patternCache
+	logger        *zap.Logger
+	metrics       *filterMetrics
+	template      *template.Template
+	schema        *schema
+	results       *resultCache
+	bypassNets    []*net.IPNet
+	overrideNets  []*net.IPNet
+	diffNets      []*net.IPNet
+	engines       map[string]*exprCache
+	trustedNets   []*net.IPNet
+}
 
 func (ResponseFilter) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
@@ -27,64 +795,2171 @@ func (ResponseFilter) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// ServeHTTP implements caddyhttp.MiddlewareHandler.
+// Provision implements caddy.Provisioner.
+func (m *ResponseFilter) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger()
+	metrics, err := newFilterMetrics(ctx.GetMetricsRegistry())
+	if err != nil {
+		return fmt.Errorf("registering metrics: %v", err)
+	}
+	m.metrics = metrics
+	if err := m.loadFiltersFile(); err != nil {
+		return fmt.Errorf("filters_file: %v", err)
+	}
+	m.expandEnv()
+	if m.QueryParam == "" {
+		m.QueryParam = defaultQueryParam
+	}
+	if len(m.ContentTypes) == 0 {
+		m.ContentTypes = append([]string(nil), defaultContentTypes...)
+	}
+	for i, ct := range m.ContentTypes {
+		m.ContentTypes[i] = strings.ToLower(strings.TrimSpace(ct))
+	}
+	for i, method := range m.Methods {
+		m.Methods[i] = strings.ToUpper(strings.TrimSpace(method))
+	}
+	if m.ErrorFormat == "" {
+		m.ErrorFormat = "json"
+	}
+	if m.Multi == "" {
+		m.Multi = "object"
+	}
+	if m.Direction == "" {
+		m.Direction = "response"
+	}
+	if m.Format == "" {
+		m.Format = "json"
+	}
+	if m.NDJSONOutput == "" {
+		m.NDJSONOutput = "lines"
+	}
+	if m.FilterParam == "" {
+		m.FilterParam = "filter"
+	}
+	if m.FilterArgParam == "" {
+		m.FilterArgParam = "arg"
+	}
+	if m.OutputContentType == "" {
+		m.OutputContentType = "application/json"
+	}
+	if _, _, err := mime.ParseMediaType(m.OutputContentType); err != nil {
+		return fmt.Errorf("invalid output_content_type %q: %v", m.OutputContentType, err)
+	}
+	if m.OnError == "" {
+		m.OnError = "fail"
+	}
+	if m.Envelope != nil {
+		if m.Envelope.ResultKey == "" {
+			m.Envelope.ResultKey = "result"
+		}
+		if m.Envelope.CountKey == "" {
+			m.Envelope.CountKey = "count"
+		}
+	}
+	if m.GroupBy != nil && m.GroupBy.MissingKey == "" {
+		m.GroupBy.MissingKey = "_none"
+	}
+	if m.ArrayEnvelope != nil {
+		if m.ArrayEnvelope.DataKey == "" {
+			m.ArrayEnvelope.DataKey = "data"
+		}
+		if m.ArrayEnvelope.TotalKey == "" {
+			m.ArrayEnvelope.TotalKey = "total"
+		}
+	}
+	if m.Batch != nil {
+		if m.Batch.Items == "" {
+			m.Batch.Items = "responses"
+		}
+		if m.Batch.Body == "" {
+			m.Batch.Body = "body"
+		}
+	}
+	if m.ResultCache != nil {
+		if m.ResultCache.TTL == 0 {
+			m.ResultCache.TTL = defaultResultTTL
+		}
+		if m.ResultCache.MaxEntries == 0 {
+			m.ResultCache.MaxEntries = defaultResultMaxEntries
+		}
+		m.results = newResultCache(time.Duration(m.ResultCache.TTL), m.ResultCache.MaxEntries)
+	}
+	if m.Compress && m.CompressMinLength == 0 {
+		m.CompressMinLength = defaultMinLength
+	}
+	if m.CacheSize == 0 {
+		m.CacheSize = defaultCacheSize
+	}
+	if m.MaxExpressionLength == 0 {
+		m.MaxExpressionLength = defaultMaxExpressionLength
+	}
+	if m.Engine == "" {
+		m.Engine = "jsonpath"
+	}
+	compile, kind := jsonpath.New, m.Engine
+	switch {
+	case m.Engine == "jq":
+		compile = compileJQ
+	case m.IncludePaths:
+		compile, kind = compilePathMap, "paths"
+	}
+	m.exprs = newExprCache(m.CacheSize, compile)
+	m.shareExprs(kind)
+	if m.AllowEngineOverride {
+		m.engines = map[string]*exprCache{m.Engine: m.exprs}
+		if m.Engine == "jq" {
+			m.engines["jsonpath"] = newExprCache(m.CacheSize, jsonpath.New)
+		} else {
+			m.engines["jq"] = newExprCache(m.CacheSize, compileJQ)
+		}
+	}
+	if m.KeyPattern != "" {
+		if m.keyPattern, err = regexp.Compile(m.KeyPattern); err != nil {
+			return fmt.Errorf("compiling key_pattern: %v", err)
+		}
+	}
+	if m.KeyPatternParam != "" {
+		m.patterns = newPatternCache(m.CacheSize)
+	}
+	if m.StripControlParams {
+		m.controlParams = m.controlParamSet()
+	}
+	if m.ValidateSchema != "" {
+		if m.schema, err = loadSchema(m.ValidateSchema); err != nil {
+			return fmt.Errorf("validate_schema: %v", err)
+		}
+	}
+	if len(m.Allow) > 0 {
+		m.allowed = make(map[string]struct{}, len(m.Allow))
+		for _, expr := range m.Allow {
+			m.allowed[expr] = struct{}{}
+		}
+	}
+	if len(m.TenantAllow) > 0 {
+		m.tenants = make(map[string]map[string]struct{}, len(m.TenantAllow))
+		for tenant, exprs := range m.TenantAllow {
+			allowed := make(map[string]struct{}, len(exprs))
+			for _, expr := range exprs {
+				allowed[expr] = struct{}{}
+			}
+			m.tenants[tenant] = allowed
+		}
+	}
+	if len(m.RemoveKeys) > 0 {
+		m.removeKeys = make(map[string]struct{}, len(m.RemoveKeys))
+		for _, key := range m.RemoveKeys {
+			m.removeKeys[key] = struct{}{}
+		}
+	}
+	if m.Template != "" {
+		m.template, err = template.New("jsonpath_filter").Funcs(templateFuncs).Parse(m.Template)
+		if err != nil {
+			return fmt.Errorf("parsing template: %v", err)
+		}
+	}
+	if m.Merge != nil {
+		if err := m.Merge.provision(); err != nil {
+			return err
+		}
+	}
+	if m.bypassNets, err = parseCIDRs(m.BypassCIDRs); err != nil {
+		return fmt.Errorf("bypass_cidrs: %v", err)
+	}
+	if m.overrideNets, err = parseCIDRs(m.EngineOverrideCIDRs); err != nil {
+		return fmt.Errorf("engine_override_cidrs: %v", err)
+	}
+	if m.diffNets, err = parseCIDRs(m.DebugDiffCIDRs); err != nil {
+		return fmt.Errorf("debug_diff_cidrs: %v", err)
+	}
+	if m.trustedNets, err = parseCIDRs(m.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted_proxies: %v", err)
+	}
+	var globs []string
+	for _, ct := range m.ContentTypes {
+		if strings.ContainsAny(ct, "*?") {
+			globs = append(globs, ct)
+		}
+	}
+	if m.contentTypes, err = compileGlobs(globs); err != nil {
+		return fmt.Errorf("content_types: %v", err)
+	}
+	if m.onlyPaths, err = compileGlobs(m.OnlyPaths); err != nil {
+		return fmt.Errorf("only_paths: %v", err)
+	}
+	if m.exceptPaths, err = compileGlobs(m.ExceptPaths); err != nil {
+		return fmt.Errorf("except_paths: %v", err)
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator. It rejects contradictory settings
+// and compiles the statically configured expressions so that mistakes
+// surface at startup.
+func (m *ResponseFilter) Validate() error {
+	if strings.TrimSpace(m.QueryParam) == "" {
+		return fmt.Errorf("query_param must not be blank")
+	}
+	for _, ct := range m.ContentTypes {
+		if ct == "" || ct == "+" {
+			return fmt.Errorf("content_types must not contain empty entries")
+		}
+	}
+	if m.EmptyStatus != 0 && (m.EmptyStatus < 100 || m.EmptyStatus > 999) {
+		return fmt.Errorf("invalid empty_status %d", m.EmptyStatus)
+	}
+	switch m.ErrorFormat {
+	case "json", "text", "problem":
+	default:
+		return fmt.Errorf("unrecognized error_format %q", m.ErrorFormat)
+	}
+	switch m.Multi {
+	case "object", "array":
+	default:
+		return fmt.Errorf("unrecognized multi mode %q", m.Multi)
+	}
+	if m.Envelope != nil && m.Envelope.ResultKey == m.Envelope.CountKey {
+		return fmt.Errorf("envelope result and count keys must differ")
+	}
+	if m.GroupBy != nil && m.GroupBy.Field == "" {
+		return fmt.Errorf("group_by requires a field")
+	}
+	if ae := m.ArrayEnvelope; ae != nil {
+		if m.Envelope != nil {
+			return fmt.Errorf("array_envelope cannot be combined with envelope")
+		}
+		if ae.DataKey == ae.TotalKey {
+			return fmt.Errorf("array_envelope data and total keys must differ")
+		}
+	}
+	if m.First && m.Last {
+		return fmt.Errorf("first and last are mutually exclusive")
+	}
+	switch m.NullToEmptyArray {
+	case "", "always", "auto":
+	default:
+		return fmt.Errorf("unrecognized null_to_empty_array mode %q", m.NullToEmptyArray)
+	}
+	switch m.OnError {
+	case "fail", "passthrough", "empty":
+	default:
+		return fmt.Errorf("unrecognized on_error mode %q", m.OnError)
+	}
+	switch m.Format {
+	case "json", "csv", "lines", "json-seq", "msgpack":
+	default:
+		return fmt.Errorf("unrecognized format %q", m.Format)
+	}
+	switch m.NDJSONOutput {
+	case "lines", "array":
+	default:
+		return fmt.Errorf("unrecognized ndjson_output %q", m.NDJSONOutput)
+	}
+	switch m.Engine {
+	case "jsonpath", "jq":
+	default:
+		return fmt.Errorf("unrecognized engine %q", m.Engine)
+	}
+	if m.IncludePaths && m.Engine != "jsonpath" {
+		return fmt.Errorf("include_paths requires the jsonpath engine")
+	}
+	if m.AllowEngineOverride && (m.IncludePaths || m.ExpressionPrefix != "" || len(m.AllowPrefix) > 0) {
+		return fmt.Errorf("allow_engine_override cannot be combined with include_paths, expression_prefix or allow_prefix")
+	}
+	if len(m.EngineOverrideCIDRs) > 0 && !m.AllowEngineOverride {
+		return fmt.Errorf("engine_override_cidrs requires allow_engine_override")
+	}
+	if len(m.DebugDiffCIDRs) > 0 && !m.AllowDebugDiff {
+		return fmt.Errorf("debug_diff_cidrs requires allow_debug_diff")
+	}
+	if m.ExpressionPrefix != "" {
+		if m.Engine != "jsonpath" {
+			return fmt.Errorf("expression_prefix requires the jsonpath engine")
+		}
+		if _, err := m.exprs.get(strings.TrimSuffix(m.ExpressionPrefix, ".")); err != nil {
+			return fmt.Errorf("invalid expression_prefix %q: %v", m.ExpressionPrefix, err)
+		}
+	}
+	switch m.Direction {
+	case "response", "request":
+	default:
+		return fmt.Errorf("unrecognized direction %q", m.Direction)
+	}
+	if rc := m.ResultCache; rc != nil {
+		if rc.TTL < 0 || rc.CacheTTL < 0 {
+			return fmt.Errorf("result_cache durations must not be negative")
+		}
+		if rc.MaxEntries < 0 {
+			return fmt.Errorf("result_cache max_entries must not be negative")
+		}
+		if rc.CacheTTL > rc.TTL {
+			return fmt.Errorf("result_cache cache_ttl must not exceed ttl")
+		}
+	}
+	for name := range m.RequireResponseHeader {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("require_response_header names must not be blank")
+		}
+	}
+	if m.Canonical && m.PreserveOrder {
+		return fmt.Errorf("canonical cannot be combined with preserve_order")
+	}
+	if m.SetHeadersPassThrough && len(m.SetHeaders) == 0 {
+		return fmt.Errorf("set_headers_pass_through requires set_headers")
+	}
+	for name := range m.SetHeaders {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("set_headers: empty header name")
+		}
+	}
+	if m.SchemaPassThrough && m.ValidateSchema == "" {
+		return fmt.Errorf("schema_pass_through requires validate_schema")
+	}
+	if m.BypassParamValue != "" && m.BypassParam == "" {
+		return fmt.Errorf("bypass_param_value requires bypass_param")
+	}
+	if m.BypassParam != "" && m.BypassParam == m.QueryParam {
+		return fmt.Errorf("bypass_param must differ from query_param")
+	}
+	if m.EnableHeaderValue != "" && m.EnableHeader == "" {
+		return fmt.Errorf("enable_header_value requires enable_header")
+	}
+	if m.CompressMinLength < 0 {
+		return fmt.Errorf("compress_min_length must not be negative")
+	}
+	if m.EvalTimeout < 0 {
+		return fmt.Errorf("eval_timeout must not be negative")
+	}
+	if m.Round != nil && (*m.Round < 0 || *m.Round > maxRound) {
+		return fmt.Errorf("round must be between 0 and %d", maxRound)
+	}
+	if m.MaxDepth < 0 {
+		return fmt.Errorf("max_depth must not be negative")
+	}
+	if m.MaxMatches < 0 {
+		return fmt.Errorf("max_matches must not be negative")
+	}
+	if m.RejectExcessMatches && m.MaxMatches == 0 {
+		return fmt.Errorf("reject_excess_matches requires max_matches")
+	}
+	if m.MaxBodySize < 0 {
+		return fmt.Errorf("max_body_size must not be negative")
+	}
+	if m.RejectLargeBody && m.MaxBodySize == 0 {
+		return fmt.Errorf("reject_large_body requires max_body_size")
+	}
+	if m.MinBodySize < 0 {
+		return fmt.Errorf("min_body_size must not be negative")
+	}
+	if m.MaxBodySize > 0 && m.MinBodySize > m.MaxBodySize {
+		return fmt.Errorf("min_body_size must not exceed max_body_size")
+	}
+	for _, except := range m.ExceptPaths {
+		for _, only := range m.OnlyPaths {
+			if except == only {
+				return fmt.Errorf("path pattern %q is both in only_paths and except_paths", only)
+			}
+		}
+	}
+	if len(m.AllowPrefix) > 0 && m.Engine != "jsonpath" {
+		return fmt.Errorf("allow_prefix requires the jsonpath engine")
+	}
+	m.allowPrefixes = m.allowPrefixes[:0]
+	for _, prefix := range m.AllowPrefix {
+		segs, err := parsePath(prefix)
+		if err != nil {
+			return fmt.Errorf("invalid allow_prefix %q: %v", prefix, err)
+		}
+		for _, seg := range segs {
+			if seg.kind == segFilter {
+				return fmt.Errorf("allow_prefix %q must not have filters", prefix)
+			}
+		}
+		m.allowPrefixes = append(m.allowPrefixes, segs)
+	}
+	m.removePaths = m.removePaths[:0]
+	for _, expr := range m.Remove {
+		segs, err := parsePath(expr)
+		if err != nil {
+			return fmt.Errorf("invalid remove expression %q: %v", expr, err)
+		}
+		if len(segs) == 0 {
+			return fmt.Errorf("remove expression %q must not select the root", expr)
+		}
+		m.removePaths = append(m.removePaths, segs)
+	}
+	if (len(m.TenantAllow) > 0 || m.DenyUnknownTenants) && m.TenantHeader == "" {
+		return fmt.Errorf("tenant_allow requires tenant_header")
+	}
+	for tenant, exprs := range m.TenantAllow {
+		for _, expr := range exprs {
+			if _, err := m.exprs.get(expr); err != nil {
+				return fmt.Errorf("invalid allow expression %q for tenant %s: %v", expr, tenant, err)
+			}
+		}
+	}
+	if m.DefaultExpression != "" {
+		if _, err := m.exprs.get(m.DefaultExpression); err != nil {
+			return fmt.Errorf("invalid default_expression %q: %v", m.DefaultExpression, err)
+		}
+	}
+	if m.Root != "" {
+		if _, err := m.exprs.get(m.Root); err != nil {
+			return fmt.Errorf("invalid root %q: %v", m.Root, err)
+		}
+	}
+	if m.When != "" {
+		if _, err := m.exprs.get(m.When); err != nil {
+			return fmt.Errorf("invalid when %q: %v", m.When, err)
+		}
+	}
+	for _, expr := range m.Allow {
+		if _, err := m.exprs.get(expr); err != nil {
+			return fmt.Errorf("invalid allow expression %q: %v", expr, err)
+		}
+	}
+	if m.ThenParam != "" && m.ThenParam == m.QueryParam {
+		return fmt.Errorf("then_param must differ from query_param")
+	}
+	if m.FilterPlaceholder != "" && len(m.Filters) == 0 {
+		return fmt.Errorf("filter_placeholder requires filters")
+	}
+	if len(m.Filters) > 0 && m.FilterParam == m.QueryParam {
+		return fmt.Errorf("filter_param must differ from query_param")
+	}
+	if len(m.Filters) > 0 && (m.FilterArgParam == m.QueryParam || m.FilterArgParam == m.FilterParam) {
+		return fmt.Errorf("filter_arg_param must differ from query_param and filter_param")
+	}
+	m.filterArity = make(map[string]int, len(m.Filters))
+	for name, expr := range m.Filters {
+		if name == "" {
+			return fmt.Errorf("filter names must not be empty")
+		}
+		if _, err := m.exprs.get(expr); err != nil {
+			return fmt.Errorf("invalid expression %q for filter %s: %v", expr, name, err)
+		}
+		n, err := filterArity(expr)
+		if err != nil {
+			return fmt.Errorf("filter %s: %v", name, err)
+		}
+		m.filterArity[name] = n
+	}
+	for status, expr := range m.StatusExpressions {
+		if !isStatusPattern(status) {
+			return fmt.Errorf("invalid status %q in status_expressions", status)
+		}
+		if _, err := m.exprs.get(expr); err != nil {
+			return fmt.Errorf("invalid expression %q for status %s: %v", expr, status, err)
+		}
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler. If the request is
+// traced, e.g. by Caddy's tracing handler, filtering is recorded in a
+// child span with the expressions, the outcome and the result size.
 func (m *ResponseFilter) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// Capture response
-	rec := caddyhttp.NewResponseRecorder(w, nil, func(status int, hdr http.Header) bool { return true })
-	if err := next.ServeHTTP(rec, r); err != nil {
-		return err
+	r = m.selectEngine(r)
+	if m.controlParams != nil {
+		next = m.stripControlParams(next)
+	}
+	r, span := m.startSpan(r)
+	if span == nil {
+		return m.serve(w, r, next)
+	}
+	defer span.End()
+	err := m.serve(w, r, next)
+	if err != nil {
+		traceError(r, err)
 	}
+	return err
+}
 
-	// Only handle JSON
-	ct := rec.Header().Get("Content-Type")
-	if ct == "" || ct != "application/json" {
-		_, err := w.Write(rec.Body())
-		return err
+// serve filters the response to r as described for ServeHTTP.
+func (m *ResponseFilter) serve(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// Stream responses for requests that are not eligible for filtering
+	if reason := m.skipReason(r); reason != "" {
+		m.setDebugHeader(w.Header(), "skipped; "+reason)
+		m.logSkip(r, "", reason)
+		return m.proxy(w, r, next)
+	}
+	if name := m.unknownFilter(r); name != "" && m.StrictFilterParam {
+		return m.writeError(w, r, http.StatusBadRequest, fmt.Errorf("unknown filter %q", name))
+	}
+	if err := m.checkFilterArgs(r); err != nil {
+		return m.writeError(w, r, http.StatusBadRequest, err)
+	}
+	if m.Direction == "request" {
+		return m.filterRequest(w, r, next)
 	}
 
-	// Parse JSON
-	var data interface{}
-	if err := json.Unmarshal(rec.Body(), &data); err != nil {
-		// Not JSON, return original
-		_, err := w.Write(rec.Body())
-		return err
+	// Serve fresh cached results without asking the upstream
+	cacheKey := m.resultKey(r)
+	if e := m.cachedResponse(r, cacheKey); e != nil {
+		return m.writeCached(w, r, e)
 	}
 
-	// Get JSONPath expression from query param
-	expr := r.URL.Query().Get("jsonpath_filter")
-	if expr == "" {
-		// No query param, return original JSON
-		_, err := w.Write(rec.Body())
+	// Capture response. The recorder shares its header map with w, so
+	// upstream headers are relayed on every branch; WriteResponse also
+	// relays the upstream status code on the pass-through branches.
+	// Responses that cannot be filtered are streamed instead of buffered.
+	// In strict mode, unfilterable responses to requests with an expression
+	// are buffered too, to be replaced by an error.
+	var streamReason string
+	_, strict := m.expressions(r)
+	strict = strict && m.StrictContentType
+	buf := new(bytes.Buffer)
+	var sniff *sniffWriter
+	rec := caddyhttp.NewResponseRecorder(w, buf, func(status int, hdr http.Header) bool {
+		if m.RedactErrors && status >= 500 {
+			return true
+		}
+		if sniff != nil && sniff.nonJSON {
+			streamReason = "invalid-json"
+			m.setDebugHeader(hdr, "skipped; "+streamReason)
+			m.setCacheControl(hdr, false)
+			m.setHeaders(r, hdr, false)
+			return false
+		}
+		streamReason = m.streamReason(status, hdr)
+		if streamReason == "non-json" && strict && status >= 200 && status <= 299 {
+			return true
+		}
+		if streamReason != "" {
+			m.setDebugHeader(hdr, "skipped; "+streamReason)
+			m.setCacheControl(hdr, false)
+			m.setHeaders(r, hdr, false)
+		}
+		return streamReason == ""
+	})
+	var upstream http.ResponseWriter = rec
+	var limiter *limitWriter
+	if m.MaxBodySize > 0 {
+		limiter = &limitWriter{rec: rec, w: w, max: m.MaxBodySize, overflow: func() (bool, error) {
+			if streamReason != "" || m.RejectLargeBody || m.RedactErrors && rec.Status() >= 500 {
+				return false, nil
+			}
+			m.setDebugHeader(rec.Header(), "skipped; too-large")
+			m.setCacheControl(rec.Header(), false)
+			m.setHeaders(r, rec.Header(), false)
+			trailers := takeTrailers(rec.Header())
+			err := rec.WriteResponse()
+			setTrailers(rec.Header(), trailers)
+			return true, err
+		}}
+		upstream = limiter
+	}
+	if m.SniffBody {
+		sniff = &sniffWriter{rec: upstream, sniffs: func(status int, hdr http.Header) bool {
+			enc := normalizeEncoding(hdr.Get("Content-Encoding"))
+			return m.streamReason(status, hdr) == "" && (enc == "" || enc == "identity")
+		}}
+		upstream = sniff
+	}
+	if err := next.ServeHTTP(upstream, r); err != nil {
 		return err
 	}
-
-	// Apply JSONPath
-	result, err := jsonpath.Get(expr, data)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("JSONPath error: %v", err), http.StatusBadRequest)
+	if sniff != nil {
+		if err := sniff.finish(); err != nil {
+			return err
+		}
+	}
+	if m.RedactErrors && rec.Buffered() && rec.Status() >= 500 {
+		return m.redactError(w, r, rec.Status())
+	}
+	if limiter != nil && limiter.streaming {
+		m.logSkip(r, rec.Header().Get("Content-Type"), "too-large")
+		return nil
+	}
+	if !rec.Buffered() {
+		m.logSkip(r, rec.Header().Get("Content-Type"), streamReason)
 		return nil
 	}
 
-	// Marshal filtered result
-	filtered, err := json.Marshal(result)
-	if err != nil {
-		return err
+	// Only handle JSON
+	ct := rec.Header().Get("Content-Type")
+	ndjson := m.NDJSON && isNDJSONContentType(ct)
+	if !ndjson && !m.isJSONContentType(ct) {
+		if strict {
+			return m.writeError(w, r, http.StatusNotAcceptable, withCode(codeNotJSON, fmt.Errorf("cannot filter response of type %q", ct)))
+		}
+		return m.passThrough(r, rec, "non-json")
 	}
 
-	// Write filtered response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(rec.Status())
-	_, err = io.Copy(w, bytes.NewReader(filtered))
-	return err
-}
+	// Reuse the cached result if the upstream response is unchanged
+	if e := m.validatedResponse(r, cacheKey, rec.Header()); e != nil {
+		return m.writeCached(w, r, e)
+	}
 
-// UnmarshalCaddyfile is no-op since we don't require any config
-func (m *ResponseFilter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	return nil
+	// Enforce the body size limit before doing any work on the body
+	if limiter != nil && limiter.exceeded {
+		if m.RejectLargeBody {
+			return m.writeError(w, r, http.StatusRequestEntityTooLarge, withCode(codeTooLarge, errors.New("response body too large to filter")))
+		}
+		return m.passThrough(r, rec, "too-large")
+	}
+	if int64(rec.Buffer().Len()) < m.MinBodySize {
+		return m.passThrough(r, rec, "too-small")
+	}
+
+	// Get JSONPath expressions from query param or header
+	status := rec.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	exprs, fromClient := m.expressions(r)
+	if expr := m.statusExpression(status); expr != "" && (!fromClient || m.LockStatusExpressions) {
+		exprs, fromClient = []string{expr}, false
+	}
+	if err := m.checkEngine(r, exprs, fromClient); err != nil {
+		return m.writeError(w, r, http.StatusBadRequest, err)
+	}
+	var fields []string
+	if m.FieldsParam != "" {
+		fields = fieldList(r.URL.Query().Get(m.FieldsParam))
+	}
+	pattern, err := m.keyPatternFor(r)
+	if err != nil {
+		return m.writeError(w, r, http.StatusBadRequest, withCode(codeInvalidRequest, err))
+	}
+	if len(exprs) == 0 && len(m.removePaths) == 0 && len(m.removeKeys) == 0 && len(fields) == 0 && pattern == nil {
+		// No expression, return original JSON
+		return m.passThrough(r, rec, "no-expression")
+	}
+	if fromClient {
+		for _, expr := range exprs {
+			if err := m.checkLength(expr); err != nil {
+				return m.writeError(w, r, http.StatusBadRequest, err)
+			}
+			if !m.isAllowed(r, expr) {
+				return m.writeError(w, r, http.StatusForbidden, withCode(codeNotAllowed, &exprError{expr, errors.New("expression not allowed")}))
+			}
+			if err := m.checkSyntax(m.engine(r.Context()), expr); err != nil && m.OnError == "fail" && !m.partial(exprs) {
+				return m.writeError(w, r, http.StatusUnprocessableEntity, err)
+			}
+		}
+	}
+	var then string
+	if m.ThenParam != "" && len(exprs) > 0 {
+		then = r.URL.Query().Get(m.ThenParam)
+	}
+	if then != "" {
+		if err := m.checkLength(then); err != nil {
+			return m.writeError(w, r, http.StatusBadRequest, err)
+		}
+		if err := m.checkSyntax(m.engine(r.Context()), then); err != nil && m.OnError == "fail" {
+			return m.writeError(w, r, http.StatusUnprocessableEntity, err)
+		}
+	}
+
+	// Decompress, if needed
+	encoding := rec.Header().Get("Content-Encoding")
+	body, err := decodeBody(encoding, rec.Buffer().Bytes(), m.MaxBodySize)
+	if errors.Is(err, errDecodedTooLarge) {
+		if m.RejectLargeBody {
+			return m.writeError(w, r, http.StatusRequestEntityTooLarge, withCode(codeTooLarge, errors.New("response body too large to filter")))
+		}
+		return m.passThrough(r, rec, "too-large")
+	}
+	if err != nil {
+		// Unsupported or corrupt encoding, return original
+		return m.passThrough(r, rec, "undecodable")
+	}
+	body = trimBody(body)
+	if len(body) == 0 {
+		// Nothing to filter, relay the empty body
+		return m.passThrough(r, rec, "empty-body")
+	}
+	if m.AllowTrailingData && !ndjson {
+		body = firstValue(body)
+	}
+
+	if ndjson {
+		records, order, err := parseNDJSON(body, m.PreserveOrder)
+		if err != nil {
+			return m.passThrough(r, rec, "invalid-json")
+		}
+		filtered, err := m.filterNDJSON(r.Context(), exprs, records, order, m.Pretty || queryFlag(r, "pretty"))
+		if err != nil {
+			m.logEvalError(r, exprs, err)
+			if m.OnError != "empty" {
+				return m.failEval(w, r, rec, err)
+			}
+		}
+		if m.NDJSONOutput == "array" {
+			ct = m.OutputContentType
+		}
+		return m.writeFiltered(w, r, rec, status, ct, encoding, exprs, filtered)
+	}
+
+	// Select simple member and index paths without decoding the whole
+	// document, or else parse JSON and apply JSONPath
+	start := time.Now()
+	result, order, handled, err := m.boundedSelect(r.Context(), exprs, body)
+	if !handled {
+		var data interface{}
+		data, order, err = decodeJSON(body, m.PreserveOrder)
+		if err != nil {
+			// Not JSON, return original
+			return m.passThrough(r, rec, "invalid-json")
+		}
+		if m.IncludeHeaders {
+			data = map[string]interface{}{"headers": headerDoc(rec.Header()), "body": data}
+		}
+
+		if !m.matchesWhen(r, data) {
+			return m.passThrough(r, rec, "condition")
+		}
+
+		if m.Batch != nil {
+			var ok bool
+			if result, ok, err = m.transformBatch(r.Context(), exprs, data); !ok {
+				return m.passThrough(r, rec, "not-batch")
+			}
+		} else {
+			result, err = m.transform(r.Context(), exprs, data)
+		}
+	} else if err != nil && !errors.Is(err, errNoMatch) && !errors.Is(err, errEvalTimeout) {
+		return m.passThrough(r, rec, "invalid-json")
+	}
+	if err == nil && then != "" {
+		result, err = m.refine(r.Context(), then, result)
+	}
+	if len(exprs) > 0 {
+		m.metrics.evalDuration.WithLabelValues(m.exprLabel(r, exprs, fromClient)).Observe(time.Since(start).Seconds())
+	}
+	noMatch := errors.Is(err, errNoMatch)
+	if err != nil && !noMatch {
+		m.logEvalError(r, exprs, err)
+		if m.OnError != "empty" {
+			return m.failEval(w, r, rec, err)
+		}
+		result, noMatch = nil, true
+	}
+	if result == nil && m.yieldsCollection(exprs) {
+		result, noMatch = []interface{}{}, false
+	}
+
+	if m.Flatten {
+		result = flatten(result)
+	}
+	if m.Distinct || queryFlag(r, "distinct") {
+		result = distinct(result)
+	}
+	if m.SortParam != "" {
+		result = sortBy(result, r.URL.Query().Get(m.SortParam))
+	}
+	if len(fields) > 0 {
+		result = project(result, fields)
+	}
+	if pattern != nil {
+		result = matchKeys(result, pattern)
+	}
+	if m.Round != nil {
+		result = roundFloats(result, *m.Round)
+	}
+
+	// Reject conflicting output flags before any header is changed
+	offset, limit := 0, -1
+	if m.Paginate {
+		if offset, limit, err = pageParams(r); err != nil {
+			return m.writeError(w, r, http.StatusBadRequest, err)
+		}
+	}
+	keysOnly, valuesOnly := queryFlag(r, "keys_only"), queryFlag(r, "values_only")
+	if keysOnly && valuesOnly {
+		return m.writeError(w, r, http.StatusBadRequest, errors.New("keys_only and values_only are mutually exclusive"))
+	}
+	first, last := m.First || queryFlag(r, "first"), m.Last || queryFlag(r, "last")
+	if first && last {
+		return m.writeError(w, r, http.StatusBadRequest, errors.New("first and last are mutually exclusive"))
+	}
+	var callback string
+	if m.JSONPParam != "" {
+		callback = r.URL.Query().Get(m.JSONPParam)
+		if callback != "" && !isCallbackName(callback) {
+			return m.writeError(w, r, http.StatusBadRequest, fmt.Errorf("invalid JSONP callback %q", callback))
+		}
+	}
+
+	// Bound the number of matches
+	if a, ok := result.([]interface{}); ok && m.MaxMatches > 0 && len(a) > m.MaxMatches {
+		if m.RejectExcessMatches {
+			return m.writeError(w, r, http.StatusBadRequest, withCode(codeTooManyMatches, fmt.Errorf("result has %d matches, more than the allowed %d", len(a), m.MaxMatches)))
+		}
+		result = a[:m.MaxMatches]
+		w.Header().Set(truncatedHeader, "true")
+	}
+
+	// Select the requested window of array results, counting them first
+	total := -1
+	if a, ok := result.([]interface{}); ok {
+		total = len(a)
+	}
+	if m.TotalCount {
+		if total >= 0 {
+			w.Header().Set(totalCountHeader, strconv.Itoa(total))
+		} else {
+			w.Header().Del(totalCountHeader)
+		}
+	}
+	if rng, ok := m.itemsRange(r, status); ok && total >= 0 {
+		first, last, ok := rng.resolve(total)
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("items */%d", total))
+			return m.writeError(w, r, http.StatusRequestedRangeNotSatisfiable, withCode(codeRangeNotSatisfiable, fmt.Errorf("range starts past the last of %d items", total)))
+		}
+		result = result.([]interface{})[first : last+1]
+		w.Header().Set("Content-Range", fmt.Sprintf("items %d-%d/%d", first, last, total))
+		status = http.StatusPartialContent
+	} else {
+		result = page(result, offset, limit)
+	}
+	if m.RangeItems && total >= 0 {
+		w.Header().Set("Accept-Ranges", "items")
+	}
+
+	if a, ok := result.([]interface{}); ok && (first || last) {
+		switch {
+		case len(a) == 0:
+			result, noMatch = nil, true
+		case first:
+			result = a[0]
+		default:
+			result = a[len(a)-1]
+		}
+	}
+
+	if m.GroupBy != nil {
+		result = m.GroupBy.apply(result)
+	}
+
+	// Reduce objects to their keys or values, if requested
+	switch {
+	case keysOnly:
+		result = objectKeys(result, order)
+	case valuesOnly:
+		result = objectValues(result, order)
+	}
+
+	if m.Merge != nil {
+		result = m.Merge.apply(result)
+	}
+
+	// Describe, count or outline the result instead of returning it, if
+	// requested
+	describing := true
+	switch {
+	case queryFlag(r, "explain"):
+		result, noMatch = explain(exprs, result, noMatch), false
+	case queryFlag(r, "count"):
+		result, noMatch = map[string]interface{}{"count": countMatches(result, noMatch)}, false
+	case queryFlag(r, "shape"):
+		result, noMatch = shapeOf(result, noMatch), false
+	case m.debugDiff(r):
+		if result, err = diff(body, result, order); err != nil {
+			return err
+		}
+		noMatch = false
+	default:
+		describing = false
+	}
+
+	// Hold the result to its contract, if configured
+	if m.schema != nil && !describing {
+		if err := m.schema.validate(result); err != nil {
+			m.logger.Warn("filtered result does not match schema",
+				zap.String("uri", r.RequestURI),
+				zap.Strings("expressions", exprs),
+				zap.Error(err))
+			if m.SchemaPassThrough {
+				return m.passThrough(r, rec, "schema-mismatch")
+			}
+			return m.writeError(w, r, http.StatusInternalServerError, withCode(codeSchemaMismatch, fmt.Errorf("result does not match schema: %v", err)))
+		}
+	}
+
+	if m.EmptyStatus != 0 && (noMatch || isEmptyArray(result)) {
+		status = m.EmptyStatus
+	}
+	if m.Envelope != nil && !describing {
+		result = m.Envelope.wrap(result, noMatch)
+	}
+	if m.ArrayEnvelope != nil && !describing {
+		result = m.ArrayEnvelope.wrap(result, total)
+	}
+	if m.WithStatus != nil && !describing {
+		result, order = m.WithStatus.wrap(result, status, w.Header(), order)
+	}
+
+	// Reshape the result with the configured template
+	if m.template != nil && !describing {
+		var out bytes.Buffer
+		if err := m.template.Execute(&out, result); err != nil {
+			m.logEvalError(r, exprs, err)
+			if m.OnError != "empty" {
+				return m.failEval(w, r, rec, err)
+			}
+			out.Reset()
+			out.WriteString("null")
+		}
+		return m.writeFiltered(w, r, rec, status, m.OutputContentType, encoding, exprs, out.Bytes())
+	}
+
+	// Write tabular results as CSV, arrays as lines or anything as
+	// MessagePack, if requested
+	format := m.outputFormat(r)
+	if format == "csv" && !describing {
+		text, ok, err := writeCSV(result, order)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return m.writeFiltered(w, r, rec, status, "text/csv; charset=utf-8", encoding, exprs, text)
+		}
+		if m.StrictFormat {
+			return m.writeError(w, r, http.StatusNotAcceptable, withCode(codeNotTabular, errors.New("result is not tabular and cannot be written as CSV")))
+		}
+	}
+	if format == "lines" && !describing {
+		text, ok, err := writeLines(result, order, m.escapeHTML())
+		if err != nil {
+			return err
+		}
+		if ok {
+			return m.writeFiltered(w, r, rec, status, "text/plain; charset=utf-8", encoding, exprs, text)
+		}
+		if m.StrictFormat {
+			return m.writeError(w, r, http.StatusNotAcceptable, withCode(codeNotArray, errors.New("result is not an array and cannot be written as lines")))
+		}
+	}
+	if format == "json-seq" {
+		text, err := writeJSONSeq(result, order, m.escapeHTML())
+		if err != nil {
+			return err
+		}
+		return m.writeFiltered(w, r, rec, status, jsonSeqContentType, encoding, exprs, text)
+	}
+	if format == "msgpack" {
+		encoded, err := encodeMsgpack(result, order)
+		if err != nil {
+			return err
+		}
+		return m.writeFiltered(w, r, rec, status, msgpackContentType, encoding, exprs, encoded)
+	}
+
+	// Write scalars as plain text, if requested
+	if m.Raw || queryFlag(r, "raw") {
+		if text, ok := rawScalar(result); ok {
+			return m.writeFiltered(w, r, rec, status, "text/plain; charset=utf-8", encoding, exprs, text)
+		}
+	}
+
+	// Marshal filtered result
+	if m.Canonical {
+		filtered, err := marshalCanonical(result)
+		if err != nil {
+			return err
+		}
+		return m.writeJSON(w, r, rec, status, encoding, exprs, callback, filtered)
+	}
+	pretty := m.Pretty || queryFlag(r, "pretty")
+	if a, ok := result.([]interface{}); ok && m.Stream && callback == "" && status != http.StatusNoContent && status != http.StatusNotModified {
+		return m.writeStream(w, r, rec, status, encoding, exprs, a, order, pretty)
+	}
+	filtered, err := marshalJSON(result, order, pretty, m.escapeHTML())
+	if err != nil {
+		return err
+	}
+	return m.writeJSON(w, r, rec, status, encoding, exprs, callback, filtered)
+}
+
+// writeJSON writes the JSON result filtered, wrapped in a call of the
+// JSONP callback if there is one.
+func (m *ResponseFilter) writeJSON(w http.ResponseWriter, r *http.Request, rec caddyhttp.ResponseRecorder, status int, encoding string, exprs []string, callback string, filtered []byte) error {
+	if callback != "" {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		return m.writeFiltered(w, r, rec, status, "application/javascript; charset=utf-8", encoding, exprs, wrapJSONP(callback, filtered))
+	}
+	return m.writeFiltered(w, r, rec, status, m.OutputContentType, encoding, exprs, filtered)
+}
+
+// skipReason returns why the response to r is not filtered at all, or ""
+// if r is eligible for filtering.
+func (m *ResponseFilter) skipReason(r *http.Request) string {
+	switch {
+	case r.Method == http.MethodHead:
+		// HEAD responses have no body to filter
+		return "head"
+	case !m.matchesMethod(r.Method):
+		return "method"
+	case !m.matchesPath(r.URL.Path):
+		return "path"
+	case m.isBypassed(r):
+		return "bypass"
+	case m.RequireAcceptJSON && !m.acceptsJSON(r.Header.Values("Accept")):
+		return "accept"
+	case !m.isEnabled(r):
+		return "disabled"
+	case m.hasBypassParam(r):
+		return "bypass-param"
+	}
+	return ""
+}
+
+// outputFormat returns the output format for r: the one given by the
+// "format" query parameter, else MessagePack if the Accept header prefers
+// it, else Format.
+func (m *ResponseFilter) outputFormat(r *http.Request) string {
+	switch f := r.URL.Query().Get("format"); f {
+	case "json", "csv", "lines", "json-seq", "msgpack":
+		return f
+	}
+	if m.prefersMsgpack(r.Header.Values("Accept")) {
+		return "msgpack"
+	}
+	return m.Format
+}
+
+// itemsRange returns the items range requested by r if RangeItems
+// applies to the response with status.
+func (m *ResponseFilter) itemsRange(r *http.Request, status int) (itemsRange, bool) {
+	if !m.RangeItems || r.Method != http.MethodGet || status != http.StatusOK {
+		return itemsRange{}, false
+	}
+	return parseItemsRange(r.Header.Get("Range"))
+}
+
+// keyPatternFor returns the key pattern for r: the one in KeyPatternParam,
+// if given, or else KeyPattern, or nil.
+func (m *ResponseFilter) keyPatternFor(r *http.Request) (*regexp.Regexp, error) {
+	if m.KeyPatternParam != "" {
+		if expr := r.URL.Query().Get(m.KeyPatternParam); expr != "" {
+			re, err := m.patterns.get(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key pattern: %v", err)
+			}
+			return re, nil
+		}
+	}
+	return m.keyPattern, nil
+}
+
+// controlParamSet returns the names of the query parameters the handler
+// acts on with its configuration.
+func (m *ResponseFilter) controlParamSet() map[string]struct{} {
+	names := []string{m.QueryParam, m.ThenParam, m.FieldsParam, m.KeyPatternParam,
+		m.SortParam, m.JSONPParam, m.BypassParam,
+		"pretty", "raw", "format", "count", "explain", "shape", "first", "last",
+		"distinct", "keys_only", "values_only"}
+	if len(m.Filters) > 0 {
+		names = append(names, m.FilterParam, m.FilterArgParam)
+	}
+	if m.Paginate {
+		names = append(names, "offset", "limit")
+	}
+	if m.AllowEngineOverride {
+		names = append(names, "engine")
+	}
+	if m.AllowDebugDiff {
+		names = append(names, "debug_diff")
+	}
+	params := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if name != "" {
+			params[name] = struct{}{}
+		}
+	}
+	return params
+}
+
+// proxy passes r to next unfiltered. With RedactErrors, responses with a
+// 5xx status are buffered and their body replaced by a generic error; all
+// others are streamed.
+func (m *ResponseFilter) proxy(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if !m.RedactErrors {
+		return next.ServeHTTP(w, r)
+	}
+	rec := caddyhttp.NewResponseRecorder(w, new(bytes.Buffer), func(status int, _ http.Header) bool {
+		return status >= 500
+	})
+	if err := next.ServeHTTP(rec, r); err != nil {
+		return err
+	}
+	if !rec.Buffered() {
+		return nil
+	}
+	if rec.Status() >= 500 {
+		return m.redactError(w, r, rec.Status())
+	}
+	// Nothing was written
+	return rec.WriteResponse()
+}
+
+// redactError replaces an upstream response with status by a generic
+// error with that status, for RedactErrors.
+func (m *ResponseFilter) redactError(w http.ResponseWriter, r *http.Request, status int) error {
+	return m.writeError(w, r, status, withCode(codeUpstreamError, errors.New("upstream error")))
+}
+
+// stripControlParams wraps next so that it is called with a copy of the
+// request whose query lacks the control parameters. The order and
+// encoding of the remaining parameters are kept.
+func (m *ResponseFilter) stripControlParams(next caddyhttp.Handler) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.URL.RawQuery == "" {
+			return next.ServeHTTP(w, r)
+		}
+		var kept []string
+		for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+			key, _, _ := strings.Cut(pair, "=")
+			if name, err := url.QueryUnescape(key); err == nil {
+				if _, ok := m.controlParams[name]; ok {
+					continue
+				}
+			}
+			kept = append(kept, pair)
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.RawQuery = strings.Join(kept, "&")
+		r2.URL = &u
+		r2.RequestURI = u.RequestURI()
+		return next.ServeHTTP(w, r2)
+	})
+}
+
+// hasBypassParam reports whether r carries BypassParam with the value
+// BypassParamValue, if configured.
+func (m *ResponseFilter) hasBypassParam(r *http.Request) bool {
+	if m.BypassParam == "" {
+		return false
+	}
+	values, ok := r.URL.Query()[m.BypassParam]
+	if !ok {
+		return false
+	}
+	if m.BypassParamValue == "" {
+		return true
+	}
+	for _, value := range values {
+		if value == m.BypassParamValue {
+			return true
+		}
+	}
+	return false
+}
+
+// isEnabled reports whether r carries EnableHeader with the value
+// EnableHeaderValue, if configured.
+func (m *ResponseFilter) isEnabled(r *http.Request) bool {
+	if m.EnableHeader == "" {
+		return true
+	}
+	values, ok := r.Header[http.CanonicalHeaderKey(m.EnableHeader)]
+	if !ok {
+		return false
+	}
+	if m.EnableHeaderValue == "" {
+		return true
+	}
+	for _, value := range values {
+		if value == m.EnableHeaderValue {
+			return true
+		}
+	}
+	return false
+}
+
+// streamReason decides, before the body is written, whether a response
+// with status and header hdr is worth buffering. It returns the reason
+// for streaming it instead, or "" if the response should be buffered.
+func (m *ResponseFilter) streamReason(status int, hdr http.Header) string {
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		return "no-body"
+	}
+	if !hasHeaders(hdr, m.RequireResponseHeader) {
+		return "header"
+	}
+	ct := hdr.Get("Content-Type")
+	if isEventStream(ct) {
+		// Never buffer server-sent events, even in strict mode, so that
+		// every flushed event reaches the client
+		return "event-stream"
+	}
+	if !m.isJSONContentType(ct) && !(m.NDJSON && isNDJSONContentType(ct)) {
+		return "non-json"
+	}
+	if m.MaxBodySize > 0 && !m.RejectLargeBody {
+		if n, err := strconv.ParseInt(hdr.Get("Content-Length"), 10, 64); err == nil && n > m.MaxBodySize {
+			return "too-large"
+		}
+	}
+	if m.MinBodySize > 0 {
+		if n, err := strconv.ParseInt(hdr.Get("Content-Length"), 10, 64); err == nil && n < m.MinBodySize {
+			return "too-small"
+		}
+	}
+	return ""
+}
+
+// headerDoc returns hdr as a JSON object mapping the canonical header
+// names to their values, joined with ", ". Trailer values are left out.
+func headerDoc(hdr http.Header) map[string]interface{} {
+	doc := make(map[string]interface{}, len(hdr))
+	for name, values := range hdr {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			continue
+		}
+		doc[http.CanonicalHeaderKey(name)] = strings.Join(values, ", ")
+	}
+	return doc
+}
+
+// hasHeaders reports whether hdr has every header in required with the
+// given value, or with any value if the value is empty.
+func hasHeaders(hdr http.Header, required map[string]string) bool {
+	for name, want := range required {
+		values := hdr.Values(name)
+		if want == "" && len(values) > 0 {
+			continue
+		}
+		found := false
+		for _, value := range values {
+			if value == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFiltered writes the filtered body with the given status and
+// content type, restoring the upstream content encoding. Upstream headers
+// are already present on w since the recorder shares its header map.
+// Upstream trailers are all sent after the filtered body, so the response
+// has no Content-Length then. The response, without trailers, is stored
+// in the result cache, if enabled.
+func (m *ResponseFilter) writeFiltered(w http.ResponseWriter, r *http.Request, rec caddyhttp.ResponseRecorder, status int, contentType, encoding string, exprs []string, filtered []byte) error {
+	upstreamType := rec.Header().Get("Content-Type")
+	validator := responseValidator(rec.Header())
+	cacheKey := m.resultKey(r)
+	if !storable(rec.Header()) {
+		// Checked before CacheControl replaces the upstream header
+		cacheKey = ""
+	}
+	hdr := w.Header()
+	for _, name := range bodyHeaders {
+		hdr.Del(name)
+	}
+	for _, name := range m.StripHeaders {
+		hdr.Del(name)
+	}
+	trailers := takeTrailers(hdr)
+	m.setDebugHeader(hdr, "applied")
+	m.setCacheControl(hdr, true)
+	m.setHeaders(r, hdr, true)
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		hdr.Del("Content-Encoding")
+		hdr.Del("Content-Length")
+		w.WriteHeader(status)
+		return nil
+	}
+
+	var etag string
+	if m.ETag && status == http.StatusOK {
+		etag = weakETag(filtered)
+		hdr.Set("Etag", etag)
+	}
+	if m.shouldCompress(r, encoding, len(filtered)) {
+		encoding = "gzip"
+		hdr.Set("Content-Encoding", encoding)
+		hdr.Add("Vary", "Accept-Encoding")
+	}
+	filtered, err := encodeBody(encoding, filtered)
+	if err != nil {
+		return err
+	}
+	hdr.Set("Content-Type", contentType)
+	if len(trailers) == 0 {
+		hdr.Set("Content-Length", strconv.Itoa(len(filtered)))
+	} else {
+		// Trailers require a chunked response
+		hdr.Del("Content-Length")
+	}
+	m.metrics.filtered.Inc()
+	m.metrics.filteredSize.Observe(float64(len(filtered)))
+	traceOutcome(r, "applied", attribute.Int("jsonpath_filter.result_size", len(filtered)))
+	if ce := m.logger.Check(zapcore.DebugLevel, "response filtered"); ce != nil {
+		ce.Write(
+			zap.Strings("expressions", exprs),
+			zap.String("content_type", upstreamType),
+			zap.Bool("applied", true),
+			zap.Int("size", len(filtered)))
+	}
+	m.storeResult(r, cacheKey, validator, status, hdr, filtered)
+	if notModified(r, etag) {
+		return writeNotModified(w, hdr)
+	}
+	w.WriteHeader(status)
+	_, err = io.Copy(w, bytes.NewReader(filtered))
+	setTrailers(hdr, trailers)
+	return m.abortBody(err)
+}
+
+// takeTrailers removes the upstream trailers from hdr and returns them,
+// leaving them declared in the Trailer header. Trailers are those already
+// declared there and those set with http.TrailerPrefix. Since the
+// recorder shares its header map with w, their values are in hdr once
+// the upstream body has been buffered, and would be sent as headers, if
+// at all, unless moved after the body with setTrailers.
+func takeTrailers(hdr http.Header) http.Header {
+	var trailers http.Header
+	take := func(key, name string) {
+		if trailers == nil {
+			trailers = make(http.Header)
+		}
+		trailers[name] = hdr[key]
+		delete(hdr, key)
+	}
+	for _, value := range hdr.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if _, ok := hdr[name]; ok {
+				take(name, name)
+			}
+		}
+	}
+	for key := range hdr {
+		if name, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			take(key, http.CanonicalHeaderKey(name))
+		}
+	}
+	if trailers != nil {
+		names := make([]string, 0, len(trailers))
+		for name := range trailers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		hdr.Set("Trailer", strings.Join(names, ", "))
+	}
+	return trailers
+}
+
+// setTrailers sets trailers on hdr after the body has been written, so
+// that they are sent as trailers.
+func setTrailers(hdr, trailers http.Header) {
+	for name, values := range trailers {
+		hdr[http.TrailerPrefix+name] = values
+	}
+}
+
+// abortBody logs err, which occurred while writing a response body after
+// the status was sent, and returns nil. Returning the error would make
+// Caddy's error handling write a second status over the partial response.
+func (m *ResponseFilter) abortBody(err error) error {
+	if err != nil {
+		m.logger.Debug("writing response body", zap.Error(err))
+	}
+	return nil
+}
+
+// shouldCompress reports whether filtered output of size bytes is to be
+// gzipped, given the upstream content encoding. A negative size stands
+// for streamed output of unknown size, which is never too small.
+func (m *ResponseFilter) shouldCompress(r *http.Request, encoding string, size int) bool {
+	if !m.Compress || (size >= 0 && size < m.CompressMinLength) {
+		return false
+	}
+	if enc := normalizeEncoding(encoding); enc != "" && enc != "identity" {
+		return false
+	}
+	return acceptsGzip(r)
+}
+
+// logEvalError counts and logs a failed expression evaluation.
+func (m *ResponseFilter) logEvalError(r *http.Request, exprs []string, err error) {
+	m.metrics.errors.Inc()
+	fields := []zap.Field{
+		zap.String("uri", r.RequestURI),
+		zap.Strings("expressions", exprs),
+		zap.Error(err),
+	}
+	var pe *panicError
+	if errors.As(err, &pe) {
+		fields = append(fields, zap.ByteString("stack", pe.Stack))
+	}
+	m.logger.Warn("JSONPath error", fields...)
+}
+
+// failEval responds to a failed expression evaluation according to
+// OnError: with the original response, status included, for
+// "passthrough", with a 400 error otherwise.
+func (m *ResponseFilter) failEval(w http.ResponseWriter, r *http.Request, rec caddyhttp.ResponseRecorder, err error) error {
+	if m.OnError == "passthrough" {
+		return m.passThrough(r, rec, "error")
+	}
+	return m.writeError(w, r, evalStatus(err), err)
+}
+
+// passThrough writes the recorded upstream response unmodified. reason
+// describes why filtering was skipped and is logged at debug level.
+func (m *ResponseFilter) passThrough(r *http.Request, rec caddyhttp.ResponseRecorder, reason string) error {
+	m.setDebugHeader(rec.Header(), "skipped; "+reason)
+	m.setCacheControl(rec.Header(), false)
+	m.setHeaders(r, rec.Header(), false)
+	m.logSkip(r, rec.Header().Get("Content-Type"), reason)
+	trailers := takeTrailers(rec.Header())
+	err := rec.WriteResponse()
+	setTrailers(rec.Header(), trailers)
+	return err
+}
+
+// logSkip counts and logs at debug level that filtering of a response
+// with the upstream content type ct was skipped for reason.
+func (m *ResponseFilter) logSkip(r *http.Request, ct, reason string) {
+	m.metrics.passThrough.WithLabelValues(reason).Inc()
+	traceOutcome(r, "skipped", attribute.String("jsonpath_filter.reason", reason))
+	if ce := m.logger.Check(zapcore.DebugLevel, "response passed through"); ce != nil {
+		ce.Write(
+			zap.String("uri", r.RequestURI),
+			zap.String("content_type", ct),
+			zap.Bool("applied", false),
+			zap.String("reason", reason))
+	}
+}
+
+// setCacheControl sets CacheControl, if configured, in the header hdr of
+// a filtered response, or of an unfiltered one with
+// CacheControlPassThrough.
+func (m *ResponseFilter) setCacheControl(hdr http.Header, filtered bool) {
+	if m.CacheControl == "" || !filtered && !m.CacheControlPassThrough {
+		return
+	}
+	hdr.Set("Cache-Control", m.CacheControl)
+	for _, name := range []string{m.Header, m.TenantHeader} {
+		if name != "" {
+			hdr.Add("Vary", name)
+		}
+	}
+}
+
+// setHeaders sets SetHeaders, with the placeholders replaced for r, in
+// the header hdr of a filtered response, or of an unfiltered one with
+// SetHeadersPassThrough.
+func (m *ResponseFilter) setHeaders(r *http.Request, hdr http.Header, filtered bool) {
+	if len(m.SetHeaders) == 0 || !filtered && !m.SetHeadersPassThrough {
+		return
+	}
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	for name, value := range m.SetHeaders {
+		if repl != nil {
+			value = repl.ReplaceAll(value, "")
+		}
+		hdr.Set(name, value)
+	}
+}
+
+// setDebugHeader sets the debug header to value, if enabled.
+func (m *ResponseFilter) setDebugHeader(hdr http.Header, value string) {
+	if m.DebugHeader {
+		hdr.Set(debugHeader, value)
+	}
+}
+
+// expressions returns the JSONPath expressions supplied with r, looking
+// at the configured query parameter first, then at the named filter, the
+// configured header and the placeholder expression. If none is present
+// the default expression is returned.
+// fromClient reports whether the expressions were supplied by the request.
+func (m *ResponseFilter) expressions(r *http.Request) (exprs []string, fromClient bool) {
+	for _, expr := range r.URL.Query()[m.QueryParam] {
+		if expr != "" {
+			exprs = append(exprs, m.prefixExpression(expr))
+		}
+	}
+	if len(exprs) > 0 {
+		return exprs, true
+	}
+	if expr, ok := m.Filters[m.filterName(r)]; ok {
+		return []string{bindArgs(expr, r.URL.Query()[m.FilterArgParam])}, false
+	}
+	if m.Header != "" {
+		if expr := r.Header.Get(m.Header); expr != "" {
+			return []string{m.prefixExpression(expr)}, true
+		}
+	}
+	if expr := m.expandExpression(r); expr != "" {
+		return []string{expr}, true
+	}
+	if m.DefaultExpression != "" {
+		return []string{m.DefaultExpression}, false
+	}
+	return nil, false
+}
+
+// prefixExpression joins ExpressionPrefix, if any, and the client-supplied
+// expression expr, dropping the root of expr and inserting a dot between
+// them where needed.
+func (m *ResponseFilter) prefixExpression(expr string) string {
+	if m.ExpressionPrefix == "" {
+		return expr
+	}
+	prefix := strings.TrimSuffix(m.ExpressionPrefix, ".")
+	expr = strings.TrimPrefix(strings.TrimSpace(expr), "$")
+	if expr == "" || expr[0] == '.' || expr[0] == '[' {
+		return prefix + expr
+	}
+	return prefix + "." + expr
+}
+
+// unknownFilter returns the filter name requested by r if it is not one
+// of Filters, or "" otherwise.
+func (m *ResponseFilter) unknownFilter(r *http.Request) string {
+	if len(m.Filters) == 0 {
+		return ""
+	}
+	name := m.filterName(r)
+	if _, ok := m.Filters[name]; ok {
+		return ""
+	}
+	return name
+}
+
+// checkFilterArgs returns an error if r selects a named filter but does
+// not pass as many arguments as it takes.
+func (m *ResponseFilter) checkFilterArgs(r *http.Request) error {
+	if len(m.Filters) == 0 || r.URL.Query().Get(m.QueryParam) != "" {
+		return nil
+	}
+	name := m.filterName(r)
+	want, ok := m.filterArity[name]
+	if !ok {
+		return nil
+	}
+	if got := len(r.URL.Query()[m.FilterArgParam]); got != want {
+		return withCode(codeInvalidRequest, fmt.Errorf("filter %q takes %d arguments, got %d", name, want, got))
+	}
+	return nil
+}
+
+// argPlaceholder matches the argument placeholders of named filters.
+var argPlaceholder = regexp.MustCompile(`\{([0-9]+)\}`)
+
+// filterArity returns the number of arguments the named filter expr
+// takes, one more than its highest placeholder index. It returns an error
+// if a placeholder is not inside a double-quoted string.
+func filterArity(expr string) (int, error) {
+	n := 0
+	for _, loc := range argPlaceholder.FindAllStringSubmatchIndex(expr, -1) {
+		placeholder := expr[loc[0]:loc[1]]
+		if !inString(expr, loc[0]) {
+			return 0, fmt.Errorf("placeholder %s must be inside a double-quoted string", placeholder)
+		}
+		i, err := strconv.Atoi(expr[loc[2]:loc[3]])
+		if err != nil || i >= maxFilterArgs {
+			return 0, fmt.Errorf("invalid placeholder %s", placeholder)
+		}
+		if i >= n {
+			n = i + 1
+		}
+	}
+	return n, nil
+}
+
+// inString reports whether offset i of expr is inside a double-quoted
+// string.
+func inString(expr string, i int) bool {
+	quoted := false
+	for j := 0; j < i; j++ {
+		switch expr[j] {
+		case '\\':
+			if quoted {
+				j++
+			}
+		case '"':
+			quoted = !quoted
+		}
+	}
+	return quoted
+}
+
+// bindArgs replaces the placeholders of the named filter expr by args,
+// escaped as in JSON strings. Placeholders without an argument are left
+// as they are.
+func bindArgs(expr string, args []string) string {
+	if len(args) == 0 {
+		return expr
+	}
+	return argPlaceholder.ReplaceAllStringFunc(expr, func(placeholder string) string {
+		i, err := strconv.Atoi(placeholder[1 : len(placeholder)-1])
+		if err != nil || i >= len(args) {
+			return placeholder
+		}
+		b, err := json.Marshal(args[i])
+		if err != nil {
+			return placeholder
+		}
+		return string(b[1 : len(b)-1])
+	})
+}
+
+// filterName returns the name of the filter requested by r in
+// FilterParam, or else by FilterPlaceholder, or "".
+func (m *ResponseFilter) filterName(r *http.Request) string {
+	if name := r.URL.Query().Get(m.FilterParam); name != "" || m.FilterPlaceholder == "" {
+		return name
+	}
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return ""
+	}
+	return repl.ReplaceAll(m.FilterPlaceholder, "")
+}
+
+// statusExpression returns the expression configured for responses with
+// status, or "" if there is none.
+func (m *ResponseFilter) statusExpression(status int) string {
+	if len(m.StatusExpressions) == 0 {
+		return ""
+	}
+	code := strconv.Itoa(status)
+	if expr, ok := m.StatusExpressions[code]; ok {
+		return expr
+	}
+	return m.StatusExpressions[code[:1]+"xx"]
+}
+
+// isStatusPattern reports whether s is a three-digit status code or a
+// status class such as "2xx".
+func isStatusPattern(s string) bool {
+	if len(s) != 3 || s[0] < '1' || s[0] > '9' {
+		return false
+	}
+	if s[1:] == "xx" {
+		return true
+	}
+	return s[1] >= '0' && s[1] <= '9' && s[2] >= '0' && s[2] <= '9'
+}
+
+// shareExprs pins the configured expressions in the expression cache,
+// sharing their compiled form with other handler instances.
+func (m *ResponseFilter) shareExprs(kind string) {
+	for _, expr := range []string{m.DefaultExpression, m.Root, m.When} {
+		if expr != "" {
+			m.exprs.share(kind, expr)
+		}
+	}
+	for _, expr := range m.Allow {
+		m.exprs.share(kind, expr)
+	}
+	for _, expr := range m.StatusExpressions {
+		m.exprs.share(kind, expr)
+	}
+	for _, expr := range m.Filters {
+		m.exprs.share(kind, expr)
+	}
+}
+
+// Cleanup implements caddy.CleanerUpper. It releases the shared compiled
+// expressions.
+func (m *ResponseFilter) Cleanup() error {
+	if m.exprs != nil {
+		m.exprs.release()
+	}
+	return nil
+}
+
+// loadFiltersFile adds the filters of FiltersFile, if set, to Filters.
+func (m *ResponseFilter) loadFiltersFile() error {
+	if m.FiltersFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(m.FiltersFile)
+	if err != nil {
+		return err
+	}
+	var filters map[string]string
+	if err := json.Unmarshal(b, &filters); err != nil {
+		return fmt.Errorf("parsing %s: %v", m.FiltersFile, err)
+	}
+	if m.Filters == nil {
+		m.Filters = make(map[string]string, len(filters))
+	}
+	for name, expr := range filters {
+		if _, ok := m.Filters[name]; !ok {
+			m.Filters[name] = expr
+		}
+	}
+	return nil
+}
+
+// expandEnv replaces environment placeholders in the configured
+// expressions. Other placeholders, as well as jq object constructions
+// such as {a: .b}, are left alone.
+func (m *ResponseFilter) expandEnv() {
+	repl := caddy.NewEmptyReplacer()
+	repl.Map(func(key string) (interface{}, bool) {
+		if name, ok := strings.CutPrefix(key, "env."); ok {
+			return os.Getenv(name), true
+		}
+		return nil, false
+	})
+	expand := func(s string) string {
+		return repl.ReplaceKnown(s, "")
+	}
+	expandAll := func(list []string) {
+		for i, s := range list {
+			list[i] = expand(s)
+		}
+	}
+	m.ExpressionPrefix = expand(m.ExpressionPrefix)
+	m.DefaultExpression = expand(m.DefaultExpression)
+	m.Root = expand(m.Root)
+	m.When = expand(m.When)
+	expandAll(m.Allow)
+	expandAll(m.AllowPrefix)
+	expandAll(m.Remove)
+	for _, list := range m.TenantAllow {
+		expandAll(list)
+	}
+	for status, expr := range m.StatusExpressions {
+		m.StatusExpressions[status] = expand(expr)
+	}
+	for name, expr := range m.Filters {
+		m.Filters[name] = expand(expr)
+	}
+}
+
+// expandExpression returns the placeholder expression with the
+// placeholders replaced for r, or "" if there is none.
+func (m *ResponseFilter) expandExpression(r *http.Request) string {
+	if m.Expression == "" {
+		return ""
+	}
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return ""
+	}
+	return repl.ReplaceAll(m.Expression, "")
+}
+
+// transform removes the configured nodes from data and then applies
+// exprs, if any, relative to the configured root. With an evaluation
+// timeout, it returns errEvalTimeout once the timeout expires, as
+// described for bounded; data must not be used afterwards.
+func (m *ResponseFilter) transform(ctx context.Context, exprs []string, data interface{}) (interface{}, error) {
+	if m.MaxDepth > 0 {
+		for _, expr := range exprs {
+			if hasRecursiveDescent(expr) && exceedsDepth(data, m.MaxDepth) {
+				return nil, &exprError{expr, errTooDeep}
+			}
+		}
+	}
+	return m.bounded(ctx, func(ctx context.Context) (interface{}, error) {
+		return m.transformDoc(ctx, exprs, data)
+	})
+}
+
+// refine applies the second-stage expression expr to the object or array
+// result of the filter expressions, like transform but without removal
+// or root. Other results are returned as they are.
+func (m *ResponseFilter) refine(ctx context.Context, expr string, result interface{}) (interface{}, error) {
+	switch result.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		return result, nil
+	}
+	if m.MaxDepth > 0 && hasRecursiveDescent(expr) && exceedsDepth(result, m.MaxDepth) {
+		return nil, &exprError{expr, errTooDeep}
+	}
+	return m.bounded(ctx, func(ctx context.Context) (interface{}, error) {
+		return m.eval(ctx, expr, result)
+	})
+}
+
+// bounded runs eval, returning errEvalTimeout once the evaluation timeout,
+// if any, expires. eval is passed a context that is cancelled then; jq
+// programs stop on it, while JSONPath expressions and other work that
+// does not observe the context run to completion in the background, so
+// that their goroutine outlives the request by as long as they take.
+func (m *ResponseFilter) bounded(ctx context.Context, eval func(context.Context) (interface{}, error)) (interface{}, error) {
+	if m.EvalTimeout <= 0 {
+		return eval(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.EvalTimeout))
+	defer cancel()
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+	// Buffered, so that the goroutine can finish after a timeout
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := eval(ctx)
+		done <- outcome{result, err}
+	}()
+	select {
+	case o := <-done:
+		if o.err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// eval stopped because of the timeout
+			return nil, errEvalTimeout
+		}
+		return o.result, o.err
+	case <-ctx.Done():
+		return nil, errEvalTimeout
+	}
+}
+
+// transformDoc does the work of transform without a timeout.
+func (m *ResponseFilter) transformDoc(ctx context.Context, exprs []string, data interface{}) (interface{}, error) {
+	if len(m.removePaths) > 0 {
+		data = removePaths(ctx, data, m.removePaths)
+	}
+	if len(m.removeKeys) > 0 {
+		removeKeys(data, m.removeKeys)
+	}
+	if len(exprs) == 0 {
+		return data, nil
+	}
+	if a, ok := data.([]interface{}); ok && m.WrapArray != "" {
+		data = map[string]interface{}{m.WrapArray: a}
+	}
+	if m.Root != "" {
+		var err error
+		if data, err = m.eval(ctx, m.Root, data); err != nil {
+			return nil, err
+		}
+	}
+	return m.apply(ctx, exprs, data)
+}
+
+// apply evaluates exprs against data. A single expression yields its raw
+// result; several are combined according to the multi mode, in which case
+// expressions matching nothing contribute null, and failing ones their
+// error with PartialResults.
+func (m *ResponseFilter) apply(ctx context.Context, exprs []string, data interface{}) (interface{}, error) {
+	if len(exprs) == 1 {
+		return m.eval(ctx, exprs[0], data)
+	}
+	results := make([]interface{}, 0, len(exprs))
+	var firstErr error
+	failed := 0
+	for _, expr := range exprs {
+		result, err := m.eval(ctx, expr, data)
+		if err != nil && !errors.Is(err, errNoMatch) {
+			if !m.PartialResults {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			result = map[string]interface{}{"error": err.Error(), "code": errorCode(err)}
+		}
+		results = append(results, result)
+	}
+	if failed == len(exprs) {
+		return nil, firstErr
+	}
+	if m.Multi == "array" {
+		return results, nil
+	}
+	keyed := make(map[string]interface{}, len(exprs))
+	for i, expr := range exprs {
+		keyed[expr] = results[i]
+	}
+	return keyed, nil
+}
+
+// partial reports whether failures of exprs are reported among the
+// results rather than failing the request.
+func (m *ResponseFilter) partial(exprs []string) bool {
+	return m.PartialResults && len(exprs) > 1
+}
+
+// checkLength returns an error if the client-supplied expression expr is
+// longer than MaxExpressionLength.
+func (m *ResponseFilter) checkLength(expr string) error {
+	if m.MaxExpressionLength > 0 && len(expr) > m.MaxExpressionLength {
+		return withCode(codeInvalidRequest, fmt.Errorf("expression of %d bytes exceeds the limit of %d", len(expr), m.MaxExpressionLength))
+	}
+	return nil
+}
+
+// checkSyntax compiles expr with the engine eng, or fetches it from the
+// cache, and returns an *exprError wrapping a *syntaxError if it is
+// malformed. A panic while compiling is not a syntax error: it is
+// swallowed here and recovered, logged and reported by eval instead.
+func (m *ResponseFilter) checkSyntax(eng exprEngine, expr string) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = nil
+		}
+	}()
+	if _, err := eng.exprs.get(expr); err != nil {
+		return &exprError{expr, newSyntaxError(err)}
+	}
+	return nil
+}
+
+// eval compiles (or fetches from the cache) and evaluates expr against
+// data. It returns errNoMatch if expr selects a key or index that does
+// not exist; other errors are returned as *exprError.
+func (m *ResponseFilter) eval(ctx context.Context, expr string, data interface{}) (result interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			result, err = nil, &exprError{expr, &panicError{Value: p, Stack: debug.Stack()}}
+		}
+	}()
+	eval, err := m.engine(ctx).exprs.get(expr)
+	if err != nil {
+		return nil, &exprError{expr, newSyntaxError(err)}
+	}
+	result, err = eval(ctx, data)
+	if err != nil {
+		if errors.Is(err, errNoMatch) || isNoMatch(err) {
+			return nil, errNoMatch
+		}
+		return nil, &exprError{expr, err}
+	}
+	return result, nil
+}
+
+// matchesWhen reports whether data satisfies the When condition, if any.
+func (m *ResponseFilter) matchesWhen(r *http.Request, data interface{}) bool {
+	if m.When == "" {
+		return true
+	}
+	result, err := m.eval(r.Context(), m.When, data)
+	if err != nil {
+		if !errors.Is(err, errNoMatch) {
+			m.logEvalError(r, []string{m.When}, err)
+		}
+		return false
+	}
+	return isTruthy(result)
+}
+
+// isTruthy reports whether v is neither null, false, zero nor empty.
+func isTruthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case int:
+		return v != 0
+	case json.Number:
+		f, err := v.Float64()
+		return err != nil || f != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
+
+// errNoMatch reports that an expression matched nothing.
+var errNoMatch = errors.New("no match")
+
+// isNoMatch reports whether err is the jsonpath package's error for a
+// missing key or an out of range index. The package has no typed errors,
+// so this matches on the message.
+func isNoMatch(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "unknown key ") ||
+		(strings.HasPrefix(msg, "index ") && strings.HasSuffix(msg, " out of bounds"))
+}
+
+// yieldsCollection reports whether null results of exprs are to be
+// written as empty arrays according to NullToEmptyArray.
+func (m *ResponseFilter) yieldsCollection(exprs []string) bool {
+	switch m.NullToEmptyArray {
+	case "always":
+		return true
+	case "auto":
+		if len(exprs) != 1 {
+			return false
+		}
+		if segs, err := parsePath(exprs[0]); err == nil {
+			return isAmbiguous(segs)
+		}
+		return strings.Contains(exprs[0], "[*]") || strings.Contains(exprs[0], "..")
+	}
+	return false
+}
+
+// isEmptyArray reports whether v is an array without elements.
+func isEmptyArray(v interface{}) bool {
+	a, ok := v.([]interface{})
+	return ok && len(a) == 0
+}
+
+// matchesMethod reports whether requests with method are subject to
+// filtering according to Methods.
+func (m *ResponseFilter) matchesMethod(method string) bool {
+	if len(m.Methods) == 0 {
+		return true
+	}
+	for _, want := range m.Methods {
+		if method == want {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPath reports whether requests for path are subject to filtering
+// according to OnlyPaths and ExceptPaths.
+func (m *ResponseFilter) matchesPath(path string) bool {
+	for _, re := range m.exceptPaths {
+		if re.MatchString(path) {
+			return false
+		}
+	}
+	if len(m.onlyPaths) == 0 {
+		return true
+	}
+	for _, re := range m.onlyPaths {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsJSON reports whether the Accept header values admit one of the
+// filterable content types.
+func (m *ResponseFilter) acceptsJSON(accept []string) bool {
+	if len(accept) == 0 {
+		return true
+	}
+	for _, value := range accept {
+		for _, mediaRange := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+			if q, ok := params["q"]; ok {
+				if qv, err := strconv.ParseFloat(q, 64); err != nil || qv <= 0 {
+					continue
+				}
+			}
+			if mediaType == "*/*" || mediaType == "application/*" || m.isJSONContentType(mediaType) || isMsgpackType(mediaType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compileGlobs compiles glob patterns into anchored regular expressions.
+func compileGlobs(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		var sb strings.Builder
+		sb.WriteString("^")
+		for _, r := range pattern {
+			switch r {
+			case '*':
+				sb.WriteString(".*")
+			case '?':
+				sb.WriteString(".")
+			default:
+				sb.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		sb.WriteString("$")
+		re, err := regexp.Compile(sb.String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// escapeHTML reports whether the filtered output escapes HTML characters.
+func (m *ResponseFilter) escapeHTML() bool {
+	return m.EscapeHTML == nil || *m.EscapeHTML
+}
+
+// queryFlag reports whether the boolean query flag name is set to a true
+// value, such as "1" or "true", on r.
+func queryFlag(r *http.Request, name string) bool {
+	v, err := strconv.ParseBool(r.URL.Query().Get(name))
+	return err == nil && v
+}
+
+// isAllowed reports whether the client-supplied expression expr of r
+// passes the allow list of its tenant, or the global one.
+func (m *ResponseFilter) isAllowed(r *http.Request, expr string) bool {
+	allowed, prefixes := m.allowed, m.allowPrefixes
+	if m.TenantHeader != "" {
+		if tenant, ok := m.tenants[r.Header.Get(m.TenantHeader)]; ok {
+			allowed, prefixes = tenant, nil
+		} else if m.DenyUnknownTenants {
+			return false
+		}
+	}
+	if allowed == nil && len(prefixes) == 0 {
+		return true
+	}
+	if _, ok := allowed[expr]; ok {
+		return true
+	}
+	return hasPathPrefix(expr, prefixes)
+}
+
+// isJSONContentType reports whether the Content-Type header value ct
+// matches one of the configured content types. Media type parameters such
+// as charset are ignored.
+func (m *ResponseFilter) isJSONContentType(ct string) bool {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, re := range m.contentTypes {
+		if re.MatchString(mediaType) {
+			return true
+		}
+	}
+	for _, want := range m.ContentTypes {
+		if strings.HasPrefix(want, "+") {
+			if strings.HasSuffix(mediaType, want) {
+				return true
+			}
+		} else if mediaType == want {
+			return true
+		}
+	}
+	return false
+}
+
+// isEventStream reports whether the Content-Type header value ct denotes
+// a server-sent event stream.
+func isEventStream(ct string) bool {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	return err == nil && mediaType == "text/event-stream"
 }
 
 // Interface guards
 var (
+	_ caddy.Provisioner           = (*ResponseFilter)(nil)
+	_ caddy.Validator             = (*ResponseFilter)(nil)
+	_ caddy.CleanerUpper          = (*ResponseFilter)(nil)
 	_ caddyhttp.MiddlewareHandler = (*ResponseFilter)(nil)
 	_ caddyfile.Unmarshaler       = (*ResponseFilter)(nil)
 )
@@ -0,0 +1,2139 @@
+package jsonpathfilter
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// provision provisions and validates m, with logging disabled, and cleans
+// it up when the test completes.
+func provision(tb testing.TB, m *ResponseFilter) {
+	tb.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	tb.Cleanup(cancel)
+	if err := m.Provision(ctx); err != nil {
+		tb.Fatalf("Provision: %v", err)
+	}
+	m.logger = zap.NewNop()
+	tb.Cleanup(func() { m.Cleanup() })
+	if err := m.Validate(); err != nil {
+		tb.Fatalf("Validate: %v", err)
+	}
+}
+
+// respond returns an upstream handler writing status, the Content-Type
+// contentType, unless empty, and body.
+func respond(status int, contentType, body string) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(status)
+		_, err := w.Write([]byte(body))
+		return err
+	})
+}
+
+// serve serves a GET of target through the provisioned m and next.
+func serve(tb testing.TB, m *ResponseFilter, target string, next caddyhttp.Handler) *httptest.ResponseRecorder {
+	tb.Helper()
+	return serveRequest(tb, m, httptest.NewRequest(http.MethodGet, target, nil), next)
+}
+
+// serveRequest serves req through the provisioned m and next.
+func serveRequest(tb testing.TB, m *ResponseFilter, req *http.Request, next caddyhttp.Handler) *httptest.ResponseRecorder {
+	tb.Helper()
+	rr := httptest.NewRecorder()
+	if err := m.ServeHTTP(rr, req, next); err != nil {
+		tb.Fatalf("ServeHTTP: %v", err)
+	}
+	return rr
+}
+
+func TestContentType(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"application/json", "1"},
+		{"application/json; charset=utf-8", "1"},
+		{"Application/JSON;charset=UTF-8", "1"},
+		{"text/html", doc},
+		{"text/html; charset=utf-8", doc},
+		{"", doc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter=$.a", respond(http.StatusOK, tt.contentType, doc))
+			if rr.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", rr.Code, http.StatusOK)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentTypePatterns(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	tests := []struct {
+		name        string
+		patterns    []string
+		contentType string
+		want        string
+	}{
+		{"suffix glob", []string{"application/*+json"}, "application/hal+json", "1"},
+		{"suffix glob with parameters", []string{"application/*+json"}, "application/hal+json; charset=utf-8", "1"},
+		{"suffix glob needs a suffix", []string{"application/*+json"}, "application/json", doc},
+		{"other type", []string{"application/*+json"}, "text/json", doc},
+		{"other type configured", []string{"application/*+json", "text/json"}, "text/json", "1"},
+		{"trailing glob", []string{"application/json*"}, "application/json-seq", "1"},
+		{"single character", []string{"application/x-json?"}, "application/x-json5", "1"},
+		{"single character only", []string{"application/x-json?"}, "application/x-json55", doc},
+		{"whole media type", []string{"json*"}, "application/json", doc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{ContentTypes: tt.patterns}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter=$.a", respond(http.StatusOK, tt.contentType, doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamStatus(t *testing.T) {
+	const doc = `{"a":1}`
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		status      int
+		want        string
+	}{
+		{"filtered", "/?jsonpath_filter=$.a", "application/json", http.StatusServiceUnavailable, "1"},
+		{"no expression", "/", "application/json", http.StatusServiceUnavailable, doc},
+		{"not json", "/?jsonpath_filter=$.a", "text/plain", http.StatusServiceUnavailable, doc},
+		{"not found", "/?jsonpath_filter=$.a", "application/json", http.StatusNotFound, "1"},
+		{"created", "/?jsonpath_filter=$.a", "application/json", http.StatusCreated, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(tt.status, tt.contentType, doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkServeHTTP measures filtering a response with a repeated client
+// expression, with the compiled expression cache and without it.
+func BenchmarkServeHTTP(b *testing.B) {
+	const doc = `{"store":{"book":[{"title":"a","price":8.95},{"title":"b","price":12.99},{"title":"c","price":8.99}]}}`
+	next := respond(http.StatusOK, "application/json", doc)
+	for _, bb := range []struct {
+		name      string
+		cacheSize int
+	}{
+		{"cached", 0},
+		{"uncached", -1},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			m := &ResponseFilter{CacheSize: bb.cacheSize}
+			provision(b, m)
+			req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.store.book[*].title", nil)
+			if rr := serve(b, m, req.RequestURI, next); rr.Code != http.StatusOK {
+				b.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := m.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	const doc = `{"a":1}`
+	tests := []struct {
+		name   string
+		max    int64
+		reject bool
+		status int
+		want   string
+	}{
+		{"under", int64(len(doc)) + 1, false, http.StatusOK, "1"},
+		{"at", int64(len(doc)), false, http.StatusOK, "1"},
+		{"over", int64(len(doc)) - 1, false, http.StatusOK, doc},
+		{"under rejecting", int64(len(doc)) + 1, true, http.StatusOK, "1"},
+		{"at rejecting", int64(len(doc)), true, http.StatusOK, "1"},
+		{"over rejecting", int64(len(doc)) - 1, true, http.StatusRequestEntityTooLarge, ""},
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(doc)))
+		_, err := w.Write([]byte(doc))
+		return err
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{MaxBodySize: tt.max, RejectLargeBody: tt.reject}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter=$.a", next)
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && rr.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	tests := []struct {
+		onError string
+		expr    string
+		status  int
+		want    string
+	}{
+		{"fail", "$[", http.StatusUnprocessableEntity, `{"error":"parsing error: $[\t:1:3 - 1:3 unexpected EOF while scanning extensions","code":"invalid_expression","expression":"$[","position":3}`},
+		{"fail", "$.missing", http.StatusOK, "null"},
+		{"fail", "$.a", http.StatusOK, "1"},
+		{"passthrough", "$[", http.StatusOK, `{"a":1}`},
+		{"passthrough", "$.missing", http.StatusOK, "null"},
+		{"empty", "$[", http.StatusOK, "null"},
+		{"empty", "$.missing", http.StatusOK, "null"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onError+" "+tt.expr, func(t *testing.T) {
+			m := &ResponseFilter{OnError: tt.onError}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter="+tt.expr, respond(http.StatusOK, "application/json", `{"a":1}`))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := strings.TrimSpace(rr.Body.String()); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnError(t *testing.T) {
+	const doc = `{"a":1}`
+	tests := []struct {
+		onError  string
+		upstream int
+		status   int
+		want     string
+	}{
+		{"fail", http.StatusOK, http.StatusUnprocessableEntity, ""},
+		{"passthrough", http.StatusOK, http.StatusOK, doc},
+		{"passthrough", http.StatusServiceUnavailable, http.StatusServiceUnavailable, doc},
+		{"empty", http.StatusOK, http.StatusOK, "null"},
+		{"empty", http.StatusServiceUnavailable, http.StatusServiceUnavailable, "null"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onError+" "+strconv.Itoa(tt.upstream), func(t *testing.T) {
+			m := &ResponseFilter{OnError: tt.onError}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter=$[", respond(tt.upstream, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.want != "" && rr.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+// strictWriter is a response writer that fails the test if WriteHeader is
+// called more than once or after the body, or if headers are changed
+// after WriteHeader, other than trailers.
+type strictWriter struct {
+	*httptest.ResponseRecorder
+	tb      testing.TB
+	written http.Header
+	body    bool
+}
+
+func (s *strictWriter) WriteHeader(status int) {
+	s.tb.Helper()
+	switch {
+	case s.body:
+		s.tb.Errorf("WriteHeader(%d) after the body", status)
+	case s.written != nil:
+		s.tb.Errorf("WriteHeader(%d) after WriteHeader(%d)", status, s.Code)
+	}
+	s.written = s.Header().Clone()
+	s.ResponseRecorder.WriteHeader(status)
+}
+
+func (s *strictWriter) Write(p []byte) (int, error) {
+	if s.written == nil {
+		s.WriteHeader(http.StatusOK)
+	}
+	s.body = true
+	return s.ResponseRecorder.Write(p)
+}
+
+// check fails the test if headers were changed after WriteHeader.
+func (s *strictWriter) check() {
+	s.tb.Helper()
+	for name, values := range s.Header() {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			continue
+		}
+		if got, want := strings.Join(values, ", "), strings.Join(s.written[name], ", "); got != want {
+			s.tb.Errorf("header %s changed after WriteHeader from %q to %q", name, want, got)
+		}
+	}
+	for name := range s.written {
+		if _, ok := s.Header()[name]; !ok {
+			s.tb.Errorf("header %s removed after WriteHeader", name)
+		}
+	}
+}
+
+func TestWriteHeaderOnce(t *testing.T) {
+	const doc = `{"a":[1,2,3],"b":"x"}`
+	tests := []struct {
+		name        string
+		m           ResponseFilter
+		target      string
+		contentType string
+		status      int
+		body        string
+	}{
+		{"filtered", ResponseFilter{}, "/?jsonpath_filter=$.a", "application/json", http.StatusOK, doc},
+		{"filtered error status", ResponseFilter{}, "/?jsonpath_filter=$.a", "application/json", http.StatusServiceUnavailable, doc},
+		{"no expression", ResponseFilter{}, "/", "application/json", http.StatusOK, doc},
+		{"not json", ResponseFilter{}, "/?jsonpath_filter=$.a", "text/html", http.StatusOK, doc},
+		{"syntax error", ResponseFilter{}, "/?jsonpath_filter=$[", "application/json", http.StatusOK, doc},
+		{"pass through error", ResponseFilter{OnError: "passthrough"}, "/?jsonpath_filter=$[", "application/json", http.StatusOK, doc},
+		{"too large", ResponseFilter{MaxBodySize: 4}, "/?jsonpath_filter=$.a", "application/json", http.StatusOK, doc},
+		{"too large rejected", ResponseFilter{MaxBodySize: 4, RejectLargeBody: true}, "/?jsonpath_filter=$.a", "application/json", http.StatusOK, doc},
+		{"stream", ResponseFilter{Stream: true}, "/?jsonpath_filter=$.a", "application/json", http.StatusOK, doc},
+		{"etag", ResponseFilter{ETag: true, DebugHeader: true}, "/?jsonpath_filter=$.a", "application/json", http.StatusOK, doc},
+		{"sniffed", ResponseFilter{SniffBody: true}, "/?jsonpath_filter=$.a", "application/json", http.StatusOK, doc},
+		{"sniffed html", ResponseFilter{SniffBody: true}, "/?jsonpath_filter=$.a", "application/json", http.StatusOK, "<html></html>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			w := &strictWriter{ResponseRecorder: httptest.NewRecorder(), tb: t}
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if err := m.ServeHTTP(w, req, respond(tt.status, tt.contentType, tt.body)); err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			if w.written == nil {
+				t.Error("WriteHeader not called")
+			}
+			w.check()
+		})
+	}
+}
+
+func TestRedactErrors(t *testing.T) {
+	const detail = `{"error":"panic: nil pointer","stack":"main.go:42"}`
+	const redacted = `{"error":"upstream error","code":"upstream_error"}`
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		method string
+		target string
+		status int
+		want   string
+	}{
+		{"filtered", ResponseFilter{}, http.MethodGet, "/?jsonpath_filter=$.error", http.StatusInternalServerError, redacted},
+		{"no expression", ResponseFilter{}, http.MethodGet, "/", http.StatusBadGateway, redacted},
+		{"bypass param", ResponseFilter{BypassParam: "raw"}, http.MethodGet, "/?raw&jsonpath_filter=$.error", http.StatusInternalServerError, redacted},
+		{"method", ResponseFilter{Methods: []string{"GET"}}, http.MethodPost, "/?jsonpath_filter=$.error", http.StatusInternalServerError, redacted},
+		{"bypass cidr", ResponseFilter{BypassCIDRs: []string{"192.0.2.0/24"}}, http.MethodGet, "/?jsonpath_filter=$.error", http.StatusServiceUnavailable, redacted},
+		{"request direction", ResponseFilter{Direction: "request"}, http.MethodPost, "/?jsonpath_filter=$.a", http.StatusInternalServerError, redacted},
+		{"success", ResponseFilter{BypassParam: "raw"}, http.MethodGet, "/?raw", http.StatusOK, detail},
+		{"client error", ResponseFilter{BypassParam: "raw"}, http.MethodGet, "/?raw", http.StatusNotFound, detail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			m.RedactErrors = true
+			provision(t, &m)
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(`{"a":1}`))
+			req.Header.Set("Content-Type", "application/json")
+			rr := serveRequest(t, &m, req, respond(tt.status, "application/json", detail))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := strings.TrimSpace(rr.Body.String()); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalTimeout(t *testing.T) {
+	doc, _ := largeDocument(t, 100000)
+	tests := []struct {
+		name    string
+		m       ResponseFilter
+		expr    string
+		status  int
+		timeout bool
+	}{
+		{"jsonpath", ResponseFilter{}, "$..name", http.StatusGatewayTimeout, true},
+		{"jq", ResponseFilter{Engine: "jq"}, "[.. | .name? // empty]", http.StatusGatewayTimeout, true},
+		{"simple selector", ResponseFilter{}, "$.id", http.StatusGatewayTimeout, true},
+		{"empty on error", ResponseFilter{OnError: "empty"}, "$..name", http.StatusOK, true},
+		{"no timeout", ResponseFilter{}, "$.items[0].id", http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			if tt.timeout {
+				m.EvalTimeout = caddy.Duration(1)
+			}
+			provision(t, &m)
+			target := "/?jsonpath_filter=" + url.QueryEscape(tt.expr)
+			rr := serve(t, &m, target, respond(http.StatusOK, "application/json", string(doc)))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+		})
+	}
+}
+
+func TestHeaderCase(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	tests := []struct {
+		name        string
+		m           ResponseFilter
+		reqHeader   map[string]string
+		contentType string
+		upstream    map[string]string
+		want        string
+	}{
+		{"expression header", ResponseFilter{Header: "x-JSONPATH"}, map[string]string{"X-Jsonpath": "$.a"}, "application/json", nil, "1"},
+		{"enable header", ResponseFilter{EnableHeader: "x-canary"}, map[string]string{"X-CANARY": "1"}, "application/json", nil, "1"},
+		{"required response header", ResponseFilter{RequireResponseHeader: map[string]string{"x-app": "catalog"}}, nil, "application/json", map[string]string{"X-App": "catalog"}, "1"},
+		{"configured content type", ResponseFilter{ContentTypes: []string{"Application/Vnd.Api+JSON"}}, nil, "application/VND.api+json", nil, "1"},
+		{"configured suffix", ResponseFilter{ContentTypes: []string{"+JSON"}}, nil, "Application/HAL+Json", nil, "1"},
+		{"configured glob", ResponseFilter{ContentTypes: []string{"Application/*+JSON"}}, nil, "application/problem+json; charset=UTF-8", nil, "1"},
+		{"unmatched content type", ResponseFilter{ContentTypes: []string{"Application/Vnd.Api+JSON"}}, nil, "application/json", nil, doc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			target := "/?jsonpath_filter=$.a"
+			if m.Header != "" {
+				target = "/"
+			}
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			for name, value := range tt.reqHeader {
+				req.Header.Set(name, value)
+			}
+			var calls int
+			upstream := map[string]string{"Content-Type": tt.contentType}
+			for name, value := range tt.upstream {
+				upstream[name] = value
+			}
+			rr := serveRequest(t, &m, req, countingUpstream(&calls, upstream, []byte(doc)))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripHeadersCase(t *testing.T) {
+	m := &ResponseFilter{StripHeaders: []string{"x-original-size"}}
+	provision(t, m)
+	var calls int
+	next := countingUpstream(&calls, map[string]string{"X-Original-Size": "13"}, []byte(`{"a":1,"b":2}`))
+	rr := serve(t, m, "/?jsonpath_filter=$.a", next)
+	if got := rr.Header().Get("X-Original-Size"); got != "" {
+		t.Errorf("X-Original-Size = %q, want it stripped", got)
+	}
+}
+
+func TestBodyHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"filtered", "/?jsonpath_filter=$.a", "1"},
+		{"unfiltered", "/", `{"a":1,"b":2}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			var calls int
+			next := countingUpstream(&calls, map[string]string{"Content-Length": "999", "ETag": `"v1"`, "Content-MD5": "x"}, []byte(`{"a":1,"b":2}`))
+			rr := serve(t, m, tt.target, next)
+			if got := rr.Body.String(); got != tt.want {
+				t.Fatalf("body = %q, want %q", got, tt.want)
+			}
+			if tt.target == "/" {
+				return
+			}
+			if got, want := rr.Header().Get("Content-Length"), strconv.Itoa(len(tt.want)); got != want {
+				t.Errorf("Content-Length = %q, want %q", got, want)
+			}
+			for _, name := range []string{"ETag", "Content-MD5"} {
+				if got := rr.Header().Get(name); got != "" {
+					t.Errorf("%s = %q, want it removed", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestExpressionSource(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	tests := []struct {
+		name   string
+		target string
+		header string
+		want   string
+	}{
+		{"header only", "/", "$.b", "2"},
+		{"query only", "/?jsonpath_filter=$.a", "", "1"},
+		{"both", "/?jsonpath_filter=$.a", "$.b", "1"},
+		{"empty query", "/?jsonpath_filter=", "$.b", "2"},
+		{"neither", "/", "", doc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Header: "X-JSONPath"}
+			provision(t, m)
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set("X-JSONPath", tt.header)
+			}
+			rr := serveRequest(t, m, req, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllow(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	tests := []struct {
+		name   string
+		allow  []string
+		target string
+		status int
+		want   string
+	}{
+		{"allowed", []string{"$.a"}, "/?jsonpath_filter=$.a", http.StatusOK, "1"},
+		{"disallowed", []string{"$.a"}, "/?jsonpath_filter=$.b", http.StatusForbidden, ""},
+		{"empty allow list", nil, "/?jsonpath_filter=$.b", http.StatusOK, "2"},
+		{"default expression", []string{"$.a"}, "/", http.StatusOK, "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Allow: tt.allow, DefaultExpression: "$.b"}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.want != "" && rr.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowPrefix(t *testing.T) {
+	const doc = `{"public":{"items":[{"name":"x"}],"name":"p"},"publicity":1,"secret":2}`
+	tests := []struct {
+		name   string
+		expr   string
+		status int
+		want   string
+	}{
+		{"prefix", "$.public.name", http.StatusOK, `"p"`},
+		{"whole prefix", "$.public.items", http.StatusOK, `[{"name":"x"}]`},
+		{"index", "$.public.items[0].name", http.StatusOK, `"x"`},
+		{"bracket notation", `$["public"].name`, http.StatusOK, `"p"`},
+		{"recursive descent", "$.public.items..name", http.StatusOK, `["x"]`},
+		{"filter", `$.public.items[?(@.name == "x")].name`, http.StatusOK, `["x"]`},
+		{"exact allow", "$.secret", http.StatusOK, "2"},
+		{"disallowed", "$.publicity", http.StatusForbidden, ""},
+		{"near miss", "$.publi", http.StatusForbidden, ""},
+		{"recursive near miss", "$..public", http.StatusForbidden, ""},
+		{"root", "$", http.StatusForbidden, ""},
+		{"filter on root", "$.public.items[?(@.name == $.secret)]", http.StatusForbidden, ""},
+		{"union", `$["public","secret"]`, http.StatusForbidden, ""},
+		{"malformed", "$.public[", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Allow: []string{"$.secret"}, AllowPrefix: []string{"$.public"}}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter="+url.QueryEscape(tt.expr), respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.want != "" && rr.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMulti(t *testing.T) {
+	const doc = `{"a":1,"b":{"c":2}}`
+	tests := []struct {
+		multi  string
+		target string
+		want   string
+	}{
+		{"", "/?jsonpath_filter=$.a&jsonpath_filter=$.b.c", `{"$.a":1,"$.b.c":2}`},
+		{"object", "/?jsonpath_filter=$.b.c&jsonpath_filter=$.a", `{"$.a":1,"$.b.c":2}`},
+		{"array", "/?jsonpath_filter=$.b.c&jsonpath_filter=$.a", `[2,1]`},
+		{"array", "/?jsonpath_filter=$.a", `1`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.multi+tt.target, func(t *testing.T) {
+			m := &ResponseFilter{Multi: tt.multi}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartialResults(t *testing.T) {
+	const doc = `{"a":1,"b":{"c":2}}`
+	tests := []struct {
+		name    string
+		m       ResponseFilter
+		target  string
+		status  int
+		results map[string]interface{}
+		codes   map[string]string
+	}{
+		{"object", ResponseFilter{PartialResults: true}, "/?jsonpath_filter=$.a&jsonpath_filter=$[", http.StatusOK,
+			map[string]interface{}{"$.a": 1.0}, map[string]string{"$[": codeInvalidExpression}},
+		{"array", ResponseFilter{PartialResults: true, Multi: "array"}, "/?jsonpath_filter=$[&jsonpath_filter=$.b.c", http.StatusOK,
+			map[string]interface{}{"1": 2.0}, map[string]string{"0": codeInvalidExpression}},
+		{"no match", ResponseFilter{PartialResults: true}, "/?jsonpath_filter=$.missing&jsonpath_filter=$[", http.StatusOK,
+			map[string]interface{}{"$.missing": nil}, map[string]string{"$[": codeInvalidExpression}},
+		{"evaluation error", ResponseFilter{PartialResults: true, Engine: "jq"}, "/?jsonpath_filter=.a&jsonpath_filter=" + url.QueryEscape(`error("boom")`), http.StatusOK,
+			map[string]interface{}{".a": 1.0}, map[string]string{`error("boom")`: codeEvaluationError}},
+		{"all failing", ResponseFilter{PartialResults: true}, "/?jsonpath_filter=$[&jsonpath_filter=$.b[", http.StatusUnprocessableEntity, nil, nil},
+		{"single expression", ResponseFilter{PartialResults: true}, "/?jsonpath_filter=$[", http.StatusUnprocessableEntity, nil, nil},
+		{"disabled", ResponseFilter{}, "/?jsonpath_filter=$.a&jsonpath_filter=$[", http.StatusUnprocessableEntity, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var decoded interface{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &decoded); err != nil {
+				t.Fatalf("decoding %s: %v", rr.Body, err)
+			}
+			got := map[string]interface{}{}
+			switch v := decoded.(type) {
+			case map[string]interface{}:
+				got = v
+			case []interface{}:
+				for i, elem := range v {
+					got[strconv.Itoa(i)] = elem
+				}
+			}
+			if len(got) != len(tt.results)+len(tt.codes) {
+				t.Errorf("body = %s, want %d results", rr.Body, len(tt.results)+len(tt.codes))
+			}
+			for key, want := range tt.results {
+				if got[key] != want {
+					t.Errorf("result %s = %v, want %v", key, got[key], want)
+				}
+			}
+			for key, code := range tt.codes {
+				failure, _ := got[key].(map[string]interface{})
+				if msg, _ := failure["error"].(string); msg == "" || failure["code"] != code {
+					t.Errorf("result %s = %v, want a %s error", key, got[key], code)
+				}
+			}
+		})
+	}
+}
+
+func TestPretty(t *testing.T) {
+	const doc = `{"a":{"b":1,"c":[2]}}`
+	tests := []struct {
+		name   string
+		pretty bool
+		target string
+		want   string
+	}{
+		{"compact", false, "/?jsonpath_filter=$.a", `{"b":1,"c":[2]}`},
+		{"configured", true, "/?jsonpath_filter=$.a", "{\n  \"b\": 1,\n  \"c\": [\n    2\n  ]\n}"},
+		{"flag", false, "/?jsonpath_filter=$.a&pretty=true", "{\n  \"b\": 1,\n  \"c\": [\n    2\n  ]\n}"},
+		{"pass through", true, "/", doc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Pretty: tt.pretty}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyStatus(t *testing.T) {
+	const doc = `{"a":[],"b":null,"c":[1]}`
+	tests := []struct {
+		name   string
+		expr   string
+		status int
+		want   string
+	}{
+		{"empty array", "$.a", http.StatusNotFound, "[]"},
+		{"no match", "$.missing", http.StatusNotFound, "null"},
+		{"null value", "$.b", http.StatusOK, "null"},
+		{"match", "$.c", http.StatusOK, "[1]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{EmptyStatus: http.StatusNotFound}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter="+tt.expr, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogging(t *testing.T) {
+	tests := []struct {
+		name        string
+		engine      string
+		target      string
+		contentType string
+		message     string
+		fields      map[string]interface{}
+	}{
+		{"filtered", "", "/?jsonpath_filter=$.a", "application/json", "response filtered", map[string]interface{}{
+			"expressions":  []interface{}{"$.a"},
+			"content_type": "application/json",
+			"applied":      true,
+			"size":         int64(1),
+		}},
+		{"passed through", "", "/?jsonpath_filter=$.a", "text/plain", "response passed through", map[string]interface{}{
+			"uri":          "/?jsonpath_filter=$.a",
+			"content_type": "text/plain",
+			"applied":      false,
+			"reason":       "non-json",
+		}},
+		{"error", "jq", `/?jsonpath_filter=error("boom")`, "application/json", "JSONPath error", map[string]interface{}{
+			"expressions": []interface{}{`error("boom")`},
+			"error":       "error: boom",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Engine: tt.engine}
+			provision(t, m)
+			core, logs := observer.New(zapcore.DebugLevel)
+			m.logger = zap.New(core)
+			serve(t, m, tt.target, respond(http.StatusOK, tt.contentType, `{"a":1}`))
+			entries := logs.FilterMessage(tt.message).All()
+			if len(entries) != 1 {
+				t.Fatalf("logged %d %q entries, want 1; all: %v", len(entries), tt.message, logs.All())
+			}
+			fields := entries[0].ContextMap()
+			for key, want := range tt.fields {
+				if got := fields[key]; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %#v, want %#v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPaths(t *testing.T) {
+	const doc = `{"a":1}`
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"included", "/api/items", "1"},
+		{"wildcard", "/v2/deep/nested/items", "1"},
+		{"single character", "/v3/items", "1"},
+		{"not included", "/static/items", doc},
+		{"excluded", "/api/raw", doc},
+		{"excluded by wildcard", "/v2/raw/items", doc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{
+				OnlyPaths:   []string{"/api/*", "/v2/*", "/v?/items"},
+				ExceptPaths: []string{"/api/raw", "*/raw/*"},
+			}
+			provision(t, m)
+			rr := serve(t, m, tt.path+"?jsonpath_filter=$.a", respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		status int
+	}{
+		{"head", http.MethodHead, http.StatusOK},
+		{"no content", http.MethodGet, http.StatusNoContent},
+		{"not modified", http.MethodGet, http.StatusNotModified},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				return nil
+			})
+			req := httptest.NewRequest(tt.method, "/?jsonpath_filter=$.a", nil)
+			rr := serveRequest(t, m, req, next)
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if rr.Body.Len() != 0 {
+				t.Errorf("body = %q, want none", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	negative, tooPrecise := -1, maxRound+1
+	tests := []struct {
+		name string
+		m    ResponseFilter
+		err  string
+	}{
+		{"valid", ResponseFilter{}, ""},
+		{"blank query param", ResponseFilter{QueryParam: " "}, "query_param must not be blank"},
+		{"empty content type", ResponseFilter{ContentTypes: []string{"application/json", " "}}, "content_types must not contain empty entries"},
+		{"empty suffix", ResponseFilter{ContentTypes: []string{"+"}}, "content_types must not contain empty entries"},
+		{"empty status", ResponseFilter{EmptyStatus: 42}, "invalid empty_status 42"},
+		{"error format", ResponseFilter{ErrorFormat: "xml"}, `unrecognized error_format "xml"`},
+		{"multi", ResponseFilter{Multi: "map"}, `unrecognized multi mode "map"`},
+		{"negative max body size", ResponseFilter{MaxBodySize: -1}, "max_body_size must not be negative"},
+		{"reject without max body size", ResponseFilter{RejectLargeBody: true}, "reject_large_body requires max_body_size"},
+		{"only and except path", ResponseFilter{OnlyPaths: []string{"/a/*"}, ExceptPaths: []string{"/a/*"}}, `path pattern "/a/*" is both in only_paths and except_paths`},
+		{"allow expression", ResponseFilter{Allow: []string{"$["}}, `invalid allow expression "$["`},
+		{"default expression", ResponseFilter{DefaultExpression: "$["}, `invalid default_expression "$["`},
+		{"engine", ResponseFilter{Engine: "jmespath"}, `unrecognized engine "jmespath"`},
+		{"when", ResponseFilter{When: "$["}, `invalid when "$["`},
+		{"include paths with jq", ResponseFilter{IncludePaths: true, Engine: "jq"}, "include_paths requires the jsonpath engine"},
+		{"status pattern", ResponseFilter{StatusExpressions: map[string]string{"2x": "$.a"}}, `invalid status "2x" in status_expressions`},
+		{"status expression", ResponseFilter{StatusExpressions: map[string]string{"200": "$["}}, `invalid expression "$[" for status 200`},
+		{"format", ResponseFilter{Format: "xml"}, `unrecognized format "xml"`},
+		{"compress min length", ResponseFilter{CompressMinLength: -1}, "compress_min_length must not be negative"},
+		{"require response header", ResponseFilter{RequireResponseHeader: map[string]string{" ": "x"}}, "require_response_header names must not be blank"},
+		{"filter param", ResponseFilter{Filters: map[string]string{"a": "$.a"}, FilterParam: "jsonpath_filter"}, "filter_param must differ from query_param"},
+		{"filter name", ResponseFilter{Filters: map[string]string{"": "$.a"}}, "filter names must not be empty"},
+		{"filter expression", ResponseFilter{Filters: map[string]string{"a": "$["}}, `invalid expression "$[" for filter a`},
+		{"max depth", ResponseFilter{MaxDepth: -1}, "max_depth must not be negative"},
+		{"tenant header", ResponseFilter{TenantAllow: map[string][]string{"acme": {"$.a"}}}, "tenant_allow requires tenant_header"},
+		{"tenant expression", ResponseFilter{TenantHeader: "X-Tenant", TenantAllow: map[string][]string{"acme": {"$["}}}, `invalid allow expression "$[" for tenant acme`},
+		{"max matches", ResponseFilter{MaxMatches: -1}, "max_matches must not be negative"},
+		{"reject without max matches", ResponseFilter{RejectExcessMatches: true}, "reject_excess_matches requires max_matches"},
+		{"ndjson output", ResponseFilter{NDJSONOutput: "json"}, `unrecognized ndjson_output "json"`},
+		{"min body size", ResponseFilter{MinBodySize: -1}, "min_body_size must not be negative"},
+		{"min above max body size", ResponseFilter{MinBodySize: 2, MaxBodySize: 1}, "min_body_size must not exceed max_body_size"},
+		{"expression prefix", ResponseFilter{ExpressionPrefix: "$["}, `invalid expression_prefix "$["`},
+		{"expression prefix with jq", ResponseFilter{ExpressionPrefix: ".data", Engine: "jq"}, "expression_prefix requires the jsonpath engine"},
+		{"enable header value", ResponseFilter{EnableHeaderValue: "on"}, "enable_header_value requires enable_header"},
+		{"negative round", ResponseFilter{Round: &negative}, "round must be between 0 and 17"},
+		{"round beyond float64", ResponseFilter{Round: &tooPrecise}, "round must be between 0 and 17"},
+		{"allow prefix", ResponseFilter{AllowPrefix: []string{"$["}}, `invalid allow_prefix "$["`},
+		{"allow prefix filter", ResponseFilter{AllowPrefix: []string{"$.a[?(@.b)]"}}, `allow_prefix "$.a[?(@.b)]" must not have filters`},
+		{"allow prefix with jq", ResponseFilter{AllowPrefix: []string{".a"}, Engine: "jq"}, "allow_prefix requires the jsonpath engine"},
+		{"array envelope with envelope", ResponseFilter{ArrayEnvelope: new(ArrayEnvelope), Envelope: new(Envelope)}, "array_envelope cannot be combined with envelope"},
+		{"array envelope keys", ResponseFilter{ArrayEnvelope: &ArrayEnvelope{DataKey: "total"}}, "array_envelope data and total keys must differ"},
+		{"filter placeholder", ResponseFilter{FilterPlaceholder: "{http.request.uri.path.3}"}, "filter_placeholder requires filters"},
+		{"then param", ResponseFilter{ThenParam: "jsonpath_filter"}, "then_param must differ from query_param"},
+		{"null to empty array", ResponseFilter{NullToEmptyArray: "never"}, `unrecognized null_to_empty_array mode "never"`},
+		{"first and last", ResponseFilter{First: true, Last: true}, "first and last are mutually exclusive"},
+		{"bypass param value", ResponseFilter{BypassParamValue: "true"}, "bypass_param_value requires bypass_param"},
+		{"bypass param", ResponseFilter{BypassParam: "jsonpath_filter"}, "bypass_param must differ from query_param"},
+		{"group by", ResponseFilter{GroupBy: new(GroupBy)}, "group_by requires a field"},
+		{"filter argument index", ResponseFilter{Filters: map[string]string{"x": `$.items[?(@.a == "{100}")]`}}, "filter x: invalid placeholder {100}"},
+		{"schema pass-through", ResponseFilter{SchemaPassThrough: true}, "schema_pass_through requires validate_schema"},
+		{"canonical with preserve order", ResponseFilter{Canonical: true, PreserveOrder: true}, "canonical cannot be combined with preserve_order"},
+		{"filter arg param", ResponseFilter{Filters: map[string]string{"x": "$.a"}, FilterArgParam: "filter"}, "filter_arg_param must differ from query_param and filter_param"},
+		{"set headers pass through", ResponseFilter{SetHeadersPassThrough: true}, "set_headers_pass_through requires set_headers"},
+		{"set headers empty name", ResponseFilter{SetHeaders: map[string]string{" ": "x"}}, "set_headers: empty header name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			if err := m.Provision(ctx); err != nil {
+				t.Fatalf("Provision: %v", err)
+			}
+			defer m.Cleanup()
+			err := m.Validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)):
+				t.Errorf("Validate = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestStreamUnfilterable(t *testing.T) {
+	chunk := strings.Repeat("x", 32<<10)
+	tests := []struct {
+		name        string
+		contentType string
+		streamed    bool
+	}{
+		{"html", "text/html", true},
+		{"binary", "application/octet-stream", true},
+		{"json", "application/json", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			rr := httptest.NewRecorder()
+			var streamed bool
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", tt.contentType)
+				for i := 0; i < 4; i++ {
+					if _, err := io.WriteString(w, chunk); err != nil {
+						return err
+					}
+					if i == 0 {
+						// Written through, rather than buffered to the end
+						streamed = rr.Body.Len() > 0
+					}
+				}
+				return nil
+			})
+			req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.a", nil)
+			if err := m.ServeHTTP(rr, req, next); err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			if streamed != tt.streamed {
+				t.Errorf("streamed = %t, want %t", streamed, tt.streamed)
+			}
+			if tt.streamed && rr.Body.Len() != 4*len(chunk) {
+				t.Errorf("body is %d bytes, want %d", rr.Body.Len(), 4*len(chunk))
+			}
+		})
+	}
+}
+
+func TestRoot(t *testing.T) {
+	const doc = `{"meta":{"page":1},"data":{"items":[{"id":1},{"id":2}],"count":2}}`
+	tests := []struct {
+		name   string
+		root   string
+		target string
+		want   string
+	}{
+		{"relative", "$.data", "/?jsonpath_filter=$.count", "2"},
+		{"nested", "$.data.items", "/?jsonpath_filter=$[1].id", "2"},
+		{"outside root", "$.data", "/?jsonpath_filter=$.meta", "null"},
+		{"missing root", "$.payload", "/?jsonpath_filter=$.count", "null"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Root: tt.root}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireAcceptJSON(t *testing.T) {
+	const doc = `{"a":1}`
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"application/json", "1"},
+		{"text/html", doc},
+		{"*/*", "1"},
+		{"", "1"},
+		{"text/html, application/json;q=0", doc},
+		{"application/*", "1"},
+		{"text/html, application/hal+json", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			m := &ResponseFilter{RequireAcceptJSON: true}
+			provision(t, m)
+			req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.a", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rr := serveRequest(t, m, req, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDebugHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		status      int
+		want        string
+	}{
+		{"applied", http.MethodGet, "/?jsonpath_filter=$.a", "application/json", http.StatusOK, "applied"},
+		{"no expression", http.MethodGet, "/", "application/json", http.StatusOK, "skipped; no-expression"},
+		{"non-json", http.MethodGet, "/?jsonpath_filter=$.a", "text/html", http.StatusOK, "skipped; non-json"},
+		{"head", http.MethodHead, "/?jsonpath_filter=$.a", "application/json", http.StatusOK, "skipped; head"},
+		{"no body", http.MethodGet, "/?jsonpath_filter=$.a", "application/json", http.StatusNoContent, "skipped; no-body"},
+		{"error", http.MethodGet, "/?jsonpath_filter=$[", "application/json", http.StatusOK, "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, enabled := range []bool{true, false} {
+				m := &ResponseFilter{DebugHeader: enabled}
+				provision(t, m)
+				req := httptest.NewRequest(tt.method, tt.target, nil)
+				next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+					w.Header().Set("Content-Type", tt.contentType)
+					w.WriteHeader(tt.status)
+					if tt.status == http.StatusNoContent || r.Method == http.MethodHead {
+						return nil
+					}
+					_, err := io.WriteString(w, `{"a":1}`)
+					return err
+				})
+				rr := serveRequest(t, m, req, next)
+				want := tt.want
+				if !enabled {
+					want = ""
+				}
+				if got := rr.Header().Get(debugHeader); got != want {
+					t.Errorf("debug_header %t: %s = %q, want %q", enabled, debugHeader, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestJQ(t *testing.T) {
+	const doc = `{"user":{"first":"Ann","last":"Lee","roles":[{"name":"admin"},{"name":"dev"}]},"n":[1,2,3]}`
+	tests := []struct {
+		name   string
+		expr   string
+		status int
+		want   string
+	}{
+		{"reshape", `.user | {name: (.first + " " + .last), roles: [.roles[].name]}`, http.StatusOK, `{"name":"Ann Lee","roles":["admin","dev"]}`},
+		{"arithmetic", `.n | add`, http.StatusOK, "6"},
+		{"several outputs", `.n[]`, http.StatusOK, "[1,2,3]"},
+		{"no output", `empty`, http.StatusOK, "null"},
+		{"syntax error", `.user |`, http.StatusUnprocessableEntity, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Engine: "jq"}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter="+url.QueryEscape(tt.expr), respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhen(t *testing.T) {
+	const list = `{"type":"list","items":[{"id":1},{"id":2}],"count":0}`
+	const failure = `{"type":"error","message":"boom","items":[]}`
+	tests := []struct {
+		name string
+		when string
+		doc  string
+		want string
+	}{
+		{"comparison matches", `$.type == "list"`, list, `[{"id":1},{"id":2}]`},
+		{"comparison fails", `$.type == "list"`, failure, failure},
+		{"filter matches", `$.items[?(@.id == 2)]`, list, `[{"id":1},{"id":2}]`},
+		{"filter empty", `$.items[?(@.id == 3)]`, list, list},
+		{"empty array", `$.items`, failure, failure},
+		{"zero", `$.count`, list, list},
+		{"missing key", `$.missing`, list, list},
+		{"string", `$.type`, list, `[{"id":1},{"id":2}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{When: tt.when}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter=$.items", respond(http.StatusOK, "application/json", tt.doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStrictContentType(t *testing.T) {
+	const page = `<html><body>hello</body></html>`
+	tests := []struct {
+		name           string
+		strict         bool
+		target         string
+		status         int
+		upstreamStatus int
+		want           string
+	}{
+		{"lenient", false, "/?jsonpath_filter=$.a", http.StatusOK, http.StatusOK, page},
+		{"strict", true, "/?jsonpath_filter=$.a", http.StatusNotAcceptable, http.StatusOK, ""},
+		{"strict without expression", true, "/", http.StatusOK, http.StatusOK, page},
+		{"strict error status", true, "/?jsonpath_filter=$.a", http.StatusBadGateway, http.StatusBadGateway, page},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{StrictContentType: tt.strict}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(tt.upstreamStatus, "text/html", page))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+			if tt.status == http.StatusNotAcceptable && !strings.Contains(rr.Body.String(), "text/html") {
+				t.Errorf("body = %s, want it to name the content type", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestMethods(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	tests := []struct {
+		name    string
+		methods []string
+		method  string
+		want    string
+	}{
+		{"get filtered", []string{"GET"}, http.MethodGet, "1"},
+		{"post untouched", []string{"GET"}, http.MethodPost, doc},
+		{"lower case", []string{" get ", "put"}, http.MethodPut, "1"},
+		{"default post", nil, http.MethodPost, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Methods: tt.methods}
+			provision(t, m)
+			req := httptest.NewRequest(tt.method, "/?jsonpath_filter=$.a", nil)
+			rr := serveRequest(t, m, req, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvExpressions(t *testing.T) {
+	t.Setenv("JSONPATH_FILTER_TENANT", "acme")
+	const doc = `{"tenants":[{"id":"acme","n":1},{"id":"globex","n":2}],"acme":3}`
+	tenant := `$.tenants[?(@.id == "{env.JSONPATH_FILTER_TENANT}")].n`
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		target string
+		status int
+		want   string
+	}{
+		{"default expression", ResponseFilter{DefaultExpression: tenant}, "/", http.StatusOK, "[1]"},
+		{"member name", ResponseFilter{DefaultExpression: "$.{env.JSONPATH_FILTER_TENANT}"}, "/", http.StatusOK, "3"},
+		{"named filter", ResponseFilter{Filters: map[string]string{"mine": tenant}}, "/?filter=mine", http.StatusOK, "[1]"},
+		{"allow", ResponseFilter{Allow: []string{"$.{env.JSONPATH_FILTER_TENANT}"}}, "/?jsonpath_filter=$.acme", http.StatusOK, "3"},
+		{"unset variable", ResponseFilter{DefaultExpression: `$.tenants[?(@.id == "{env.JSONPATH_FILTER_UNSET}")].n`}, "/", http.StatusOK, "[]"},
+		{"client expression", ResponseFilter{}, "/?jsonpath_filter=" + url.QueryEscape(tenant), http.StatusOK, "[]"},
+		{"jq object", ResponseFilter{Engine: "jq", DefaultExpression: "{n: .acme}"}, "/", http.StatusOK, `{"n":3}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaceholderExpression(t *testing.T) {
+	const doc = `{"a":1,"b":{"c":2},"t":{"acme":3}}`
+	tests := []struct {
+		name       string
+		expression string
+		target     string
+		header     string
+		want       string
+	}{
+		{"query placeholder", "{http.request.uri.query.q}", "/?q=$.b.c", "", "2"},
+		{"header placeholder", "$.t.{http.request.header.X-Tenant}", "/", "acme", "3"},
+		{"query parameter first", "{http.request.uri.query.q}", "/?q=$.b.c&jsonpath_filter=$.a", "", "1"},
+		{"empty expansion", "{http.request.uri.query.q}", "/", "", doc},
+		{"no placeholders", "$.a", "/", "", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Expression: tt.expression}
+			provision(t, m)
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set("X-Tenant", tt.header)
+			}
+			rr := httptest.NewRecorder()
+			req = caddyhttp.PrepareRequest(req, caddy.NewReplacer(), rr, nil)
+			if err := m.ServeHTTP(rr, req, respond(http.StatusOK, "application/json", doc)); err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusExpressions(t *testing.T) {
+	const ok = `{"data":{"id":1},"error":null}`
+	const failure = `{"data":null,"error":{"message":"boom"}}`
+	exprs := map[string]string{"2xx": "$.data", "5xx": "$.error.message", "503": "$.error"}
+	tests := []struct {
+		name   string
+		lock   bool
+		target string
+		status int
+		doc    string
+		want   string
+	}{
+		{"success", false, "/", http.StatusOK, ok, `{"id":1}`},
+		{"server error", false, "/", http.StatusInternalServerError, failure, `"boom"`},
+		{"exact code", false, "/", http.StatusServiceUnavailable, failure, `{"message":"boom"}`},
+		{"unmatched status", false, "/", http.StatusNotFound, failure, failure},
+		{"client expression", false, "/?jsonpath_filter=$.error", http.StatusOK, ok, "null"},
+		{"locked", true, "/?jsonpath_filter=$.error", http.StatusOK, ok, `{"id":1}`},
+		{"locked unmatched", true, "/?jsonpath_filter=$.error", http.StatusNotFound, failure, `{"message":"boom"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{StatusExpressions: exprs, LockStatusExpressions: tt.lock}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(tt.status, "application/json", tt.doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"zero length", http.StatusOK, ""},
+		{"whitespace", http.StatusOK, " \r\n\t "},
+		{"error status", http.StatusBadGateway, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{DebugHeader: true}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter=$.a", respond(tt.status, "application/json", tt.body))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); got != tt.body {
+				t.Errorf("body = %q, want %q", got, tt.body)
+			}
+			if got := rr.Header().Get(debugHeader); got != "skipped; empty-body" {
+				t.Errorf("%s = %q, want %q", debugHeader, got, "skipped; empty-body")
+			}
+		})
+	}
+}
+
+func TestRequireResponseHeader(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	tests := []struct {
+		name     string
+		required map[string]string
+		hdr      map[string]string
+		want     string
+	}{
+		{"present", map[string]string{"X-App": "catalog"}, map[string]string{"X-App": "catalog"}, "1"},
+		{"absent", map[string]string{"X-App": "catalog"}, nil, doc},
+		{"other value", map[string]string{"X-App": "catalog"}, map[string]string{"X-App": "billing"}, doc},
+		{"any value", map[string]string{"x-app": ""}, map[string]string{"X-App": "billing"}, "1"},
+		{"all required", map[string]string{"X-App": "catalog", "X-Version": "2"}, map[string]string{"X-App": "catalog"}, doc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{RequireResponseHeader: tt.required}
+			provision(t, m)
+			var calls int
+			rr := serve(t, m, "/?jsonpath_filter=$.a", countingUpstream(&calls, tt.hdr, []byte(doc)))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnableHeader(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	tests := []struct {
+		name   string
+		value  string
+		header []string
+		want   string
+	}{
+		{"present", "", []string{"1"}, "1"},
+		{"absent", "", nil, doc},
+		{"empty value", "", []string{""}, "1"},
+		{"value match", "on", []string{"on"}, "1"},
+		{"value mismatch", "on", []string{"off"}, doc},
+		{"value absent", "on", nil, doc},
+		{"value among several", "on", []string{"off", "on"}, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{EnableHeader: "X-Canary", EnableHeaderValue: tt.value}
+			provision(t, m)
+			req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.a", nil)
+			for _, value := range tt.header {
+				req.Header.Add("X-Canary", value)
+			}
+			rr := serveRequest(t, m, req, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBypassParam(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	tests := []struct {
+		name   string
+		value  string
+		target string
+		want   string
+	}{
+		{"present", "", "/?expand=true", doc},
+		{"present without value", "", "/?expand", doc},
+		{"absent", "", "/", "1"},
+		{"value match", "true", "/?expand=true", doc},
+		{"value mismatch", "true", "/?expand=false", "1"},
+		{"value among several", "true", "/?expand=false&expand=true", doc},
+		{"client expression", "", "/?expand=true&jsonpath_filter=$.b", doc},
+		{"client expression without bypass", "", "/?jsonpath_filter=$.b", "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{BypassParam: "expand", BypassParamValue: tt.value, DefaultExpression: "$.a"}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	const doc = `{"a":1,"b":2}`
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		target string
+		header map[string]string
+		cc     string
+		vary   string
+	}{
+		{"filtered", ResponseFilter{CacheControl: "public, max-age=60"}, "/?jsonpath_filter=$.a", nil, "public, max-age=60", "Accept-Encoding"},
+		{"expression header", ResponseFilter{CacheControl: "public, max-age=60", Header: "X-Jsonpath"}, "/", map[string]string{"X-Jsonpath": "$.a"}, "public, max-age=60", "Accept-Encoding, X-Jsonpath"},
+		{"tenant header", ResponseFilter{CacheControl: "private", TenantHeader: "X-Tenant"}, "/?jsonpath_filter=$.a", map[string]string{"X-Tenant": "acme"}, "private", "Accept-Encoding, X-Tenant"},
+		{"streamed", ResponseFilter{CacheControl: "public, max-age=60", Stream: true}, "/?jsonpath_filter=$.*", nil, "public, max-age=60", "Accept-Encoding"},
+		{"pass-through", ResponseFilter{CacheControl: "public, max-age=60"}, "/", nil, "no-cache", "Accept-Encoding"},
+		{"pass-through configured", ResponseFilter{CacheControl: "public, max-age=60", CacheControlPassThrough: true, Header: "X-Jsonpath"}, "/", nil, "public, max-age=60", "Accept-Encoding, X-Jsonpath"},
+		{"disabled", ResponseFilter{}, "/?jsonpath_filter=$.a", nil, "no-cache", "Accept-Encoding"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+			var calls int
+			upstream := map[string]string{"Cache-Control": "no-cache", "Vary": "Accept-Encoding"}
+			rr := serveRequest(t, &m, req, countingUpstream(&calls, upstream, []byte(doc)))
+			if got := rr.Header().Get("Cache-Control"); got != tt.cc {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.cc)
+			}
+			if got := strings.Join(rr.Header().Values("Vary"), ", "); got != tt.vary {
+				t.Errorf("Vary = %q, want %q", got, tt.vary)
+			}
+		})
+	}
+}
+
+func TestStripControlParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		target string
+		query  string
+		want   string
+	}{
+		{"expression", ResponseFilter{StripControlParams: true}, "/?jsonpath_filter=$.a&page=2", "page=2", "1"},
+		{"order and encoding kept", ResponseFilter{StripControlParams: true}, "/?q=a%20b&pretty=true&z=1&x=%26", "q=a%20b&z=1&x=%26", ""},
+		{"flags", ResponseFilter{StripControlParams: true}, "/?raw=true&format=json&count=false&explain=0&first=0&last=0&distinct=0&keys_only=0&values_only=0", "", ""},
+		{"encoded name", ResponseFilter{StripControlParams: true}, "/?jsonpath%5Ffilter=$.a", "", "1"},
+		{"custom parameters", ResponseFilter{StripControlParams: true, QueryParam: "q", FieldsParam: "fields", SortParam: "sort"}, "/?q=$.a&fields=a&sort=a&jsonpath_filter=x", "jsonpath_filter=x", "1"},
+		{"pagination", ResponseFilter{StripControlParams: true, Paginate: true}, "/?offset=1&limit=2&page=3", "page=3", ""},
+		{"pagination disabled", ResponseFilter{StripControlParams: true}, "/?offset=1&limit=2", "offset=1&limit=2", ""},
+		{"named filters", ResponseFilter{StripControlParams: true, Filters: map[string]string{"member": `$["{0}"]`}}, "/?filter=member&arg=a&id=1", "id=1", "1"},
+		{"filters disabled", ResponseFilter{StripControlParams: true}, "/?filter=a&arg=x", "filter=a&arg=x", ""},
+		{"no query", ResponseFilter{StripControlParams: true}, "/", "", ""},
+		{"disabled", ResponseFilter{}, "/?jsonpath_filter=$.a&page=2", "jsonpath_filter=$.a&page=2", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			var query, uri string
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				query, uri = r.URL.RawQuery, r.RequestURI
+				w.Header().Set("Content-Type", "application/json")
+				_, err := w.Write([]byte(`{"a":1}`))
+				return err
+			})
+			rr := serve(t, &m, tt.target, next)
+			if query != tt.query {
+				t.Errorf("upstream query = %q, want %q", query, tt.query)
+			}
+			if want := (&url.URL{Path: "/", RawQuery: tt.query}).RequestURI(); uri != want {
+				t.Errorf("upstream RequestURI = %q, want %q", uri, want)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamedFilters(t *testing.T) {
+	const doc = `{"id":1,"name":"a","details":{"x":2}}`
+	filters := map[string]string{"summary": "$.name", "details": "$.details"}
+	tests := []struct {
+		name   string
+		strict bool
+		target string
+		status int
+		want   string
+	}{
+		{"known name", false, "/?filter=summary", http.StatusOK, `"a"`},
+		{"other name", false, "/?filter=details", http.StatusOK, `{"x":2}`},
+		{"expression first", false, "/?filter=summary&jsonpath_filter=$.id", http.StatusOK, "1"},
+		{"unknown name", false, "/?filter=full", http.StatusOK, doc},
+		{"unknown name strict", true, "/?filter=full", http.StatusBadRequest, ""},
+		{"missing param", true, "/", http.StatusOK, doc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Filters: filters, StrictFilterParam: tt.strict}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterArgs(t *testing.T) {
+	const doc = `{"items":[{"id":1,"category":"books"},{"id":2,"category":"games"},{"id":3,"category":"say \"hi\""}]}`
+	filters := map[string]string{
+		"byCategory": `$.items[?(@.category == "{0}")].id`,
+		"member":     `$.items[?(@.category == "{0}")]["{1}"]`,
+		"all":        "$.items[*].id",
+	}
+	tests := []struct {
+		name     string
+		argParam string
+		target   string
+		status   int
+		want     string
+	}{
+		{"string argument", "", "/?filter=byCategory&arg=books", http.StatusOK, "[1]"},
+		{"two arguments", "", "/?filter=member&arg=games&arg=category", http.StatusOK, `["games"]`},
+		{"quoted argument", "", "/?filter=byCategory&arg=" + url.QueryEscape(`say "hi"`), http.StatusOK, "[3]"},
+		{"injection", "", "/?filter=byCategory&arg=" + url.QueryEscape(`books"`), http.StatusOK, "[]"},
+		{"backslash", "", "/?filter=byCategory&arg=" + url.QueryEscape(`books\`), http.StatusOK, "[]"},
+		{"missing argument", "", "/?filter=byCategory", http.StatusBadRequest, ""},
+		{"too few arguments", "", "/?filter=member&arg=books", http.StatusBadRequest, ""},
+		{"too many arguments", "", "/?filter=all&arg=books", http.StatusBadRequest, ""},
+		{"custom parameter", "category", "/?filter=byCategory&category=games", http.StatusOK, "[2]"},
+		{"expression first", "", "/?filter=byCategory&jsonpath_filter=$.items[0].id", http.StatusOK, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Filters: filters, FilterArgParam: tt.argParam}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFiltersFile(t *testing.T) {
+	const doc = `{"id":1,"name":"a","details":{"x":2}}`
+	dir := t.TempDir()
+	file := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	valid := file("filters.json", `{"summary":"$.name","details":"$.details"}`)
+
+	m := &ResponseFilter{FiltersFile: valid, Filters: map[string]string{"summary": "$.id"}}
+	provision(t, m)
+	for _, tt := range []struct {
+		target string
+		want   string
+	}{
+		{"/?filter=details", `{"x":2}`},
+		{"/?filter=summary", "1"},
+		{"/?filter=full", doc},
+	} {
+		rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+		if got := rr.Body.String(); got != tt.want {
+			t.Errorf("%s: body = %s, want %s", tt.target, got, tt.want)
+		}
+	}
+
+	tests := []struct {
+		name string
+		path string
+		err  string
+	}{
+		{"missing", filepath.Join(dir, "missing.json"), "filters_file: open "},
+		{"malformed", file("malformed.json", `{"summary":`), "filters_file: parsing "},
+		{"not an object", file("array.json", `["$.name"]`), "filters_file: parsing "},
+		{"invalid expression", file("invalid.json", `{"broken":"$["}`), `invalid expression "$[" for filter broken`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			m := &ResponseFilter{FiltersFile: tt.path}
+			err := m.Provision(ctx)
+			if err == nil {
+				defer m.Cleanup()
+				err = m.Validate()
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("loading %s = %v, want %s...", tt.path, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestFilterPlaceholder(t *testing.T) {
+	const doc = `{"id":1,"name":"a","details":{"x":2}}`
+	filters := map[string]string{"summary": "$.name", "details": "$.details"}
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"path segment", "/api/catalog/view/summary", `"a"`},
+		{"other segment", "/api/catalog/view/details", `{"x":2}`},
+		{"query parameter first", "/api/catalog/view/summary?filter=details", `{"x":2}`},
+		{"unknown name", "/api/catalog/view/full", doc},
+		{"unresolved", "/api", doc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Filters: filters, FilterPlaceholder: "{http.request.uri.path.3}"}
+			provision(t, m)
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			rr := httptest.NewRecorder()
+			req = caddyhttp.PrepareRequest(req, caddy.NewReplacer(), rr, nil)
+			if err := m.ServeHTTP(rr, req, respond(http.StatusOK, "application/json", doc)); err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	events := []string{"data: {\"a\":1}\n\n", "data: {\"a\":2}\n\n"}
+	tests := []struct {
+		name        string
+		m           ResponseFilter
+		contentType string
+	}{
+		{"event stream", ResponseFilter{}, "text/event-stream"},
+		{"with charset", ResponseFilter{}, "text/event-stream; charset=utf-8"},
+		{"strict", ResponseFilter{StrictContentType: true}, "text/event-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := httptest.NewRecorder()
+			var flushed []string
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", tt.contentType)
+				for _, event := range events {
+					if _, err := io.WriteString(w, event); err != nil {
+						return err
+					}
+					if err := http.NewResponseController(w).Flush(); err != nil {
+						return err
+					}
+					flushed = append(flushed, rr.Body.String())
+				}
+				return nil
+			})
+			req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.a", nil)
+			if err := m.ServeHTTP(rr, req, next); err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			if rr.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", rr.Code, http.StatusOK)
+			}
+			for i, got := range flushed {
+				if want := strings.Join(events[:i+1], ""); got != want {
+					t.Errorf("after flush %d, client received %q, want %q", i, got, want)
+				}
+			}
+			if !rr.Flushed {
+				t.Error("response was not flushed to the client")
+			}
+		})
+	}
+}
+
+func TestTenantAllow(t *testing.T) {
+	const doc = `{"a":1,"b":2,"c":3}`
+	tenants := map[string][]string{"acme": {"$.a"}, "globex": {"$.b", "$.c"}, "none": {}}
+	tests := []struct {
+		name   string
+		deny   bool
+		tenant string
+		expr   string
+		status int
+	}{
+		{"first tenant allowed", false, "acme", "$.a", http.StatusOK},
+		{"first tenant disallowed", false, "acme", "$.b", http.StatusForbidden},
+		{"second tenant allowed", false, "globex", "$.c", http.StatusOK},
+		{"second tenant disallowed", false, "globex", "$.a", http.StatusForbidden},
+		{"empty list", false, "none", "$.a", http.StatusForbidden},
+		{"unknown tenant fallback", false, "initech", "$.c", http.StatusOK},
+		{"unknown tenant fallback disallowed", false, "initech", "$.a", http.StatusForbidden},
+		{"no tenant fallback", false, "", "$.c", http.StatusOK},
+		{"unknown tenant denied", true, "initech", "$.c", http.StatusForbidden},
+		{"known tenant with deny", true, "acme", "$.a", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{TenantHeader: "X-Tenant", TenantAllow: tenants, DenyUnknownTenants: tt.deny, Allow: []string{"$.c"}}
+			provision(t, m)
+			req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter="+tt.expr, nil)
+			if tt.tenant != "" {
+				req.Header.Set("X-Tenant", tt.tenant)
+			}
+			rr := serveRequest(t, m, req, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestWrapArray(t *testing.T) {
+	const doc = `[{"id":1,"name":"a"},{"id":2,"name":"b"}]`
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		body   string
+		expr   string
+		status int
+		want   string
+	}{
+		{"object-style expression", ResponseFilter{WrapArray: "items"}, doc, "$.items[*].name", http.StatusOK, `["a","b"]`},
+		{"custom key", ResponseFilter{WrapArray: "data"}, doc, "$.data[1].id", http.StatusOK, "2"},
+		{"object document", ResponseFilter{WrapArray: "items"}, `{"items":[1]}`, "$.items", http.StatusOK, "[1]"},
+		{"with root", ResponseFilter{WrapArray: "items", Root: "$.items"}, doc, "$[0].id", http.StatusOK, "1"},
+		{"disabled", ResponseFilter{}, doc, "$.items", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, "/?jsonpath_filter="+url.QueryEscape(tt.expr), respond(http.StatusOK, "application/json", tt.body))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		target      string
+		want        string
+	}{
+		{"filtered", "application/json", "/?jsonpath_filter=$.a", "1"},
+		{"passed through", "text/plain", "/?jsonpath_filter=$.a", `{"a":1}`},
+		{"no expression", "application/json", "/", `{"a":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Trailer", "Grpc-Status")
+				if _, err := io.WriteString(w, `{"a":1}`); err != nil {
+					return err
+				}
+				w.Header().Set("Grpc-Status", "0")
+				w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+				return nil
+			})
+			rr := serve(t, m, tt.target, next)
+			res := rr.Result()
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != tt.want {
+				t.Errorf("body = %s, want %s", body, tt.want)
+			}
+			for name, want := range map[string]string{"Grpc-Status": "0", "Grpc-Message": "ok"} {
+				if got := res.Trailer.Get(name); got != want {
+					t.Errorf("trailer %s = %q, want %q", name, got, want)
+				}
+				if got := res.Header.Get(name); got != "" {
+					t.Errorf("trailer %s sent as header %q", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMinBodySize(t *testing.T) {
+	const doc = `{"a":1,"b":2}` // 13 bytes
+	tests := []struct {
+		name          string
+		minBodySize   int64
+		contentLength bool
+		want          string
+	}{
+		{"just below", 14, false, doc},
+		{"at threshold", 13, false, "1"},
+		{"just above", 12, false, "1"},
+		{"content length below", 14, true, doc},
+		{"content length above", 12, true, "1"},
+		{"unlimited", 0, false, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{MinBodySize: tt.minBodySize}
+			provision(t, m)
+			hdr := map[string]string{}
+			if tt.contentLength {
+				hdr["Content-Length"] = strconv.Itoa(len(doc))
+			}
+			var calls int
+			rr := serve(t, m, "/?jsonpath_filter=$.a", countingUpstream(&calls, hdr, []byte(doc)))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThenParam(t *testing.T) {
+	const doc = `{"items":[{"id":1,"name":"a"},{"id":2,"name":"b"}],"o":{"x":{"y":1}},"s":"v"}`
+	tests := []struct {
+		name   string
+		param  string
+		target string
+		status int
+		want   string
+	}{
+		{"array then field", "jsonpath_filter2", "/?jsonpath_filter=$.items&jsonpath_filter2=" + url.QueryEscape("$[*].name"), http.StatusOK, `["a","b"]`},
+		{"array then filter", "jsonpath_filter2", "/?jsonpath_filter=$.items&jsonpath_filter2=" + url.QueryEscape(`$[?(@.id == 2)].name`), http.StatusOK, `["b"]`},
+		{"object then member", "jsonpath_filter2", "/?jsonpath_filter=$.o&jsonpath_filter2=$.x.y", http.StatusOK, "1"},
+		{"scalar passes through", "jsonpath_filter2", "/?jsonpath_filter=$.s&jsonpath_filter2=$.x", http.StatusOK, `"v"`},
+		{"second stage no match", "jsonpath_filter2", "/?jsonpath_filter=$.o&jsonpath_filter2=$.missing", http.StatusOK, "null"},
+		{"custom name", "then", "/?jsonpath_filter=$.o&then=$.x", http.StatusOK, `{"y":1}`},
+		{"without first stage", "jsonpath_filter2", "/?jsonpath_filter2=$.s", http.StatusOK, doc},
+		{"malformed", "jsonpath_filter2", "/?jsonpath_filter=$.o&jsonpath_filter2=$[", http.StatusUnprocessableEntity, ""},
+		{"disabled", "", "/?jsonpath_filter=$.o&jsonpath_filter2=$.x", http.StatusOK, `{"x":{"y":1}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{ThenParam: tt.param}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.want != "" && rr.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNullToEmptyArray(t *testing.T) {
+	const doc = `{"items":null,"n":null,"a":1}`
+	tests := []struct {
+		name   string
+		mode   string
+		engine string
+		expr   string
+		want   string
+	}{
+		{"auto wildcard", "auto", "", "$.missing[*]", "[]"},
+		{"auto recursive descent", "auto", "", "$..missing", "[]"},
+		{"auto single node", "auto", "", "$.n", "null"},
+		{"auto no match", "auto", "", "$.missing", "null"},
+		{"auto jq recursive descent", "auto", "jq", ".items | ..", "[]"},
+		{"auto jq single node", "auto", "jq", ".n", "null"},
+		{"always single node", "always", "", "$.n", "[]"},
+		{"always no match", "always", "", "$.missing", "[]"},
+		{"always jq", "always", "jq", ".n", "[]"},
+		{"match kept", "always", "", "$.a", "1"},
+		{"off jq recursive descent", "", "jq", ".items | ..", "null"},
+		{"off single node", "", "", "$.n", "null"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{NullToEmptyArray: tt.mode, Engine: tt.engine}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter="+url.QueryEscape(tt.expr), respond(http.StatusOK, "application/json", doc))
+			if rr.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", rr.Code, http.StatusOK)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxExpressionLength(t *testing.T) {
+	// key returns a member name making "$." + key n bytes long.
+	key := func(n int) string { return strings.Repeat("k", n-2) }
+	doc := `{"` + key(16) + `":1,"` + key(4096) + `":2,"` + key(5000) + `":3,"data":{"` + key(11) + `":4}}`
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		expr   string
+		status int
+		want   string
+	}{
+		{"at limit", ResponseFilter{MaxExpressionLength: 16}, "$." + key(16), http.StatusOK, "1"},
+		{"over limit", ResponseFilter{MaxExpressionLength: 15}, "$." + key(16), http.StatusBadRequest, ""},
+		{"at default limit", ResponseFilter{}, "$." + key(4096), http.StatusOK, "2"},
+		{"over default limit", ResponseFilter{}, "$." + key(4096) + "k", http.StatusBadRequest, ""},
+		{"disabled", ResponseFilter{MaxExpressionLength: -1}, "$." + key(5000), http.StatusOK, "3"},
+		{"prefix counted", ResponseFilter{MaxExpressionLength: 15, ExpressionPrefix: "$.data"}, "." + key(11), http.StatusBadRequest, ""},
+		{"prefix at limit", ResponseFilter{MaxExpressionLength: 16, ExpressionPrefix: "$.data"}, "." + key(11), http.StatusOK, "4"},
+		{"default expression", ResponseFilter{MaxExpressionLength: 4, DefaultExpression: "$." + key(16)}, "", http.StatusOK, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			target := "/"
+			if tt.expr != "" {
+				target += "?jsonpath_filter=" + url.QueryEscape(tt.expr)
+			}
+			rr := serve(t, &m, target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.want != "" && rr.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestExpressionPrefix(t *testing.T) {
+	const doc = `{"data":{"items":[{"id":1},{"id":2}],"count":2},"secret":"x"}`
+	tests := []struct {
+		name   string
+		prefix string
+		expr   string
+		want   string
+	}{
+		{"dot", "$.data", ".items[*].id", "[1,2]"},
+		{"bare", "$.data", "items[*].id", "[1,2]"},
+		{"rooted", "$.data", "$.items[*].id", "[1,2]"},
+		{"bracket", "$.data", `["count"]`, "2"},
+		{"root only", "$.data", "$", `{"count":2,"items":[{"id":1},{"id":2}]}`},
+		{"trailing dot prefix", "$.data.", "count", "2"},
+		{"padded", "$.data", " .count ", "2"},
+		{"cannot escape prefix", "$.data", "$.secret", "null"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{ExpressionPrefix: tt.prefix}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter="+url.QueryEscape(tt.expr), respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncludeHeaders(t *testing.T) {
+	const doc = `{"id":7,"name":"a"}`
+	hdr := map[string]string{"x-request-id": "abc", "Cache-Control": "no-cache"}
+	tests := []struct {
+		name  string
+		m     ResponseFilter
+		exprs []string
+		want  string
+	}{
+		{"header and body", ResponseFilter{IncludeHeaders: true}, []string{`$.headers["X-Request-Id"]`, "$.body.id"},
+			`{"$.body.id":7,"$.headers[\"X-Request-Id\"]":"abc"}`},
+		{"body", ResponseFilter{IncludeHeaders: true}, []string{"$.body"}, doc},
+		{"disabled", ResponseFilter{}, []string{"$.headers"}, "null"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			query := url.Values{"jsonpath_filter": tt.exprs}
+			var calls int
+			rr := serve(t, &m, "/?"+query.Encode(), countingUpstream(&calls, hdr, []byte(doc)))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalPanic(t *testing.T) {
+	const doc = `{"a":1}`
+	panicking := func(string) (gval.Evaluable, error) {
+		return func(context.Context, interface{}) (interface{}, error) {
+			var m map[string]int
+			m["x"]++ // assignment to entry in nil map
+			return nil, nil
+		}, nil
+	}
+	tests := []struct {
+		name    string
+		onError string
+		compile func(string) (gval.Evaluable, error)
+		status  int
+		want    string
+	}{
+		{"fail", "", panicking, http.StatusBadRequest, ""},
+		{"empty", "empty", panicking, http.StatusOK, "null"},
+		{"passthrough", "passthrough", panicking, http.StatusOK, doc},
+		{"compile", "", func(string) (gval.Evaluable, error) { panic("boom") }, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{OnError: tt.onError}
+			provision(t, m)
+			m.exprs.compile = tt.compile
+			core, logs := observer.New(zapcore.DebugLevel)
+			m.logger = zap.New(core)
+			rr := serve(t, m, "/?jsonpath_filter="+url.QueryEscape("$[?(@ == 1)]"), respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+			entries := logs.FilterMessage("JSONPath error").All()
+			if len(entries) != 1 {
+				t.Fatalf("logged %d errors, want 1; all: %v", len(entries), logs.All())
+			}
+			fields := entries[0].ContextMap()
+			if stack, _ := fields["stack"].(string); !strings.Contains(stack, "runtime/debug.Stack") {
+				t.Errorf("stack = %.80q, want a stack trace", fields["stack"])
+			}
+			if msg, _ := fields["error"].(string); !strings.Contains(msg, "evaluation panicked") {
+				t.Errorf("error = %q, want a recovered panic", msg)
+			}
+		})
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		passThrough bool
+		ct          string
+		target      string
+		want        map[string]string
+	}{
+		{"filtered", false, "application/json", "/?jsonpath_filter=$.a",
+			map[string]string{"X-Filtered-By": "jsonpath", "X-User": "alice", "X-Upstream": "replaced"}},
+		{"unfiltered", false, "text/plain", "/?jsonpath_filter=$.a",
+			map[string]string{"X-Filtered-By": "", "X-User": "", "X-Upstream": "upstream"}},
+		{"pass through", true, "text/plain", "/?jsonpath_filter=$.a",
+			map[string]string{"X-Filtered-By": "jsonpath", "X-User": "alice", "X-Upstream": "replaced"}},
+		{"pass through filtered", true, "application/json", "/?jsonpath_filter=$.a",
+			map[string]string{"X-Filtered-By": "jsonpath", "X-User": "alice", "X-Upstream": "replaced"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{
+				SetHeaders: map[string]string{
+					"X-Filtered-By": "jsonpath",
+					"X-User":        "{http.request.header.X-Name}",
+					"X-Upstream":    "replaced",
+				},
+				SetHeadersPassThrough: tt.passThrough,
+			}
+			provision(t, m)
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", tt.ct)
+				w.Header().Set("X-Upstream", "upstream")
+				_, err := w.Write([]byte(`{"a":1}`))
+				return err
+			})
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("X-Name", "alice")
+			rr := httptest.NewRecorder()
+			req = caddyhttp.PrepareRequest(req, caddy.NewReplacer(), rr, nil)
+			if err := m.ServeHTTP(rr, req, next); err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			for name, want := range tt.want {
+				if got := rr.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
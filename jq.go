@@ -0,0 +1,50 @@
+package jsonpathfilter
+
+import (
+	"context"
+	"errors"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/itchyny/gojq"
+)
+
+// compileJQ compiles the jq program expr. The returned evaluable yields
+// the program's only output, or an array of all outputs if there are
+// several, and errNoMatch if there are none.
+func compileJQ(expr string) (gval.Evaluable, error) {
+	query, err := gojq.Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, data interface{}) (interface{}, error) {
+		var results []interface{}
+		iter := code.RunWithContext(ctx, data)
+		for {
+			v, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := v.(error); ok {
+				var halt *gojq.HaltError
+				if errors.As(err, &halt) && halt.Value() == nil {
+					// halt stops the program without an error
+					break
+				}
+				return nil, err
+			}
+			results = append(results, v)
+		}
+		switch len(results) {
+		case 0:
+			return nil, errNoMatch
+		case 1:
+			return results[0], nil
+		default:
+			return results, nil
+		}
+	}, nil
+}
@@ -0,0 +1,424 @@
+package jsonpathfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// keyOrder records the original key order of decoded JSON objects, keyed
+// by the objects' map pointers. Expressions select values without copying
+// them, so the order survives filtering.
+type keyOrder map[uintptr][]string
+
+// utf8BOM is the UTF-8 encoded byte order mark.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// trimBody strips a leading UTF-8 byte order mark and surrounding
+// whitespace from body, which some upstreams emit around JSON.
+func trimBody(body []byte) []byte {
+	body = bytes.TrimSpace(body)
+	return bytes.TrimSpace(bytes.TrimPrefix(body, utf8BOM))
+}
+
+// firstValue returns the first complete JSON value in body without the
+// data following it, or body unchanged if it does not start with one.
+func firstValue(body []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return body
+	}
+	return body[:dec.InputOffset()]
+}
+
+// decodeJSON parses body. If preserveOrder is set, it also returns the
+// key order of every object in the document. Numbers are decoded as
+// float64, except for integers beyond the range float64 represents
+// exactly, which are kept as json.Number so that they are written back
+// unchanged. Note that JSONPath comparisons never match json.Number
+// values.
+func decodeJSON(body []byte, preserveOrder bool) (interface{}, keyOrder, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var data interface{}
+	var order keyOrder
+	var err error
+	if preserveOrder {
+		order = make(keyOrder)
+		data, err = decodeOrdered(dec, order)
+	} else if err = dec.Decode(&data); err == nil {
+		data = convertNumbers(data)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, nil, fmt.Errorf("invalid character after top-level value")
+	}
+	return data, order, nil
+}
+
+// decodeOrdered reads the next JSON value from dec, recording the key
+// order of objects in order.
+func decodeOrdered(dec *json.Decoder, order keyOrder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		if n, ok := tok.(json.Number); ok {
+			return convertNumber(n), nil
+		}
+		return tok, nil
+	}
+	switch delim {
+	case '{':
+		obj := make(map[string]interface{})
+		var keys []string
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := tok.(string)
+			value, err := decodeOrdered(dec, order)
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := obj[key]; !dup {
+				keys = append(keys, key)
+			}
+			obj[key] = value
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		order[reflect.ValueOf(obj).Pointer()] = keys
+		return obj, nil
+	case '[':
+		arr := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrdered(dec, order)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return arr, nil
+	default:
+		return nil, fmt.Errorf("unexpected delimiter %v", delim)
+	}
+}
+
+// maxExactInt is the largest integer magnitude that float64 represents
+// exactly.
+const maxExactInt = 1 << 53
+
+// convertNumber returns n as float64 unless it is an integer that float64
+// cannot represent exactly.
+func convertNumber(n json.Number) interface{} {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		if i > maxExactInt || i < -maxExactInt {
+			return n
+		}
+		return float64(i)
+	}
+	if !strings.ContainsAny(string(n), ".eE") {
+		// an integer beyond int64
+		return n
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return n
+	}
+	return f
+}
+
+// convertNumbers replaces the json.Number values in v, decoded with
+// UseNumber, as described for convertNumber. Objects and arrays are
+// modified in place.
+func convertNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		return convertNumber(v)
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = convertNumbers(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = convertNumbers(elem)
+		}
+	}
+	return v
+}
+
+// maxRound is the most decimal places numbers can be rounded to; float64
+// has no more significant digits.
+const maxRound = 17
+
+// roundFloats rounds the non-integral float64 numbers in v to decimals
+// places, leaving json.Number values alone. Objects and arrays are
+// modified in place.
+func roundFloats(v interface{}, decimals int) interface{} {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) {
+			return v
+		}
+		// Round the decimal form, which avoids the error of scaling
+		rounded, err := strconv.ParseFloat(strconv.FormatFloat(v, 'f', decimals, 64), 64)
+		if err != nil {
+			return v
+		}
+		return rounded
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = roundFloats(elem, decimals)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = roundFloats(elem, decimals)
+		}
+	}
+	return v
+}
+
+// marshalJSON encodes v, indented with two spaces if pretty is set, and
+// with <, > and & escaped in strings if escapeHTML is set, like
+// json.Marshal. Objects with a recorded key order are written in that
+// order; any keys added after decoding follow in sorted order.
+func marshalJSON(v interface{}, order keyOrder, pretty, escapeHTML bool) ([]byte, error) {
+	if order == nil {
+		indent := ""
+		if pretty {
+			indent = "  "
+		}
+		return encodeValue(v, indent, escapeHTML)
+	}
+
+	var buf bytes.Buffer
+	if err := writeOrdered(&buf, v, order, escapeHTML); err != nil {
+		return nil, err
+	}
+	if !pretty {
+		return buf.Bytes(), nil
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, buf.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	return indented.Bytes(), nil
+}
+
+// encodeValue encodes v like json.MarshalIndent with the given indent,
+// escaping HTML characters only if escapeHTML is set.
+func encodeValue(v interface{}, indent string, escapeHTML bool) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(escapeHTML)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func writeOrdered(buf *bytes.Buffer, v interface{}, order keyOrder, escapeHTML bool) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		buf.WriteByte('{')
+		for i, key := range orderedKeys(v, order) {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			k, err := encodeValue(key, "", escapeHTML)
+			if err != nil {
+				return err
+			}
+			buf.Write(k)
+			buf.WriteByte(':')
+			if err := writeOrdered(buf, v[key], order, escapeHTML); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeOrdered(buf, elem, order, escapeHTML); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		b, err := encodeValue(v, "", escapeHTML)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	return nil
+}
+
+// marshalCanonical encodes v in the canonical form of RFC 8785, for
+// byte-stable output: without whitespace, with object keys sorted by
+// their UTF-16 code units, strings escaped only where JSON requires it
+// and numbers formatted as in ECMAScript.
+func marshalCanonical(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeCanonical(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case string:
+		writeCanonicalString(buf, v)
+	case float64:
+		if v == 0 {
+			// no negative zero
+			buf.WriteByte('0')
+			return nil
+		}
+		// encoding/json formats float64 like ECMAScript
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	case json.Number:
+		// an integer beyond the range of float64, kept as it is
+		buf.WriteString(string(v))
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return lessUTF16(keys[i], keys[j]) })
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, key)
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, v[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonical(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		// other types, such as the descriptions of results, as decoded
+		// from their JSON encoding
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		data, _, err := decodeJSON(b, false)
+		if err != nil {
+			return err
+		}
+		return writeCanonical(buf, data)
+	}
+	return nil
+}
+
+// writeCanonicalString writes s as a JSON string, escaping only quotes,
+// backslashes and control characters. Invalid UTF-8 is replaced by
+// U+FFFD.
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, c := range s {
+		switch c {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if c < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, c)
+			} else {
+				buf.WriteRune(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// lessUTF16 reports whether a sorts before b by their UTF-16 code units.
+func lessUTF16(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
+
+// orderedKeys returns the keys of obj in their recorded order.
+func orderedKeys(obj map[string]interface{}, order keyOrder) []string {
+	recorded := order[reflect.ValueOf(obj).Pointer()]
+	keys := make([]string, 0, len(obj))
+	seen := make(map[string]bool, len(obj))
+	for _, key := range recorded {
+		if _, ok := obj[key]; ok && !seen[key] {
+			keys = append(keys, key)
+			seen[key] = true
+		}
+	}
+	if len(keys) == len(obj) {
+		return keys
+	}
+	var extra []string
+	for key := range obj {
+		if !seen[key] {
+			extra = append(extra, key)
+		}
+	}
+	sort.Strings(extra)
+	return append(keys, extra...)
+}
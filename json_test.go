@@ -0,0 +1,210 @@
+package jsonpathfilter
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestPreserveOrder(t *testing.T) {
+	const doc = `{"z":1,"a":{"y":true,"b":null},"m":[{"k":1,"c":2}]}`
+	tests := []struct {
+		name     string
+		preserve bool
+		target   string
+		want     string
+	}{
+		{"whole document", true, "/?jsonpath_filter=$", doc},
+		{"nested object", true, "/?jsonpath_filter=$.a", `{"y":true,"b":null}`},
+		{"array elements", true, "/?jsonpath_filter=$.m", `[{"k":1,"c":2}]`},
+		{"sorted by default", false, "/?jsonpath_filter=$", `{"a":{"b":null,"y":true},"m":[{"c":2,"k":1}],"z":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{PreserveOrder: tt.preserve}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrimBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		target string
+		want   string
+	}{
+		{"bom object", "\xEF\xBB\xBF{\"a\":1}", "/?jsonpath_filter=$.a", "1"},
+		{"padded array", " \n\t[1,2,3]\r\n ", "/?jsonpath_filter=$[1]", "2"},
+		{"padded bom", " \xEF\xBB\xBF [1] \n", "/?jsonpath_filter=$[0]", "1"},
+		{"invalid passes original", "\xEF\xBB\xBF {nope} ", "/?jsonpath_filter=$.a", "\xEF\xBB\xBF {nope} "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", tt.body))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrailingData(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow bool
+		body  string
+		want  string
+	}{
+		{"log line", true, "{\"a\":1}\nINFO request done\n", "1"},
+		{"second document", true, `{"a":1}{"a":2}`, "1"},
+		{"padded", true, " \xEF\xBB\xBF{\"a\":1} trailing", "1"},
+		{"no trailing data", true, `{"a":1}`, "1"},
+		{"invalid", true, "{nope} trailing", "{nope} trailing"},
+		{"strict log line", false, "{\"a\":1}\nINFO request done\n", "{\"a\":1}\nINFO request done\n"},
+		{"strict second document", false, `{"a":1}{"a":2}`, `{"a":1}{"a":2}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{AllowTrailingData: tt.allow}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter=$.a", respond(http.StatusOK, "application/json", tt.body))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLargeNumbers(t *testing.T) {
+	const doc = `{"id":9007199254740993,"items":[{"id":9007199254740993,"n":"a"},{"id":2,"n":"b"}]}`
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		target string
+		want   string
+	}{
+		{"member", ResponseFilter{}, "/?jsonpath_filter=$.id", "9007199254740993"},
+		{"object", ResponseFilter{}, "/?jsonpath_filter=$.items[0]", `{"id":9007199254740993,"n":"a"}`},
+		{"comparison", ResponseFilter{}, "/?jsonpath_filter=" + url.QueryEscape(`$.items[?(@.id == 2)].n`), `["b"]`},
+		{"filtered", ResponseFilter{}, "/?jsonpath_filter=" + url.QueryEscape(`$.items[?(@.n == "a")].id`), `[9007199254740993]`},
+		{"large comparison never matches", ResponseFilter{}, "/?jsonpath_filter=" + url.QueryEscape(`$.items[?(@.id == 9007199254740993)].n`), `[]`},
+		{"preserve order", ResponseFilter{PreserveOrder: true}, "/?jsonpath_filter=$.items", `[{"id":9007199254740993,"n":"a"},{"id":2,"n":"b"}]`},
+		{"jq", ResponseFilter{Engine: "jq"}, "/?jsonpath_filter=.id", "9007199254740993"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRound(t *testing.T) {
+	const doc = `{"pi":3.14159,"n":7,"s":"1.2345","big":9007199254740993,"items":[{"x":2.675,"y":[0.125,1.5]},2.5]}`
+	two, zero := 2, 0
+	tests := []struct {
+		name   string
+		round  *int
+		target string
+		want   string
+	}{
+		{"scalar", &two, "/?jsonpath_filter=$.pi", "3.14"},
+		{"nested", &two, "/?jsonpath_filter=$.items", `[{"x":2.67,"y":[0.12,1.5]},2.5]`},
+		{"whole numbers", &zero, "/?jsonpath_filter=$.items", `[{"x":3,"y":[0,2]},2]`},
+		{"integer", &two, "/?jsonpath_filter=$.n", "7"},
+		{"string", &two, "/?jsonpath_filter=$.s", `"1.2345"`},
+		{"large integer", &zero, "/?jsonpath_filter=$.big", "9007199254740993"},
+		{"disabled", nil, "/?jsonpath_filter=$.pi", "3.14159"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Round: tt.round}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		bodies []string
+		want   string
+	}{
+		{"key order", ResponseFilter{Canonical: true},
+			[]string{`{"b":1,"a":{"y":true,"x":null}}`, `{"a":{"x":null,"y":true},"b":1}`, "{\n  \"a\" : { \"y\": true, \"x\": null },\n  \"b\": 1\n}"},
+			`{"a":{"x":null,"y":true},"b":1}`},
+		{"utf-16 key order", ResponseFilter{Canonical: true},
+			[]string{`{"\uff61":1,"\ud83d\ude00":2,"z":3}`, `{"z":3,"\ud83d\ude00":2,"\uff61":1}`},
+			"{\"z\":3,\"\U0001F600\":2,\"\uff61\":1}"},
+		{"numbers", ResponseFilter{Canonical: true},
+			[]string{`[1.0,-0,1e21,0.000001,1e-7,9007199254740993,1.5E2]`},
+			`[1,0,1e+21,0.000001,1e-7,9007199254740993,150]`},
+		{"minimal escaping", ResponseFilter{Canonical: true},
+			[]string{`["<b>&","\u00e9","\u2028","\"\\","\u0001\n\t"]`},
+			"[\"<b>&\",\"\u00e9\",\"\u2028\",\"\\\"\\\\\",\"\\u0001\\n\\t\"]"},
+		{"pretty overridden", ResponseFilter{Canonical: true, Pretty: true},
+			[]string{`{"b":[1,2],"a":1}`},
+			`{"a":1,"b":[1,2]}`},
+		{"stream disabled", ResponseFilter{Canonical: true, Stream: true},
+			[]string{`{"b":[1,2],"a":1}`, `{"a":1,"b":[1,2]}`},
+			`{"a":1,"b":[1,2]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			for _, body := range tt.bodies {
+				for i := 0; i < 3; i++ {
+					rr := serve(t, &m, "/?jsonpath_filter=$", respond(http.StatusOK, "application/json", body))
+					if got := rr.Body.String(); got != tt.want {
+						t.Fatalf("body for %s = %q, want %q", body, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEscapeHTML(t *testing.T) {
+	const doc = `{"link":"<a href=\"/x?a=1&b=2\">x</a>","items":[{"html":"<b>"}]}`
+	escape, keep := true, false
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		target string
+		want   string
+	}{
+		{"default", ResponseFilter{}, "/?jsonpath_filter=$.link", `"\u003ca href=\"/x?a=1\u0026b=2\"\u003ex\u003c/a\u003e"`},
+		{"enabled", ResponseFilter{EscapeHTML: &escape}, "/?jsonpath_filter=$.items", `[{"html":"\u003cb\u003e"}]`},
+		{"disabled", ResponseFilter{EscapeHTML: &keep}, "/?jsonpath_filter=$.link", `"<a href=\"/x?a=1&b=2\">x</a>"`},
+		{"disabled pretty", ResponseFilter{EscapeHTML: &keep, Pretty: true}, "/?jsonpath_filter=$.items", "[\n  {\n    \"html\": \"<b>\"\n  }\n]"},
+		{"disabled preserve order", ResponseFilter{EscapeHTML: &keep, PreserveOrder: true}, "/?jsonpath_filter=$.items", `[{"html":"<b>"}]`},
+		{"disabled stream", ResponseFilter{EscapeHTML: &keep, Stream: true}, "/?jsonpath_filter=$.items", `[{"html":"<b>"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package jsonpathfilter
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// limitWriter sits in front of the response recorder and counts the
+// bytes of buffered bodies as they arrive, so that MaxBodySize also holds
+// for bodies without a Content-Length, such as chunked ones. Once a body
+// exceeds max, buffering stops: if overflow writes the buffered part to
+// the client, the rest of the body is streamed through; otherwise it is
+// discarded and exceeded is set, for the body to be replaced by an error.
+type limitWriter struct {
+	rec caddyhttp.ResponseRecorder
+	w   http.ResponseWriter
+	max int64
+
+	// overflow is called once the limit is exceeded and reports whether
+	// it wrote the recorded response to w.
+	overflow func() (bool, error)
+
+	status    int
+	n         int64
+	exceeded  bool
+	streaming bool
+}
+
+func (l *limitWriter) Header() http.Header { return l.rec.Header() }
+
+func (l *limitWriter) WriteHeader(status int) {
+	if l.status != 0 {
+		return
+	}
+	if status < 100 || status > 199 {
+		l.status = status
+	}
+	l.rec.WriteHeader(status)
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.status == 0 {
+		l.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case l.streaming:
+		return l.w.Write(p)
+	case l.exceeded:
+		return len(p), nil
+	case !l.rec.Buffered():
+		return l.rec.Write(p)
+	}
+	l.n += int64(len(p))
+	if l.n <= l.max {
+		return l.rec.Write(p)
+	}
+	streamed, err := l.overflow()
+	if err != nil {
+		return 0, err
+	}
+	if !streamed {
+		l.exceeded = true
+		l.rec.Buffer().Reset()
+		return len(p), nil
+	}
+	l.streaming = true
+	return l.w.Write(p)
+}
+
+// FlushError flushes the client once the body is streamed through, and
+// the recorder otherwise.
+func (l *limitWriter) FlushError() error {
+	//nolint:bodyclose
+	if l.streaming {
+		return http.NewResponseController(l.w).Flush()
+	}
+	//nolint:bodyclose
+	return http.NewResponseController(l.rec).Flush()
+}
+
+// Unwrap returns the recorder, for http.ResponseController.
+func (l *limitWriter) Unwrap() http.ResponseWriter { return l.rec }
@@ -0,0 +1,80 @@
+package jsonpathfilter
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestLimitWriter(t *testing.T) {
+	doc := `{"a":1,"b":"` + strings.Repeat("x", 100) + `"}`
+	tests := []struct {
+		name   string
+		max    int64
+		reject bool
+		status int
+		want   string
+	}{
+		{"under", int64(len(doc)) + 1, false, http.StatusOK, "1"},
+		{"at", int64(len(doc)), false, http.StatusOK, "1"},
+		{"over", int64(len(doc)) - 1, false, http.StatusOK, doc},
+		{"far over", 16, false, http.StatusOK, doc},
+		{"over rejecting", int64(len(doc)) - 1, true, http.StatusRequestEntityTooLarge, ""},
+		{"far over rejecting", 16, true, http.StatusRequestEntityTooLarge, ""},
+	}
+	// Write the body in chunks without a Content-Length
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+		for body := doc; body != ""; {
+			n := min(len(body), 10)
+			if _, err := w.Write([]byte(body[:n])); err != nil {
+				return err
+			}
+			body = body[n:]
+		}
+		return nil
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{MaxBodySize: tt.max, RejectLargeBody: tt.reject, DebugHeader: true}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter=$.a", next)
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if tt.want == doc {
+				if got, want := rr.Header().Get(debugHeader), "skipped; too-large"; got != want {
+					t.Errorf("%s = %q, want %q", debugHeader, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitWriterBuffer(t *testing.T) {
+	var buf bytes.Buffer
+	rec := caddyhttp.NewResponseRecorder(httptest.NewRecorder(), &buf, func(int, http.Header) bool { return true })
+	l := &limitWriter{rec: rec, w: httptest.NewRecorder(), max: 16, overflow: func() (bool, error) { return false, nil }}
+	chunk := []byte("0123456789")
+	for i := 0; i < 10; i++ {
+		if n, err := l.Write(chunk); n != len(chunk) || err != nil {
+			t.Fatalf("Write = %d, %v, want %d, nil", n, err, len(chunk))
+		}
+		if buf.Len() > 16 {
+			t.Fatalf("buffered %d bytes after %d writes, want at most 16", buf.Len(), i+1)
+		}
+	}
+	if !l.exceeded || l.streaming {
+		t.Errorf("exceeded, streaming = %t, %t, want true, false", l.exceeded, l.streaming)
+	}
+}
@@ -0,0 +1,114 @@
+package jsonpathfilter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// filterMetrics holds the Prometheus collectors of the handler.
+type filterMetrics struct {
+	filtered     prometheus.Counter
+	passThrough  *prometheus.CounterVec
+	errors       prometheus.Counter
+	filteredSize prometheus.Histogram
+	evalDuration *prometheus.HistogramVec
+}
+
+// newFilterMetrics registers the handler's collectors with registry. If
+// another handler instance already registered them, the existing
+// collectors are shared.
+func newFilterMetrics(registry *prometheus.Registry) (*filterMetrics, error) {
+	const ns, sub = "caddy", "jsonpath_filter"
+	fm := &filterMetrics{
+		filtered: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "filtered_total",
+			Help:      "Number of responses filtered.",
+		}),
+		passThrough: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "passthrough_total",
+			Help:      "Number of responses passed through unfiltered, by reason.",
+		}, []string{"reason"}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "errors_total",
+			Help:      "Number of JSONPath errors.",
+		}),
+		filteredSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "filtered_size_bytes",
+			Help:      "Histogram of filtered response body sizes.",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+		}),
+		evalDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "eval_duration_seconds",
+			Help:      "Histogram of the time taken to apply the expressions, by expression.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}, []string{"expression"}),
+	}
+	if registry == nil {
+		return fm, nil
+	}
+
+	var err error
+	if fm.filtered, err = register(registry, fm.filtered); err != nil {
+		return nil, err
+	}
+	if fm.passThrough, err = register(registry, fm.passThrough); err != nil {
+		return nil, err
+	}
+	if fm.errors, err = register(registry, fm.errors); err != nil {
+		return nil, err
+	}
+	if fm.filteredSize, err = register(registry, fm.filteredSize); err != nil {
+		return nil, err
+	}
+	if fm.evalDuration, err = register(registry, fm.evalDuration); err != nil {
+		return nil, err
+	}
+	return fm, nil
+}
+
+// register registers c with registry, returning the already registered
+// collector if there is one.
+func register[T prometheus.Collector](registry *prometheus.Registry, c T) (T, error) {
+	if err := registry.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing, nil
+			}
+		}
+		return c, err
+	}
+	return c, nil
+}
+
+// exprLabel identifies the expressions exprs applied to r in the
+// expression label of the evaluation latency histogram, without letting
+// clients create labels: "filter:<name>" for a named filter,
+// "config:<hash>" for other configured expressions and "client" for all
+// client-supplied ones.
+func (m *ResponseFilter) exprLabel(r *http.Request, exprs []string, fromClient bool) string {
+	if fromClient {
+		return "client"
+	}
+	name := m.filterName(r)
+	if expr, ok := m.Filters[name]; ok && len(exprs) == 1 && exprs[0] == bindArgs(expr, r.URL.Query()[m.FilterArgParam]) {
+		return "filter:" + name
+	}
+	sum := sha256.Sum256([]byte(strings.Join(exprs, "\n")))
+	return "config:" + hex.EncodeToString(sum[:4])
+}
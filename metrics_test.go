@@ -0,0 +1,81 @@
+package jsonpathfilter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sampleCount returns the number of observations of the histogram o.
+func sampleCount(tb testing.TB, o prometheus.Observer) float64 {
+	tb.Helper()
+	var metric dto.Metric
+	if err := o.(prometheus.Metric).Write(&metric); err != nil {
+		tb.Fatal(err)
+	}
+	return float64(metric.GetHistogram().GetSampleCount())
+}
+
+func TestMetrics(t *testing.T) {
+	m := new(ResponseFilter)
+	provision(t, m)
+	json := respond(http.StatusOK, "application/json", `{"a":1}`)
+	serve(t, m, "/?jsonpath_filter=$.a", json)
+	serve(t, m, "/?jsonpath_filter=$.a", json)
+	serve(t, m, "/?jsonpath_filter=$", json)
+	serve(t, m, "/?jsonpath_filter=$.a", respond(http.StatusOK, "text/plain", "a"))
+	serve(t, m, "/", json)
+	serve(t, m, "/?jsonpath_filter=$[", json)
+
+	for _, tt := range []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"filtered", testutil.ToFloat64(m.metrics.filtered), 3},
+		{"non-json", testutil.ToFloat64(m.metrics.passThrough.WithLabelValues("non-json")), 1},
+		{"no-expression", testutil.ToFloat64(m.metrics.passThrough.WithLabelValues("no-expression")), 1},
+		{"filtered size", sampleCount(t, m.metrics.filteredSize), 3},
+		{"latency", sampleCount(t, m.metrics.evalDuration.WithLabelValues("client")), 3},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestEvalDurationLabels(t *testing.T) {
+	m := &ResponseFilter{Filters: map[string]string{"summary": "$.a", "member": `$["{0}"]`}, DefaultExpression: "$.b"}
+	provision(t, m)
+	json := respond(http.StatusOK, "application/json", `{"a":1,"b":2}`)
+	serve(t, m, "/?filter=summary", json)
+	serve(t, m, "/?filter=summary", json)
+	serve(t, m, "/?filter=member&arg=a", json)
+	serve(t, m, "/?filter=member&arg=b", json)
+	serve(t, m, "/", json)
+	serve(t, m, "/?jsonpath_filter=$.a", json)
+	serve(t, m, "/?jsonpath_filter=$.b", json)
+
+	sum := sha256.Sum256([]byte("$.b"))
+	for _, tt := range []struct {
+		label string
+		want  float64
+	}{
+		{"filter:summary", 2},
+		{"filter:member", 2},
+		{"config:" + hex.EncodeToString(sum[:4]), 1},
+		{"client", 2},
+	} {
+		if got := sampleCount(t, m.metrics.evalDuration.WithLabelValues(tt.label)); got != tt.want {
+			t.Errorf("observations labeled %s = %v, want %v", tt.label, got, tt.want)
+		}
+	}
+	if n := testutil.CollectAndCount(m.metrics.evalDuration); n != 4 {
+		t.Errorf("%d expression labels, want 4", n)
+	}
+}
@@ -0,0 +1,176 @@
+package jsonpathfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// msgpackContentType is the Content-Type of MessagePack output.
+const msgpackContentType = "application/msgpack"
+
+// encodeMsgpack encodes v, a decoded JSON value, as MessagePack. Objects
+// with a recorded key order are written in that order. Integral numbers
+// are written as integers if they fit in 64 bits, other numbers as
+// float64. Values of other types, such as the explain description, are
+// converted through JSON first.
+func encodeMsgpack(v interface{}, order keyOrder) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeMsgpack(&buf, v, order); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeMsgpack(buf *bytes.Buffer, v interface{}, order keyOrder) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+			writeMsgpackInt(buf, int64(v))
+		} else {
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+		}
+	case int:
+		writeMsgpackInt(buf, int64(v))
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			writeMsgpackInt(buf, i)
+		} else if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			buf.WriteByte(0xcf)
+			binary.Write(buf, binary.BigEndian, u)
+		} else if f, err := strconv.ParseFloat(string(v), 64); err == nil {
+			return writeMsgpack(buf, f, order)
+		} else {
+			return fmt.Errorf("invalid number %q", v)
+		}
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackLength(buf, len(v), 0x90, 0xdc)
+		for _, elem := range v {
+			if err := writeMsgpack(buf, elem, order); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeMsgpackLength(buf, len(v), 0x80, 0xde)
+		for _, key := range orderedKeys(v, order) {
+			if err := writeMsgpack(buf, key, order); err != nil {
+				return err
+			}
+			if err := writeMsgpack(buf, v[key], order); err != nil {
+				return err
+			}
+		}
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		data, _, err := decodeJSON(b, false)
+		if err != nil {
+			return err
+		}
+		return writeMsgpack(buf, data, nil)
+	}
+	return nil
+}
+
+// writeMsgpackInt writes i in the smallest MessagePack integer format.
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 127:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// writeMsgpackLength writes the header of an array or map of n elements,
+// fix being the format of up to 15 elements and format16 that of up to
+// 65535; the 32-bit format follows format16.
+func writeMsgpackLength(buf *bytes.Buffer, n int, fix, format16 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(format16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(format16 + 1)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// isMsgpackType reports whether mediaType denotes MessagePack.
+func isMsgpackType(mediaType string) bool {
+	return mediaType == msgpackContentType || mediaType == "application/x-msgpack"
+}
+
+// prefersMsgpack reports whether the Accept header values rank
+// MessagePack above the filterable JSON media types, which are preferred
+// on ties.
+func (m *ResponseFilter) prefersMsgpack(accept []string) bool {
+	var msgpackQ, jsonQ float64
+	for _, value := range accept {
+		for _, mediaRange := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if s, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(s, 64); err != nil {
+					continue
+				}
+			}
+			switch {
+			case isMsgpackType(mediaType):
+				msgpackQ = math.Max(msgpackQ, q)
+			case m.isJSONContentType(mediaType):
+				jsonQ = math.Max(jsonQ, q)
+			}
+		}
+	}
+	return msgpackQ > jsonQ
+}
@@ -0,0 +1,228 @@
+package jsonpathfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeMsgpack decodes the MessagePack formats written by encodeMsgpack,
+// returning integers as int64, or uint64 beyond its range.
+func decodeMsgpack(r *bytes.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	read := func(v interface{}) error { return binary.Read(r, binary.BigEndian, v) }
+	length := func(size int) (int, error) {
+		switch size {
+		case 1:
+			var n uint8
+			return int(n), read(&n)
+		case 2:
+			var n uint16
+			err := read(&n)
+			return int(n), err
+		default:
+			var n uint32
+			err := read(&n)
+			return int(n), err
+		}
+	}
+	str := func(n int, err error) (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return string(b), err
+	}
+	array := func(n int, err error) (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = decodeMsgpack(r); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	object := func(n int, err error) (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		obj := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			key, err := decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			s, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is not a string", key)
+			}
+			if obj[s], err = decodeMsgpack(r); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return str(int(c&0x1f), nil)
+	case c&0xf0 == 0x90:
+		return array(int(c&0x0f), nil)
+	case c&0xf0 == 0x80:
+		return object(int(c&0x0f), nil)
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2, 0xc3:
+		return c == 0xc3, nil
+	case 0xcb:
+		var bits uint64
+		err := read(&bits)
+		return math.Float64frombits(bits), err
+	case 0xcf:
+		var u uint64
+		err := read(&u)
+		return u, err
+	case 0xd0:
+		var i int8
+		err := read(&i)
+		return int64(i), err
+	case 0xd1:
+		var i int16
+		err := read(&i)
+		return int64(i), err
+	case 0xd2:
+		var i int32
+		err := read(&i)
+		return int64(i), err
+	case 0xd3:
+		var i int64
+		err := read(&i)
+		return i, err
+	case 0xd9, 0xda, 0xdb:
+		return str(length(1 << (c - 0xd9)))
+	case 0xdc, 0xdd:
+		return array(length(2 << (c - 0xdc)))
+	case 0xde, 0xdf:
+		return object(length(2 << (c - 0xde)))
+	}
+	return nil, fmt.Errorf("unexpected format 0x%02x", c)
+}
+
+func TestMsgpack(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	doc := `{"a":1,"s":"x","f":1.5,"n":null,"t":true,"ints":[-1,-33,200,-40000,70000,-3000000000],` +
+		`"big":9007199254740993,"huge":18446744073709551615,"long":"` + long + `","many":[0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16]}`
+	many := make([]interface{}, 17)
+	for i := range many {
+		many[i] = int64(i)
+	}
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		target string
+		accept string
+		want   interface{}
+	}{
+		{"object", ResponseFilter{}, "/?format=msgpack&jsonpath_filter=" + url.QueryEscape(`$["a","s","f","n","t"]`), "",
+			[]interface{}{int64(1), "x", 1.5, nil, true}},
+		{"nested", ResponseFilter{}, "/?format=msgpack&jsonpath_filter=$", "",
+			map[string]interface{}{"a": int64(1), "s": "x", "f": 1.5, "n": nil, "t": true,
+				"ints": []interface{}{int64(-1), int64(-33), int64(200), int64(-40000), int64(70000), int64(-3000000000)},
+				"big":  int64(9007199254740993), "huge": uint64(math.MaxUint64), "long": long, "many": many}},
+		{"integers", ResponseFilter{}, "/?format=msgpack&jsonpath_filter=$.ints", "",
+			[]interface{}{int64(-1), int64(-33), int64(200), int64(-40000), int64(70000), int64(-3000000000)}},
+		{"large number", ResponseFilter{}, "/?format=msgpack&jsonpath_filter=$.big", "", int64(9007199254740993)},
+		{"unsigned number", ResponseFilter{}, "/?format=msgpack&jsonpath_filter=$.huge", "", uint64(math.MaxUint64)},
+		{"configured", ResponseFilter{Format: "msgpack"}, "/?jsonpath_filter=$.s", "", "x"},
+		{"accept", ResponseFilter{}, "/?jsonpath_filter=$.s", "application/msgpack", "x"},
+		{"accept preferred", ResponseFilter{}, "/?jsonpath_filter=$.s", "application/json;q=0.5, application/x-msgpack", "x"},
+		{"explain", ResponseFilter{}, "/?format=msgpack&explain=true&jsonpath_filter=$.s", "",
+			map[string]interface{}{"expression": "$.s", "matches": int64(1), "type": "string"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rr := serveRequest(t, &m, req, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Header().Get("Content-Type"); got != msgpackContentType {
+				t.Fatalf("Content-Type = %q, want %q", got, msgpackContentType)
+			}
+			r := bytes.NewReader(rr.Body.Bytes())
+			got, err := decodeMsgpack(r)
+			if err != nil {
+				t.Fatalf("decoding %x: %v", rr.Body.Bytes(), err)
+			}
+			if r.Len() != 0 {
+				t.Errorf("%d bytes left after decoding", r.Len())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMsgpackPreserveOrder(t *testing.T) {
+	m := &ResponseFilter{PreserveOrder: true}
+	provision(t, m)
+	rr := serve(t, m, "/?format=msgpack&jsonpath_filter=$.o", respond(http.StatusOK, "application/json", `{"o":{"z":1,"a":{"y":2,"b":3}}}`))
+	want := []byte{0x82, 0xa1, 'z', 0x01, 0xa1, 'a', 0x82, 0xa1, 'y', 0x02, 0xa1, 'b', 0x03}
+	if !bytes.Equal(rr.Body.Bytes(), want) {
+		t.Errorf("body = %x, want %x", rr.Body.Bytes(), want)
+	}
+}
+
+func TestMsgpackNegotiation(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		accept string
+		want   string
+	}{
+		{"default", "/?jsonpath_filter=$.a", "", "application/json"},
+		{"json preferred", "/?jsonpath_filter=$.a", "application/json, application/msgpack;q=0.5", "application/json"},
+		{"tie", "/?jsonpath_filter=$.a", "application/msgpack, application/json", "application/json"},
+		{"query overrides accept", "/?format=json&jsonpath_filter=$.a", "application/msgpack", "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rr := serveRequest(t, m, req, respond(http.StatusOK, "application/json", `{"a":1}`))
+			if got := rr.Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+			if tt.want == "application/json" && rr.Body.String() != "1" {
+				t.Errorf("body = %q, want %q", rr.Body.String(), "1")
+			}
+		})
+	}
+}
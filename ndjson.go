@@ -0,0 +1,71 @@
+package jsonpathfilter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime"
+)
+
+// isNDJSONContentType reports whether the Content-Type header value ct
+// describes newline-delimited JSON.
+func isNDJSONContentType(ct string) bool {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/x-ndjson" || mediaType == "application/ndjson"
+}
+
+// parseNDJSON parses every non-blank line of body as a JSON document. If
+// preserveOrder is set, it also returns the key order of all objects.
+func parseNDJSON(body []byte, preserveOrder bool) ([]interface{}, keyOrder, error) {
+	var records []interface{}
+	var order keyOrder
+	if preserveOrder {
+		order = make(keyOrder)
+	}
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		record, recordOrder, err := decodeJSON(line, preserveOrder)
+		if err != nil {
+			return nil, nil, err
+		}
+		for ptr, keys := range recordOrder {
+			order[ptr] = keys
+		}
+		records = append(records, record)
+	}
+	return records, order, nil
+}
+
+// filterNDJSON applies exprs to every record and returns the results as
+// newline-delimited JSON, or as a JSON array if NDJSONOutput is "array".
+// Records matching nothing yield null.
+func (m *ResponseFilter) filterNDJSON(ctx context.Context, exprs []string, records []interface{}, order keyOrder, pretty bool) ([]byte, error) {
+	results := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		result, err := m.transform(ctx, exprs, record)
+		if err != nil && !errors.Is(err, errNoMatch) {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	if m.NDJSONOutput == "array" {
+		return marshalJSON(results, order, pretty, m.escapeHTML())
+	}
+
+	var buf bytes.Buffer
+	for _, result := range results {
+		line, err := marshalJSON(result, order, false, m.escapeHTML())
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
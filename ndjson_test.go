@@ -0,0 +1,44 @@
+package jsonpathfilter
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNDJSON(t *testing.T) {
+	const doc = "{\"a\":1,\"b\":\"x\"}\n\n{\"a\":2}\n{\"a\":{\"c\":3}}\n"
+	tests := []struct {
+		name        string
+		m           ResponseFilter
+		contentType string
+		want        string
+	}{
+		{"lines", ResponseFilter{}, "application/x-ndjson", "1\n2\n{\"c\":3}\n"},
+		{"array", ResponseFilter{NDJSONOutput: "array"}, "application/json", `[1,2,{"c":3}]`},
+		{"pretty array", ResponseFilter{NDJSONOutput: "array", Pretty: true}, "application/json", "[\n  1,\n  2,\n  {\n    \"c\": 3\n  }\n]"},
+		{"array content type", ResponseFilter{NDJSONOutput: "array", OutputContentType: "application/vnd.example+json"},
+			"application/vnd.example+json", `[1,2,{"c":3}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			m.NDJSON = true
+			provision(t, &m)
+			rr := serve(t, &m, "/?jsonpath_filter=$.a", respond(http.StatusOK, "application/x-ndjson", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+		})
+	}
+	t.Run("disabled", func(t *testing.T) {
+		m := new(ResponseFilter)
+		provision(t, m)
+		rr := serve(t, m, "/?jsonpath_filter=$.a", respond(http.StatusOK, "application/x-ndjson", doc))
+		if got := rr.Body.String(); got != doc {
+			t.Errorf("body = %q, want it unfiltered", got)
+		}
+	})
+}
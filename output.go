@@ -0,0 +1,845 @@
+package jsonpathfilter
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// callbackName matches safe JSONP callback names: JavaScript identifiers,
+// optionally dotted, such as app.render.
+var callbackName = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+// isCallbackName reports whether name is a safe JSONP callback name.
+func isCallbackName(name string) bool {
+	return len(name) <= 128 && callbackName.MatchString(name)
+}
+
+// wrapJSONP returns the encoded JSON body as a call of callback.
+func wrapJSONP(callback string, body []byte) []byte {
+	out := make([]byte, 0, len(callback)+len(body)+3)
+	out = append(out, callback...)
+	out = append(out, '(')
+	out = append(out, body...)
+	return append(out, ");"...)
+}
+
+// templateFuncs are the functions available to the response template.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// rawScalar returns the plain text form of v if it is a scalar: strings
+// are returned unquoted, numbers, booleans and null in their JSON form.
+// It reports false for arrays and objects.
+func rawScalar(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), true
+	case []interface{}, map[string]interface{}:
+		return nil, false
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, false
+		}
+		return b, true
+	}
+}
+
+// Envelope configures wrapping of filtered results, producing for example
+// {"result": <filtered>, "count": <n>}.
+type Envelope struct {
+	// ResultKey is the member holding the filtered result. Defaults to
+	// "result".
+	ResultKey string `json:"result_key,omitempty"`
+
+	// CountKey is the member holding the number of matches: the length
+	// of an array result, 0 if nothing matched and 1 otherwise. Defaults
+	// to "count".
+	CountKey string `json:"count_key,omitempty"`
+}
+
+// wrap embeds result in the envelope. noMatch reports that the
+// expressions matched nothing.
+func (e *Envelope) wrap(result interface{}, noMatch bool) map[string]interface{} {
+	return map[string]interface{}{
+		e.ResultKey: result,
+		e.CountKey:  countMatches(result, noMatch),
+	}
+}
+
+// StatusEnvelope configures wrapping of filtered results together with
+// the response status and headers, producing {"status": 200, "headers":
+// {...}, "data": <filtered>}, for clients that read everything from the
+// body.
+type StatusEnvelope struct {
+	// Headers lists the response headers included in "headers". Headers
+	// missing from the response are omitted; repeated ones are joined
+	// with ", ".
+	Headers []string `json:"headers,omitempty"`
+}
+
+// wrap embeds result in the envelope; status and hdr describe the
+// response. The members are recorded in order, which is created if it
+// is nil and returned, so that they are written as status, headers and
+// data whether or not key order is preserved otherwise.
+func (e *StatusEnvelope) wrap(result interface{}, status int, hdr http.Header, order keyOrder) (map[string]interface{}, keyOrder) {
+	headers := make(map[string]interface{}, len(e.Headers))
+	for _, name := range e.Headers {
+		if values := hdr.Values(name); len(values) > 0 {
+			headers[http.CanonicalHeaderKey(name)] = strings.Join(values, ", ")
+		}
+	}
+	env := map[string]interface{}{
+		"status":  status,
+		"headers": headers,
+		"data":    result,
+	}
+	if order == nil {
+		order = keyOrder{}
+	}
+	order[reflect.ValueOf(env).Pointer()] = []string{"status", "headers", "data"}
+	return env, order
+}
+
+// ArrayEnvelope configures wrapping of array results only, producing for
+// example {"data": [...], "total": <n>}.
+type ArrayEnvelope struct {
+	// DataKey is the member holding the array. Defaults to "data".
+	DataKey string `json:"data_key,omitempty"`
+
+	// TotalKey is the member holding the number of elements. Defaults to
+	// "total".
+	TotalKey string `json:"total_key,omitempty"`
+}
+
+// wrap embeds result in the envelope if it is an array. total is the
+// number of elements before pagination, or negative if result was not
+// an array then, in which case its length is used.
+func (e *ArrayEnvelope) wrap(result interface{}, total int) interface{} {
+	a, ok := result.([]interface{})
+	if !ok {
+		return result
+	}
+	if total < 0 {
+		total = len(a)
+	}
+	return map[string]interface{}{
+		e.DataKey:  a,
+		e.TotalKey: total,
+	}
+}
+
+// GroupBy configures grouping of array results by a member of their
+// elements, producing for example {"books": [...], "games": [...]}.
+type GroupBy struct {
+	// Field is the member whose value names the group of an element.
+	Field string `json:"field,omitempty"`
+
+	// MissingKey is the group of elements that are not objects, lack
+	// Field or have it set to null. Defaults to "_none".
+	MissingKey string `json:"missing_key,omitempty"`
+}
+
+// apply groups the elements of the array result by their Field value, in
+// their order in result. String values name their group as they are,
+// other values by their JSON encoding. Other results are returned
+// unchanged.
+func (g *GroupBy) apply(result interface{}) interface{} {
+	a, ok := result.([]interface{})
+	if !ok {
+		return result
+	}
+	groups := make(map[string]interface{})
+	for _, elem := range a {
+		key := g.MissingKey
+		if obj, ok := elem.(map[string]interface{}); ok {
+			switch v := obj[g.Field].(type) {
+			case nil:
+			case string:
+				key = v
+			default:
+				if b, err := json.Marshal(v); err == nil {
+					key = string(b)
+				}
+			}
+		}
+		group, _ := groups[key].([]interface{})
+		groups[key] = append(group, elem)
+	}
+	return groups
+}
+
+// shapeOf returns the structure of result for the shape flag: objects
+// map their keys to the shapes of their values, arrays hold the shape
+// common to all their elements, and other values are given by their
+// type name, or "none" for no match. Elements of different shapes are
+// merged: objects into one with the keys of all, anything else into the
+// type names joined with "|", e.g. "number|string".
+func shapeOf(result interface{}, noMatch bool) interface{} {
+	if noMatch {
+		return "none"
+	}
+	switch v := result.(type) {
+	case map[string]interface{}:
+		shape := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			shape[key] = shapeOf(elem, false)
+		}
+		return shape
+	case []interface{}:
+		if len(v) == 0 {
+			return []interface{}{}
+		}
+		elem := shapeOf(v[0], false)
+		for _, other := range v[1:] {
+			elem = mergeShapes(elem, shapeOf(other, false))
+		}
+		return []interface{}{elem}
+	default:
+		return jsonType(result)
+	}
+}
+
+// mergeShapes returns the shape covering both shapes a and b.
+func mergeShapes(a, b interface{}) interface{} {
+	if oa, ok := a.(map[string]interface{}); ok {
+		if ob, ok := b.(map[string]interface{}); ok {
+			merged := make(map[string]interface{}, len(oa)+len(ob))
+			for key, shape := range oa {
+				merged[key] = shape
+			}
+			for key, shape := range ob {
+				if other, ok := merged[key]; ok {
+					shape = mergeShapes(other, shape)
+				}
+				merged[key] = shape
+			}
+			return merged
+		}
+	}
+	if aa, ok := a.([]interface{}); ok {
+		if ab, ok := b.([]interface{}); ok {
+			switch {
+			case len(aa) == 0:
+				return ab
+			case len(ab) == 0:
+				return aa
+			}
+			return []interface{}{mergeShapes(aa[0], ab[0])}
+		}
+	}
+	names := map[string]bool{}
+	for _, shape := range []interface{}{a, b} {
+		for _, name := range strings.Split(shapeName(shape), "|") {
+			names[name] = true
+		}
+	}
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return strings.Join(list, "|")
+}
+
+// shapeName returns the type names of shape, joined with "|".
+func shapeName(shape interface{}) string {
+	switch v := shape.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return v
+	}
+	return "unknown"
+}
+
+// countMatches returns the number of matches in result: the length of an
+// array, 0 for no match or null and 1 for any other value.
+func countMatches(result interface{}, noMatch bool) int {
+	switch v := result.(type) {
+	case []interface{}:
+		return len(v)
+	case nil:
+		return 0
+	default:
+		if noMatch {
+			return 0
+		}
+		return 1
+	}
+}
+
+// explanation describes the result of a filter for the explain flag.
+type explanation struct {
+	Expression interface{} `json:"expression"`
+	Matches    int         `json:"matches"`
+	Type       string      `json:"type"`
+}
+
+// diffSummary describes the effect of a filter for the debug_diff flag.
+type diffSummary struct {
+	OriginalSize        int      `json:"original_size"`
+	FilteredSize        int      `json:"filtered_size"`
+	RemovedTopLevelKeys []string `json:"removed_top_level_keys"`
+}
+
+// diff returns the effect of filtering the upstream body into result.
+// Top-level keys of an object body count as removed unless result is an
+// object with the same key.
+func diff(body []byte, result interface{}, order keyOrder) (diffSummary, error) {
+	filtered, err := marshalJSON(result, order, false, false)
+	if err != nil {
+		return diffSummary{}, err
+	}
+	d := diffSummary{OriginalSize: len(body), FilteredSize: len(filtered), RemovedTopLevelKeys: []string{}}
+	data, _, err := decodeJSON(body, false)
+	if err != nil {
+		return d, nil
+	}
+	original, _ := data.(map[string]interface{})
+	kept, _ := result.(map[string]interface{})
+	for key := range original {
+		if _, ok := kept[key]; !ok {
+			d.RemovedTopLevelKeys = append(d.RemovedTopLevelKeys, key)
+		}
+	}
+	sort.Strings(d.RemovedTopLevelKeys)
+	return d, nil
+}
+
+// explain returns match metadata for result, the outcome of applying
+// exprs. noMatch reports that the expressions matched nothing.
+func explain(exprs []string, result interface{}, noMatch bool) explanation {
+	e := explanation{Expression: exprs, Matches: 1, Type: jsonType(result)}
+	if len(exprs) == 1 {
+		e.Expression = exprs[0]
+	}
+	switch v := result.(type) {
+	case []interface{}:
+		e.Matches = len(v)
+	default:
+		if noMatch {
+			e.Matches, e.Type = 0, "none"
+		}
+	}
+	return e
+}
+
+// jsonType returns the JSON type name of v.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case int, float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return "unknown"
+	}
+}
+
+// pageParams returns the window requested by the "offset" and "limit"
+// query parameters of r. A missing limit is returned as -1, meaning no
+// limit.
+func pageParams(r *http.Request) (offset, limit int, err error) {
+	query := r.URL.Query()
+	limit = -1
+	if v := query.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			return 0, 0, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	return offset, limit, nil
+}
+
+// itemsRange is the range of a "Range: items=<first>-[<last>]" header.
+// last is -1 for ranges open at the end.
+type itemsRange struct {
+	first, last int
+}
+
+// parseItemsRange parses the Range header value v. It reports false for
+// other units, malformed ranges and multiple ranges.
+func parseItemsRange(v string) (itemsRange, bool) {
+	unit, spec, ok := strings.Cut(v, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "items") {
+		return itemsRange{}, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return itemsRange{}, false
+	}
+	rng := itemsRange{last: -1}
+	var err error
+	if rng.first, err = strconv.Atoi(first); err != nil || rng.first < 0 {
+		return itemsRange{}, false
+	}
+	if last != "" {
+		if rng.last, err = strconv.Atoi(last); err != nil || rng.last < rng.first {
+			return itemsRange{}, false
+		}
+	}
+	return rng, true
+}
+
+// resolve returns the indexes of the first and last elements of an array
+// of total elements within rng, or false if rng starts past its end.
+func (rng itemsRange) resolve(total int) (first, last int, ok bool) {
+	if rng.first >= total {
+		return 0, 0, false
+	}
+	last = rng.last
+	if last < 0 || last >= total {
+		last = total - 1
+	}
+	return rng.first, last, true
+}
+
+// page returns the window of at most limit elements starting at offset
+// if result is an array, and result unchanged otherwise. An offset past
+// the end yields an empty array; a negative limit means no limit.
+func page(result interface{}, offset, limit int) interface{} {
+	a, ok := result.([]interface{})
+	if !ok {
+		return result
+	}
+	if offset >= len(a) {
+		return []interface{}{}
+	}
+	a = a[offset:]
+	if limit >= 0 && limit < len(a) {
+		a = a[:limit]
+	}
+	return a
+}
+
+// Merge configures a JSON Merge Patch (RFC 7386) applied to filtered
+// results, e.g. to add static fields.
+type Merge struct {
+	// Patch is the merge patch; it must be a JSON object. Members with a
+	// null value are deleted from the result.
+	Patch json.RawMessage `json:"patch,omitempty"`
+
+	// Elements applies the patch to every object element of an array
+	// result as well. Without it, array results are left unchanged.
+	Elements bool `json:"elements,omitempty"`
+
+	patch map[string]interface{}
+}
+
+// provision parses the patch.
+func (mg *Merge) provision() error {
+	if err := json.Unmarshal(mg.Patch, &mg.patch); err != nil || mg.patch == nil {
+		return fmt.Errorf("merge patch must be a JSON object")
+	}
+	return nil
+}
+
+// apply merges the patch into result if it is an object, or into its
+// object elements if it is an array and Elements is set. Other results
+// are returned unchanged.
+func (mg *Merge) apply(result interface{}) interface{} {
+	switch v := result.(type) {
+	case map[string]interface{}:
+		return mergePatch(v, mg.patch)
+	case []interface{}:
+		if mg.Elements {
+			for i, elem := range v {
+				if obj, ok := elem.(map[string]interface{}); ok {
+					v[i] = mergePatch(obj, mg.patch)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// mergePatch applies the merge patch to target, modifying it in place,
+// and returns the result as described by RFC 7386.
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = make(map[string]interface{}, len(patch))
+	}
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(target, key)
+		case map[string]interface{}:
+			obj, _ := target[key].(map[string]interface{})
+			target[key] = mergePatch(obj, value)
+		default:
+			target[key] = value
+		}
+	}
+	return target
+}
+
+// fieldList returns the field names of a comma-separated projection list,
+// or nil if there are none.
+func fieldList(s string) []string {
+	var fields []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// project keeps only the given top-level members of result if it is an
+// object, or of each object element if it is an array. Objects are
+// modified in place, which retains their key order.
+func project(result interface{}, fields []string) interface{} {
+	keep := make(map[string]struct{}, len(fields))
+	for _, field := range fields {
+		keep[field] = struct{}{}
+	}
+	projectObject := func(v interface{}) {
+		if obj, ok := v.(map[string]interface{}); ok {
+			for key := range obj {
+				if _, ok := keep[key]; !ok {
+					delete(obj, key)
+				}
+			}
+		}
+	}
+	if a, ok := result.([]interface{}); ok {
+		for _, elem := range a {
+			projectObject(elem)
+		}
+	} else {
+		projectObject(result)
+	}
+	return result
+}
+
+// matchKeys keeps only the top-level members of result whose keys match
+// re if it is an object, or of each object element if it is an array.
+// Objects are modified in place, as by project.
+func matchKeys(result interface{}, re *regexp.Regexp) interface{} {
+	matchObject := func(v interface{}) {
+		if obj, ok := v.(map[string]interface{}); ok {
+			for key := range obj {
+				if !re.MatchString(key) {
+					delete(obj, key)
+				}
+			}
+		}
+	}
+	if a, ok := result.([]interface{}); ok {
+		for _, elem := range a {
+			matchObject(elem)
+		}
+	} else {
+		matchObject(result)
+	}
+	return result
+}
+
+// sortBy stably sorts the objects of the array result by their member
+// key, in descending order if key is prefixed with "-". Elements lacking
+// the member, or having it set to null, go last. Other results, and an
+// empty key, leave result unchanged.
+func sortBy(result interface{}, key string) interface{} {
+	a, ok := result.([]interface{})
+	if !ok || key == "" || key == "-" {
+		return result
+	}
+	desc := strings.HasPrefix(key, "-")
+	key = strings.TrimPrefix(key, "-")
+	member := func(elem interface{}) interface{} {
+		if obj, ok := elem.(map[string]interface{}); ok {
+			return obj[key]
+		}
+		return nil
+	}
+	sort.SliceStable(a, func(i, j int) bool {
+		vi, vj := member(a[i]), member(a[j])
+		if vi == nil || vj == nil {
+			return vi != nil
+		}
+		c := compareValues(vi, vj)
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	})
+	return a
+}
+
+// compareValues orders the JSON values a and b: numbers before strings
+// before booleans before arrays and objects, which compare equal.
+func compareValues(a, b interface{}) int {
+	ra, rb := sortRank(a), sortRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case bool:
+		switch {
+		case a == b.(bool):
+			return 0
+		case a:
+			return 1
+		default:
+			return -1
+		}
+	}
+	if ra == 0 {
+		fa, fb := toFloat(a), toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+	}
+	return 0
+}
+
+// sortRank returns the position of the type of v in the sort order of
+// compareValues.
+func sortRank(v interface{}) int {
+	switch v.(type) {
+	case float64, int, json.Number:
+		return 0
+	case string:
+		return 1
+	case bool:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// toFloat returns the number v as float64.
+func toFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	}
+	return 0
+}
+
+// flatten replaces array elements of the array result with their
+// elements, one level deep: [[1,[2]],3] becomes [1,[2],3]. Other results
+// are returned unchanged.
+func flatten(result interface{}) interface{} {
+	a, ok := result.([]interface{})
+	if !ok {
+		return result
+	}
+	flat := make([]interface{}, 0, len(a))
+	for _, elem := range a {
+		if inner, ok := elem.([]interface{}); ok {
+			flat = append(flat, inner...)
+		} else {
+			flat = append(flat, elem)
+		}
+	}
+	return flat
+}
+
+// distinct removes duplicate elements from the array result, keeping
+// the first occurrence of each. Scalars are compared by type and value,
+// other elements by their JSON encoding. Other results are returned
+// unchanged.
+func distinct(result interface{}) interface{} {
+	a, ok := result.([]interface{})
+	if !ok {
+		return result
+	}
+	// encoded distinguishes JSON encodings from string elements
+	type encoded string
+	seen := make(map[interface{}]struct{}, len(a))
+	unique := make([]interface{}, 0, len(a))
+	for _, elem := range a {
+		var key interface{}
+		switch elem.(type) {
+		case nil, bool, float64, string, json.Number:
+			key = elem
+		default:
+			b, err := json.Marshal(elem)
+			if err != nil {
+				unique = append(unique, elem)
+				continue
+			}
+			key = encoded(b)
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		unique = append(unique, elem)
+	}
+	return unique
+}
+
+// objectKeys returns the keys of the object result as an array, in their
+// recorded order, else sorted as in the encoded object. Array results
+// yield their indexes, other results are returned unchanged.
+func objectKeys(result interface{}, order keyOrder) interface{} {
+	switch v := result.(type) {
+	case map[string]interface{}:
+		keys := orderedKeys(v, order)
+		out := make([]interface{}, len(keys))
+		for i, key := range keys {
+			out[i] = key
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i := range v {
+			out[i] = i
+		}
+		return out
+	default:
+		return result
+	}
+}
+
+// objectValues returns the values of the object result as an array, in
+// the order of objectKeys. Other results are returned unchanged.
+func objectValues(result interface{}, order keyOrder) interface{} {
+	obj, ok := result.(map[string]interface{})
+	if !ok {
+		return result
+	}
+	keys := orderedKeys(obj, order)
+	out := make([]interface{}, len(keys))
+	for i, key := range keys {
+		out[i] = obj[key]
+	}
+	return out
+}
+
+// writeCSV encodes result as CSV if it is an array of flat objects, i.e.
+// objects whose values are all scalars. The header row holds the union
+// of the objects' keys in order of appearance; missing keys yield empty
+// cells, as does null. It reports false for other results.
+func writeCSV(result interface{}, order keyOrder) ([]byte, bool, error) {
+	rows, ok := result.([]interface{})
+	if !ok {
+		return nil, false, nil
+	}
+	var header []string
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		obj, ok := row.(map[string]interface{})
+		if !ok {
+			return nil, false, nil
+		}
+		for _, key := range orderedKeys(obj, order) {
+			if _, ok := rawScalar(obj[key]); !ok {
+				return nil, false, nil
+			}
+			if !seen[key] {
+				seen[key] = true
+				header = append(header, key)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	if err := cw.Write(header); err != nil {
+		return nil, false, err
+	}
+	record := make([]string, len(header))
+	for _, row := range rows {
+		obj := row.(map[string]interface{})
+		for i, key := range header {
+			record[i] = ""
+			if v, ok := obj[key]; ok && v != nil {
+				text, _ := rawScalar(v)
+				record[i] = string(text)
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return nil, false, err
+		}
+	}
+	cw.Flush()
+	return buf.Bytes(), true, cw.Error()
+}
+
+// jsonSeqContentType is the media type of RFC 7464 JSON text sequences.
+const jsonSeqContentType = "application/json-seq"
+
+// writeJSONSeq writes each element of result, if it is an array, or else
+// result itself as a JSON text sequence record: the record separator
+// 0x1E, compact JSON and a newline.
+func writeJSONSeq(result interface{}, order keyOrder, escapeHTML bool) ([]byte, error) {
+	elems, ok := result.([]interface{})
+	if !ok {
+		elems = []interface{}{result}
+	}
+	var buf bytes.Buffer
+	for _, elem := range elems {
+		text, err := marshalJSON(elem, order, false, escapeHTML)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(0x1E)
+		buf.Write(text)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// writeLines writes each element of result on its own line if it is an
+// array: scalars as by rawScalar, objects and arrays as compact JSON. It
+// reports false for other results.
+func writeLines(result interface{}, order keyOrder, escapeHTML bool) ([]byte, bool, error) {
+	elems, ok := result.([]interface{})
+	if !ok {
+		return nil, false, nil
+	}
+	var buf bytes.Buffer
+	for _, elem := range elems {
+		text, ok := rawScalar(elem)
+		if !ok {
+			var err error
+			if text, err = marshalJSON(elem, order, false, escapeHTML); err != nil {
+				return nil, false, err
+			}
+		}
+		buf.Write(text)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), true, nil
+}
@@ -0,0 +1,912 @@
+package jsonpathfilter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestWithStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		target string
+		want   string
+	}{
+		{"headers", ResponseFilter{WithStatus: &StatusEnvelope{Headers: []string{"etag", "X-Missing"}}}, "/?jsonpath_filter=$.a",
+			`{"status":200,"headers":{"Etag":"\"v1\""},"data":{"b":2,"z":1}}`},
+		{"no headers", ResponseFilter{WithStatus: new(StatusEnvelope)}, "/?jsonpath_filter=$.a.z",
+			`{"status":200,"headers":{},"data":1}`},
+		{"preserve order", ResponseFilter{WithStatus: new(StatusEnvelope), PreserveOrder: true}, "/?jsonpath_filter=$.a",
+			`{"status":200,"headers":{},"data":{"z":1,"b":2}}`},
+		{"empty status", ResponseFilter{WithStatus: new(StatusEnvelope), EmptyStatus: http.StatusNotFound}, "/?jsonpath_filter=$.missing",
+			`{"status":404,"headers":{},"data":null}`},
+		{"envelope", ResponseFilter{WithStatus: new(StatusEnvelope), Envelope: new(Envelope)}, "/?jsonpath_filter=$.a.b",
+			`{"status":200,"headers":{},"data":{"count":1,"result":2}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			var calls int
+			next := countingUpstream(&calls, map[string]string{"ETag": `"v1"`}, []byte(`{"a":{"z":1,"b":2}}`))
+			rr := serve(t, &m, tt.target, next)
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRaw(t *testing.T) {
+	const doc = `{"s":"a \"b\"","n":1.5,"o":{"x":1},"z":null}`
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		want        string
+	}{
+		{"string", "/?jsonpath_filter=$.s", "text/plain; charset=utf-8", `a "b"`},
+		{"number", "/?jsonpath_filter=$.n", "text/plain; charset=utf-8", "1.5"},
+		{"null", "/?jsonpath_filter=$.z", "text/plain; charset=utf-8", "null"},
+		{"object", "/?jsonpath_filter=$.o", "application/json", `{"x":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, m := range []*ResponseFilter{{Raw: true}, new(ResponseFilter)} {
+				provision(t, m)
+				target := tt.target
+				if !m.Raw {
+					target += "&raw=true"
+				}
+				rr := serve(t, m, target, respond(http.StatusOK, "application/json", doc))
+				if got := rr.Body.String(); got != tt.want {
+					t.Errorf("%s: body = %q, want %q", target, got, tt.want)
+				}
+				if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+					t.Errorf("%s: Content-Type = %q, want %q", target, got, tt.contentType)
+				}
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	const doc = `{"a":"x","b":[1,2,3]}`
+	tests := []struct {
+		name string
+		expr string
+		want string
+	}{
+		{"scalar", "$.a", `{"expression":"$.a","matches":1,"type":"string"}`},
+		{"array", "$.b", `{"expression":"$.b","matches":3,"type":"array"}`},
+		{"nothing", "$.c", `{"expression":"$.c","matches":0,"type":"none"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			rr := serve(t, m, "/?explain=true&jsonpath_filter="+tt.expr, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCount(t *testing.T) {
+	const doc = `{"a":"x","b":[1,2,3],"c":null,"d":{"e":1},"f":[]}`
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"array", "/?count=true&jsonpath_filter=$.b", `{"count":3}`},
+		{"empty array", "/?count=true&jsonpath_filter=$.f", `{"count":0}`},
+		{"filter", "/?count=true&jsonpath_filter=" + url.QueryEscape("$.b[?(@ != 2)]"), `{"count":2}`},
+		{"scalar", "/?count=true&jsonpath_filter=$.a", `{"count":1}`},
+		{"object", "/?count=true&jsonpath_filter=$.d", `{"count":1}`},
+		{"null", "/?count=true&jsonpath_filter=$.c", `{"count":0}`},
+		{"no match", "/?count=true&jsonpath_filter=$.missing", `{"count":0}`},
+		{"disabled", "/?count=false&jsonpath_filter=$.b", "[1,2,3]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", rr.Code, http.StatusOK)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShape(t *testing.T) {
+	const doc = `{"o":{"id":1,"name":"a","tags":["x"]},` +
+		`"items":[{"id":1,"name":"a"},{"id":2,"name":null,"extra":true}],` +
+		`"mixed":[1,"x"],"none":[],"s":"v","n":null}`
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"object", "/?shape=true&jsonpath_filter=$.o", `{"id":"number","name":"string","tags":["string"]}`},
+		{"array of objects", "/?shape=true&jsonpath_filter=$.items", `[{"extra":"boolean","id":"number","name":"null|string"}]`},
+		{"mixed array", "/?shape=true&jsonpath_filter=$.mixed", `["number|string"]`},
+		{"empty array", "/?shape=true&jsonpath_filter=$.none", "[]"},
+		{"scalar", "/?shape=true&jsonpath_filter=$.s", `"string"`},
+		{"null", "/?shape=true&jsonpath_filter=$.n", `"null"`},
+		{"no match", "/?shape=true&jsonpath_filter=$.missing", `"none"`},
+		{"disabled", "/?shape=false&jsonpath_filter=$.s", `"v"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", rr.Code, http.StatusOK)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	const doc = `{"a":[1,2,3],"o":{"x":1},"s":"v"}`
+	tests := []struct {
+		name     string
+		envelope *Envelope
+		target   string
+		want     string
+	}{
+		{"array", new(Envelope), "/?jsonpath_filter=$.a", `{"count":3,"result":[1,2,3]}`},
+		{"object", new(Envelope), "/?jsonpath_filter=$.o", `{"count":1,"result":{"x":1}}`},
+		{"scalar", new(Envelope), "/?jsonpath_filter=$.s", `{"count":1,"result":"v"}`},
+		{"keys", &Envelope{ResultKey: "data", CountKey: "n"}, "/?jsonpath_filter=$.a", `{"data":[1,2,3],"n":3}`},
+		{"off", nil, "/?jsonpath_filter=$.a", `[1,2,3]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Envelope: tt.envelope}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArrayEnvelope(t *testing.T) {
+	const doc = `{"a":[1,2,3],"o":{"x":1},"s":"v","e":[]}`
+	tests := []struct {
+		name     string
+		envelope *ArrayEnvelope
+		target   string
+		want     string
+	}{
+		{"array", new(ArrayEnvelope), "/?jsonpath_filter=$.a", `{"data":[1,2,3],"total":3}`},
+		{"empty array", new(ArrayEnvelope), "/?jsonpath_filter=$.e", `{"data":[],"total":0}`},
+		{"object", new(ArrayEnvelope), "/?jsonpath_filter=$.o", `{"x":1}`},
+		{"scalar", new(ArrayEnvelope), "/?jsonpath_filter=$.s", `"v"`},
+		{"paginated", new(ArrayEnvelope), "/?jsonpath_filter=$.a&offset=1&limit=1", `{"data":[2],"total":3}`},
+		{"keys", &ArrayEnvelope{DataKey: "items", TotalKey: "n"}, "/?jsonpath_filter=$.a", `{"items":[1,2,3],"n":3}`},
+		{"off", nil, "/?jsonpath_filter=$.a", `[1,2,3]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{ArrayEnvelope: tt.envelope, Paginate: true}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	const doc = `{"user":{"name":"ann","roles":["a","b"]}}`
+	tests := []struct {
+		name     string
+		template string
+		onError  string
+		target   string
+		status   int
+		want     string
+	}{
+		{"reshape", `{"name":{{json .name}},"first_role":{{json (index .roles 0)}}}`, "", "/?jsonpath_filter=$.user",
+			http.StatusOK, `{"name":"ann","first_role":"a"}`},
+		{"scalar", `[{{json .}}]`, "", "/?jsonpath_filter=$.user.name", http.StatusOK, `["ann"]`},
+		{"explain skips template", `{{json .name}}`, "", "/?jsonpath_filter=$.user.name&explain=true",
+			http.StatusOK, `{"expression":"$.user.name","matches":1,"type":"string"}`},
+		{"execution error", `{{template "missing"}}`, "", "/?jsonpath_filter=$.user", http.StatusBadRequest, ""},
+		{"execution error empty", `{{template "missing"}}`, "empty", "/?jsonpath_filter=$.user", http.StatusOK, "null"},
+		{"execution error passthrough", `{{template "missing"}}`, "passthrough", "/?jsonpath_filter=$.user", http.StatusOK, doc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Template: tt.template, OnError: tt.onError}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	m := &ResponseFilter{Template: "{{"}
+	if err := m.Provision(ctx); err == nil || !strings.HasPrefix(err.Error(), "parsing template") {
+		t.Errorf("Provision with unparsable template = %v, want parsing error", err)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	const doc = `{"a":[1,2,3,4,5],"o":{"x":1}}`
+	tests := []struct {
+		name     string
+		paginate bool
+		target   string
+		status   int
+		want     string
+	}{
+		{"window", true, "/?jsonpath_filter=$.a&offset=1&limit=2", http.StatusOK, "[2,3]"},
+		{"offset only", true, "/?jsonpath_filter=$.a&offset=3", http.StatusOK, "[4,5]"},
+		{"offset beyond length", true, "/?jsonpath_filter=$.a&offset=9", http.StatusOK, "[]"},
+		{"zero limit", true, "/?jsonpath_filter=$.a&limit=0", http.StatusOK, "[]"},
+		{"limit beyond length", true, "/?jsonpath_filter=$.a&offset=2&limit=10", http.StatusOK, "[3,4,5]"},
+		{"object ignored", true, "/?jsonpath_filter=$.o&offset=1&limit=1", http.StatusOK, `{"x":1}`},
+		{"invalid offset", true, "/?jsonpath_filter=$.a&offset=-1", http.StatusBadRequest, ""},
+		{"invalid limit", true, "/?jsonpath_filter=$.a&limit=x", http.StatusBadRequest, ""},
+		{"disabled", false, "/?jsonpath_filter=$.a&offset=1&limit=2", http.StatusOK, "[1,2,3,4,5]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Paginate: tt.paginate}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTotalCount(t *testing.T) {
+	const doc = `{"a":[1,2,3,4,5],"o":{"x":1}}`
+	tests := []struct {
+		name       string
+		totalCount bool
+		target     string
+		want       string
+	}{
+		{"array", true, "/?jsonpath_filter=$.a", "5"},
+		{"window", true, "/?jsonpath_filter=$.a&offset=1&limit=2", "5"},
+		{"offset beyond length", true, "/?jsonpath_filter=$.a&offset=9", "5"},
+		{"object", true, "/?jsonpath_filter=$.o", ""},
+		{"disabled", false, "/?jsonpath_filter=$.a", "upstream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{TotalCount: tt.totalCount, Paginate: true}
+			provision(t, m)
+			var calls int
+			next := countingUpstream(&calls, map[string]string{"X-Total-Count": "upstream"}, []byte(doc))
+			rr := serve(t, m, tt.target, next)
+			if got := rr.Header().Get("X-Total-Count"); got != tt.want {
+				t.Errorf("X-Total-Count = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	const doc = `{"o":{"a":1,"b":{"c":2,"d":3}},"l":[{"a":1},2],"s":"x"}`
+	const patch = `{"_filtered":true,"a":null,"b":{"d":null,"e":4}}`
+	tests := []struct {
+		name     string
+		elements bool
+		target   string
+		want     string
+	}{
+		{"object", false, "/?jsonpath_filter=$.o", `{"_filtered":true,"b":{"c":2,"e":4}}`},
+		{"array skipped", false, "/?jsonpath_filter=$.l", `[{"a":1},2]`},
+		{"array elements", true, "/?jsonpath_filter=$.l", `[{"_filtered":true,"b":{"e":4}},2]`},
+		{"scalar skipped", true, "/?jsonpath_filter=$.s", `"x"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Merge: &Merge{Patch: []byte(patch), Elements: tt.elements}}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	m := &ResponseFilter{Merge: &Merge{Patch: []byte(`[1]`)}}
+	if err := m.Provision(ctx); err == nil || err.Error() != "merge patch must be a JSON object" {
+		t.Errorf("Provision with array patch = %v, want merge patch error", err)
+	}
+}
+
+func TestFields(t *testing.T) {
+	const doc = `{"id":1,"name":"ann","email":"a@example.com","items":[{"id":2,"name":"x","price":3},4]}`
+	tests := []struct {
+		name        string
+		fieldsParam string
+		target      string
+		want        string
+	}{
+		{"object", "fields", "/?fields=id,%20name", `{"id":1,"name":"ann"}`},
+		{"array elements", "fields", "/?jsonpath_filter=$.items&fields=name,price", `[{"name":"x","price":3},4]`},
+		{"after filter", "fields", "/?jsonpath_filter=$.items[0]&fields=id", `{"id":2}`},
+		{"unknown field", "fields", "/?fields=missing", `{}`},
+		{"empty list", "fields", "/?jsonpath_filter=$.id&fields=,", "1"},
+		{"custom name", "keep", "/?keep=email", `{"email":"a@example.com"}`},
+		{"disabled", "", "/?jsonpath_filter=$.id&fields=name", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{FieldsParam: tt.fieldsParam}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyPattern(t *testing.T) {
+	const doc = `{"id":1,"meta_a":2,"meta_b":3,"items":[{"meta_c":4,"x":5},6]}`
+	tests := []struct {
+		name    string
+		pattern string
+		param   string
+		target  string
+		status  int
+		want    string
+	}{
+		{"matching", "^meta_", "", "/", http.StatusOK, `{"meta_a":2,"meta_b":3}`},
+		{"matching nothing", "^none$", "", "/", http.StatusOK, `{}`},
+		{"array elements", "^meta_", "", "/?jsonpath_filter=$.items", http.StatusOK, `[{"meta_c":4},6]`},
+		{"scalar", "^meta_", "", "/?jsonpath_filter=$.id", http.StatusOK, "1"},
+		{"query", "", "key_pattern", "/?key_pattern=" + url.QueryEscape("^(id|meta_b)$"), http.StatusOK, `{"id":1,"meta_b":3}`},
+		{"query overrides config", "^meta_", "key_pattern", "/?key_pattern=^id$", http.StatusOK, `{"id":1}`},
+		{"config without query", "^meta_a$", "key_pattern", "/", http.StatusOK, `{"meta_a":2}`},
+		{"invalid query", "", "key_pattern", "/?key_pattern=" + url.QueryEscape("("), http.StatusBadRequest, ""},
+		{"query disabled", "", "", "/?key_pattern=^id$", http.StatusOK, doc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{KeyPattern: tt.pattern, KeyPatternParam: tt.param}
+			provision(t, m)
+			for i := 0; i < 2; i++ {
+				rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+				if rr.Code != tt.status {
+					t.Errorf("status = %d, want %d", rr.Code, tt.status)
+				}
+				if got := rr.Body.String(); tt.want != "" && got != tt.want {
+					t.Errorf("body = %s, want %s", got, tt.want)
+				}
+			}
+		})
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	m := &ResponseFilter{KeyPattern: "("}
+	if err := m.Provision(ctx); err == nil || !strings.HasPrefix(err.Error(), "compiling key_pattern") {
+		t.Errorf("Provision with invalid key_pattern = %v, want compile error", err)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	const doc = `{"items":[{"prices":[1,2]},{"prices":[3,[4,5]]},{"prices":6}],"o":{"x":[1]}}`
+	tests := []struct {
+		name    string
+		flatten bool
+		target  string
+		want    string
+	}{
+		{"nested", true, "/?jsonpath_filter=$.items[*].prices", "[1,2,3,[4,5],6]"},
+		{"not nested", true, "/?jsonpath_filter=$.items[0].prices", "[1,2]"},
+		{"object", true, "/?jsonpath_filter=$.o", `{"x":[1]}`},
+		{"disabled", false, "/?jsonpath_filter=$.items[*].prices", "[[1,2],[3,[4,5]],6]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Flatten: tt.flatten}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputContentType(t *testing.T) {
+	const doc = `{"a":{"b":1},"s":"x"}`
+	tests := []struct {
+		name        string
+		m           ResponseFilter
+		target      string
+		contentType string
+	}{
+		{"default", ResponseFilter{}, "/?jsonpath_filter=$.a", "application/json"},
+		{"configured", ResponseFilter{OutputContentType: "application/vnd.example+json; charset=utf-8"}, "/?jsonpath_filter=$.a",
+			"application/vnd.example+json; charset=utf-8"},
+		{"template", ResponseFilter{OutputContentType: "application/vnd.example+json", Template: "{{json .}}"}, "/?jsonpath_filter=$.a",
+			"application/vnd.example+json"},
+		{"raw keeps text", ResponseFilter{OutputContentType: "application/vnd.example+json"}, "/?jsonpath_filter=$.s&raw=true",
+			"text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+		})
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	m := &ResponseFilter{OutputContentType: "application/json; charset"}
+	if err := m.Provision(ctx); err == nil || !strings.HasPrefix(err.Error(), "invalid output_content_type") {
+		t.Errorf("Provision with malformed media type = %v, want invalid output_content_type", err)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	const doc = `{"uniform":[{"id":1,"name":"a, b"},{"id":2,"name":"say \"hi\""}],` +
+		`"ragged":[{"id":1,"name":"x"},{"id":2,"extra":true},{"name":null}],"nested":[{"id":{"x":1}}],"o":{"id":1}}`
+	tests := []struct {
+		name        string
+		m           ResponseFilter
+		target      string
+		status      int
+		contentType string
+		want        string
+	}{
+		{"uniform", ResponseFilter{Format: "csv"}, "/?jsonpath_filter=$.uniform", http.StatusOK, "text/csv; charset=utf-8",
+			"id,name\n1,\"a, b\"\n2,\"say \"\"hi\"\"\"\n"},
+		{"ragged", ResponseFilter{Format: "csv", PreserveOrder: true}, "/?jsonpath_filter=$.ragged", http.StatusOK, "text/csv; charset=utf-8",
+			"id,name,extra\n1,x,\n2,,true\n,,\n"},
+		{"query parameter", ResponseFilter{}, "/?jsonpath_filter=$.uniform&format=csv", http.StatusOK, "text/csv; charset=utf-8",
+			"id,name\n1,\"a, b\"\n2,\"say \"\"hi\"\"\"\n"},
+		{"query parameter json", ResponseFilter{Format: "csv"}, "/?jsonpath_filter=$.o&format=json", http.StatusOK, "application/json", `{"id":1}`},
+		{"nested falls back", ResponseFilter{Format: "csv"}, "/?jsonpath_filter=$.nested", http.StatusOK, "application/json", `[{"id":{"x":1}}]`},
+		{"object falls back", ResponseFilter{Format: "csv"}, "/?jsonpath_filter=$.o", http.StatusOK, "application/json", `{"id":1}`},
+		{"strict", ResponseFilter{Format: "csv", StrictFormat: true}, "/?jsonpath_filter=$.o", http.StatusNotAcceptable, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirst(t *testing.T) {
+	const doc = `{"items":[{"id":1,"active":false},{"id":2,"active":true},{"id":3,"active":true}],"o":{"id":1}}`
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		target string
+		status int
+		want   string
+	}{
+		{"non-empty array", ResponseFilter{First: true}, "/?jsonpath_filter=" + url.QueryEscape(`$.items[?(@.active)]`), http.StatusOK, `{"active":true,"id":2}`},
+		{"empty array", ResponseFilter{First: true}, "/?jsonpath_filter=" + url.QueryEscape(`$.items[?(@.id == 9)]`), http.StatusOK, "null"},
+		{"empty array status", ResponseFilter{First: true, EmptyStatus: http.StatusNotFound}, "/?jsonpath_filter=" + url.QueryEscape(`$.items[?(@.id == 9)]`), http.StatusNotFound, "null"},
+		{"object", ResponseFilter{First: true}, "/?jsonpath_filter=$.o", http.StatusOK, `{"id":1}`},
+		{"scalar", ResponseFilter{First: true}, "/?jsonpath_filter=$.o.id", http.StatusOK, "1"},
+		{"query flag", ResponseFilter{}, "/?jsonpath_filter=$.items[*].id&first=true", http.StatusOK, "1"},
+		{"disabled", ResponseFilter{}, "/?jsonpath_filter=$.items[*].id", http.StatusOK, "[1,2,3]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLast(t *testing.T) {
+	const doc = `{"items":[{"id":1,"active":true},{"id":2,"active":true},{"id":3,"active":false}],"o":{"id":1}}`
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		target string
+		status int
+		want   string
+	}{
+		{"non-empty array", ResponseFilter{Last: true}, "/?jsonpath_filter=" + url.QueryEscape(`$.items[?(@.active)]`), http.StatusOK, `{"active":true,"id":2}`},
+		{"empty array", ResponseFilter{Last: true}, "/?jsonpath_filter=" + url.QueryEscape(`$.items[?(@.id == 9)]`), http.StatusOK, "null"},
+		{"object", ResponseFilter{Last: true}, "/?jsonpath_filter=$.o", http.StatusOK, `{"id":1}`},
+		{"query flag", ResponseFilter{}, "/?jsonpath_filter=$.items[*].id&last=true", http.StatusOK, "3"},
+		{"both flags", ResponseFilter{}, "/?jsonpath_filter=$.items[*].id&first=true&last=true", http.StatusBadRequest, ""},
+		{"flag with first configured", ResponseFilter{First: true}, "/?jsonpath_filter=$.items[*].id&last=true", http.StatusBadRequest, ""},
+		{"disabled", ResponseFilter{}, "/?jsonpath_filter=$.items[*].id", http.StatusOK, "[1,2,3]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	const doc = `{"items":[{"category":"b","tags":["x"]},{"category":"a","tags":["x"]},{"category":"b","tags":["y"]}],` +
+		`"mixed":[1,"1",1,true,null,true,null,"1"],"objects":[{"a":1,"b":2},{"b":2,"a":1},{"a":2},{"a":1,"b":2}],"o":{"a":1}}`
+	tests := []struct {
+		name     string
+		distinct bool
+		target   string
+		want     string
+	}{
+		{"scalars", true, "/?jsonpath_filter=$.items[*].category", `["b","a"]`},
+		{"mixed scalars", true, "/?jsonpath_filter=$.mixed", `[1,"1",true,null]`},
+		{"objects", true, "/?jsonpath_filter=$.objects", `[{"a":1,"b":2},{"a":2}]`},
+		{"arrays", true, "/?jsonpath_filter=$.items[*].tags", `[["x"],["y"]]`},
+		{"object result", true, "/?jsonpath_filter=$.o", `{"a":1}`},
+		{"query flag", false, "/?jsonpath_filter=$.items[*].category&distinct=true", `["b","a"]`},
+		{"disabled", false, "/?jsonpath_filter=$.items[*].category", `["b","a","b"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Distinct: tt.distinct}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	const doc = `{"items":[{"id":1,"category":"books"},{"id":2,"category":"games"},{"id":3},{"id":4,"category":"books"},` +
+		`{"id":5,"category":null},{"id":6,"category":2},7],"o":{"category":"books"}}`
+	tests := []struct {
+		name    string
+		groupBy *GroupBy
+		target  string
+		want    string
+	}{
+		{"groups", &GroupBy{Field: "category"}, "/?jsonpath_filter=$.items[0:4]",
+			`{"_none":[{"id":3}],"books":[{"category":"books","id":1},{"category":"books","id":4}],"games":[{"category":"games","id":2}]}`},
+		{"null, numbers and non-objects", &GroupBy{Field: "category"}, "/?jsonpath_filter=$.items[4:]",
+			`{"2":[{"category":2,"id":6}],"_none":[{"category":null,"id":5},7]}`},
+		{"missing key", &GroupBy{Field: "category", MissingKey: "other"}, "/?jsonpath_filter=$.items[2:4]",
+			`{"books":[{"category":"books","id":4}],"other":[{"id":3}]}`},
+		{"empty array", &GroupBy{Field: "category"}, "/?jsonpath_filter=" + url.QueryEscape(`$.items[?(@.id == 9)]`), `{}`},
+		{"object", &GroupBy{Field: "category"}, "/?jsonpath_filter=$.o", `{"category":"books"}`},
+		{"disabled", nil, "/?jsonpath_filter=$.items[0:2].id", `[1,2]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{GroupBy: tt.groupBy}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeysValuesOnly(t *testing.T) {
+	const doc = `{"o":{"z":1,"a":[2],"m":{"x":3}},"l":["a","b"],"s":"x"}`
+	tests := []struct {
+		name     string
+		preserve bool
+		target   string
+		status   int
+		want     string
+	}{
+		{"object keys", false, "/?jsonpath_filter=$.o&keys_only=true", http.StatusOK, `["a","m","z"]`},
+		{"object values", false, "/?jsonpath_filter=$.o&values_only=true", http.StatusOK, `[[2],{"x":3},1]`},
+		{"ordered keys", true, "/?jsonpath_filter=$.o&keys_only=true", http.StatusOK, `["z","a","m"]`},
+		{"ordered values", true, "/?jsonpath_filter=$.o&values_only=true", http.StatusOK, `[1,[2],{"x":3}]`},
+		{"array keys", false, "/?jsonpath_filter=$.l&keys_only=true", http.StatusOK, "[0,1]"},
+		{"array values", false, "/?jsonpath_filter=$.l&values_only=true", http.StatusOK, `["a","b"]`},
+		{"scalar", false, "/?jsonpath_filter=$.s&keys_only=true", http.StatusOK, `"x"`},
+		{"both", false, "/?jsonpath_filter=$.o&keys_only=true&values_only=true", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{PreserveOrder: tt.preserve}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSort(t *testing.T) {
+	const doc = `{"items":[{"name":"b","n":10},{"name":"a","n":9},{"n":1},{"name":"c","n":null},{"name":2}],"o":{"name":"x"}}`
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"ascending", "/?jsonpath_filter=$.items[0:2]&sort=name", `[{"n":9,"name":"a"},{"n":10,"name":"b"}]`},
+		{"descending", "/?jsonpath_filter=$.items[0:2]&sort=-name", `[{"n":10,"name":"b"},{"n":9,"name":"a"}]`},
+		{"numeric", "/?jsonpath_filter=$.items[0:3]&sort=n", `[{"n":1},{"n":9,"name":"a"},{"n":10,"name":"b"}]`},
+		{"missing last", "/?jsonpath_filter=$.items&sort=n", `[{"n":1},{"n":9,"name":"a"},{"n":10,"name":"b"},{"n":null,"name":"c"},{"name":2}]`},
+		{"missing last descending", "/?jsonpath_filter=$.items&sort=-n", `[{"n":10,"name":"b"},{"n":9,"name":"a"},{"n":1},{"n":null,"name":"c"},{"name":2}]`},
+		{"numbers before strings", "/?jsonpath_filter=$.items&sort=name", `[{"name":2},{"n":9,"name":"a"},{"n":10,"name":"b"},{"n":null,"name":"c"},{"n":1}]`},
+		{"object ignored", "/?jsonpath_filter=$.o&sort=name", `{"name":"x"}`},
+		{"no parameter", "/?jsonpath_filter=$.items[0:2]", `[{"n":10,"name":"b"},{"n":9,"name":"a"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{SortParam: "sort"}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONP(t *testing.T) {
+	const doc = `{"a":{"b":1}}`
+	tests := []struct {
+		name        string
+		jsonpParam  string
+		target      string
+		status      int
+		contentType string
+		want        string
+	}{
+		{"valid callback", "callback", "/?jsonpath_filter=$.a&callback=render", http.StatusOK,
+			"application/javascript; charset=utf-8", `render({"b":1});`},
+		{"dotted callback", "callback", "/?jsonpath_filter=$.a&callback=app.$render_1", http.StatusOK,
+			"application/javascript; charset=utf-8", `app.$render_1({"b":1});`},
+		{"custom parameter", "cb", "/?jsonpath_filter=$.a&cb=render", http.StatusOK,
+			"application/javascript; charset=utf-8", `render({"b":1});`},
+		{"no callback", "callback", "/?jsonpath_filter=$.a", http.StatusOK, "application/json", `{"b":1}`},
+		{"invalid callback", "callback", "/?jsonpath_filter=$.a&callback=" + url.QueryEscape("alert(1);x"), http.StatusBadRequest, "", ""},
+		{"leading digit", "callback", "/?jsonpath_filter=$.a&callback=1x", http.StatusBadRequest, "", ""},
+		{"too long", "callback", "/?jsonpath_filter=$.a&callback=" + strings.Repeat("x", 129), http.StatusBadRequest, "", ""},
+		{"disabled", "", "/?jsonpath_filter=$.a&callback=render", http.StatusOK, "application/json", `{"b":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{JSONPParam: tt.jsonpParam}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+			if strings.HasPrefix(tt.contentType, "application/javascript") && rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+				t.Error("JSONP response lacks X-Content-Type-Options: nosniff")
+			}
+		})
+	}
+}
+
+func TestMaxMatches(t *testing.T) {
+	const doc = `{"a":[1,2,3],"b":[1,2]}`
+	tests := []struct {
+		name      string
+		reject    bool
+		target    string
+		status    int
+		want      string
+		truncated string
+	}{
+		{"truncated", false, "/?jsonpath_filter=$.a", http.StatusOK, "[1,2]", "true"},
+		{"at limit", false, "/?jsonpath_filter=$.b", http.StatusOK, "[1,2]", ""},
+		{"rejected", true, "/?jsonpath_filter=$.a", http.StatusBadRequest, "", ""},
+		{"at limit with reject", true, "/?jsonpath_filter=$.b", http.StatusOK, "[1,2]", ""},
+		{"before pagination", false, "/?jsonpath_filter=$.a&offset=1", http.StatusOK, "[2]", "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{MaxMatches: 2, RejectExcessMatches: tt.reject, Paginate: true}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+			if got := rr.Header().Get("X-Truncated"); got != tt.truncated {
+				t.Errorf("X-Truncated = %q, want %q", got, tt.truncated)
+			}
+		})
+	}
+}
+
+func TestLines(t *testing.T) {
+	const doc = `{"ids":[1,2.5,"a b",true,null],"objects":[{"id":1},[2,3]],"o":{"id":1}}`
+	tests := []struct {
+		name        string
+		m           ResponseFilter
+		target      string
+		status      int
+		contentType string
+		want        string
+	}{
+		{"scalars", ResponseFilter{Format: "lines"}, "/?jsonpath_filter=$.ids", http.StatusOK, "text/plain; charset=utf-8", "1\n2.5\na b\ntrue\nnull\n"},
+		{"objects", ResponseFilter{Format: "lines"}, "/?jsonpath_filter=$.objects", http.StatusOK, "text/plain; charset=utf-8", "{\"id\":1}\n[2,3]\n"},
+		{"query parameter", ResponseFilter{}, "/?jsonpath_filter=$.ids[0:2]&format=lines", http.StatusOK, "text/plain; charset=utf-8", "1\n2.5\n"},
+		{"empty array", ResponseFilter{Format: "lines"}, "/?jsonpath_filter=$.ids[9:]", http.StatusOK, "text/plain; charset=utf-8", ""},
+		{"object falls back", ResponseFilter{Format: "lines"}, "/?jsonpath_filter=$.o", http.StatusOK, "application/json", `{"id":1}`},
+		{"strict", ResponseFilter{Format: "lines", StrictFormat: true}, "/?jsonpath_filter=$.o", http.StatusNotAcceptable, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONSeq(t *testing.T) {
+	const doc = `{"ids":[1,"a\nb",null],"objects":[{"id":1},[2,3]],"o":{"z":1,"a":2},"html":["<b>"]}`
+	tests := []struct {
+		name   string
+		m      ResponseFilter
+		target string
+		want   string
+	}{
+		{"scalars", ResponseFilter{Format: "json-seq"}, "/?jsonpath_filter=$.ids", "\x1e1\n\x1e\"a\\nb\"\n\x1enull\n"},
+		{"objects", ResponseFilter{Format: "json-seq"}, "/?jsonpath_filter=$.objects", "\x1e{\"id\":1}\n\x1e[2,3]\n"},
+		{"object", ResponseFilter{Format: "json-seq"}, "/?jsonpath_filter=$.o", "\x1e{\"a\":2,\"z\":1}\n"},
+		{"preserve order", ResponseFilter{Format: "json-seq", PreserveOrder: true}, "/?jsonpath_filter=$.o", "\x1e{\"z\":1,\"a\":2}\n"},
+		{"escape html", ResponseFilter{Format: "json-seq"}, "/?jsonpath_filter=$.html", "\x1e\"\\u003cb\\u003e\"\n"},
+		{"empty array", ResponseFilter{Format: "json-seq"}, "/?jsonpath_filter=$.ids[9:]", ""},
+		{"query parameter", ResponseFilter{}, "/?jsonpath_filter=$.ids[0:1]&format=json-seq", "\x1e1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			provision(t, &m)
+			rr := serve(t, &m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Header().Get("Content-Type"); got != "application/json-seq" {
+				t.Errorf("Content-Type = %q, want %q", got, "application/json-seq")
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeItems(t *testing.T) {
+	const doc = `{"a":[1,2,3,4,5],"o":{"x":1}}`
+	tests := []struct {
+		name         string
+		rangeItems   bool
+		expr         string
+		rng          string
+		status       int
+		contentRange string
+		acceptRanges string
+		want         string
+	}{
+		{"valid range", true, "$.a", "items=0-1", http.StatusPartialContent, "items 0-1/5", "items", "[1,2]"},
+		{"open range", true, "$.a", "items=3-", http.StatusPartialContent, "items 3-4/5", "items", "[4,5]"},
+		{"range past the end", true, "$.a", "items=2-99", http.StatusPartialContent, "items 2-4/5", "items", "[3,4,5]"},
+		{"unsatisfiable", true, "$.a", "items=5-9", http.StatusRequestedRangeNotSatisfiable, "items */5", "", ""},
+		{"non-array result", true, "$.o", "items=0-1", http.StatusOK, "", "", `{"x":1}`},
+		{"no range", true, "$.a", "", http.StatusOK, "", "items", "[1,2,3,4,5]"},
+		{"malformed", true, "$.a", "items=a-b", http.StatusOK, "", "items", "[1,2,3,4,5]"},
+		{"reversed", true, "$.a", "items=3-1", http.StatusOK, "", "items", "[1,2,3,4,5]"},
+		{"multiple ranges", true, "$.a", "items=0-1,3-4", http.StatusOK, "", "items", "[1,2,3,4,5]"},
+		{"other unit", true, "$.a", "bytes=0-1", http.StatusOK, "", "items", "[1,2,3,4,5]"},
+		{"disabled", false, "$.a", "items=0-1", http.StatusOK, "", "", "[1,2,3,4,5]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{RangeItems: tt.rangeItems}
+			provision(t, m)
+			req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter="+url.QueryEscape(tt.expr), nil)
+			if tt.rng != "" {
+				req.Header.Set("Range", tt.rng)
+			}
+			rr := serveRequest(t, m, req, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+			if got := rr.Header().Get("Accept-Ranges"); got != tt.acceptRanges {
+				t.Errorf("Accept-Ranges = %q, want %q", got, tt.acceptRanges)
+			}
+			if tt.want != "" && rr.Body.String() != tt.want {
+				t.Errorf("body = %s, want %s", rr.Body, tt.want)
+			}
+		})
+	}
+}
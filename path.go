@@ -0,0 +1,485 @@
+package jsonpathfilter
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/PaesslerAG/jsonpath"
+)
+
+// segmentKind identifies the selector of a path segment.
+type segmentKind int
+
+const (
+	segKey      segmentKind = iota // .name or ['name']
+	segIndex                       // [n]
+	segWildcard                    // .* or [*]
+	segFilter                      // [?(predicate)]
+)
+
+// segment is one step of a parsed JSONPath.
+type segment struct {
+	kind segmentKind
+
+	// recursive is set for segments preceded by "..", which match at any
+	// depth below the current node.
+	recursive bool
+
+	key   string
+	index int
+
+	// filter is the predicate of a segFilter, compiled as "$[?(...)]" so
+	// that it can be evaluated against a single candidate wrapped in an
+	// array.
+	filter gval.Evaluable
+}
+
+// parsePath parses the subset of JSONPath that can be resolved to
+// concrete locations in a document: child and recursive descent by name,
+// index, wildcard and filter predicate. Slices and unions are not
+// supported.
+func parsePath(expr string) ([]segment, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("path must start with $")
+	}
+	var segs []segment
+	s := expr[1:]
+	for len(s) > 0 {
+		var seg segment
+		switch {
+		case strings.HasPrefix(s, ".."):
+			seg.recursive = true
+			s = s[2:]
+			if strings.HasPrefix(s, "[") {
+				break
+			}
+			fallthrough
+		case s[0] == '.':
+			if !seg.recursive {
+				s = s[1:]
+			}
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			name := s[:end]
+			s = s[end:]
+			switch name {
+			case "":
+				return nil, fmt.Errorf("missing name in %q", expr)
+			case "*":
+				seg.kind = segWildcard
+			default:
+				seg.kind, seg.key = segKey, name
+			}
+			segs = append(segs, seg)
+			continue
+		case s[0] != '[':
+			return nil, fmt.Errorf("unexpected %q in %q", s[0], expr)
+		}
+
+		// bracket notation
+		end, err := closingBracket(s)
+		if err != nil {
+			return nil, fmt.Errorf("%v in %q", err, expr)
+		}
+		inner := strings.TrimSpace(s[1:end])
+		s = s[end+1:]
+		switch {
+		case inner == "*":
+			seg.kind = segWildcard
+		case strings.HasPrefix(inner, "?(") && strings.HasSuffix(inner, ")"):
+			seg.kind = segFilter
+			seg.filter, err = jsonpath.New("$[" + inner + "]")
+			if err != nil {
+				return nil, err
+			}
+		case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+			seg.kind, seg.key = segKey, inner[1:len(inner)-1]
+		default:
+			n, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("unsupported selector [%s] in %q", inner, expr)
+			}
+			seg.kind, seg.index = segIndex, n
+		}
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// closingBracket returns the index of the "]" closing the bracket that
+// s starts with, skipping over quoted strings and nested brackets.
+func closingBracket(s string) (int, error) {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unterminated bracket")
+}
+
+// location is a matched node, identified by its parent container and its
+// key (string) or index (int) within that container.
+type location struct {
+	parent interface{}
+	key    interface{}
+}
+
+// resolvePath calls visit for every location in doc matched by segs.
+func resolvePath(ctx context.Context, doc interface{}, segs []segment, visit func(location)) {
+	if len(segs) == 0 {
+		return
+	}
+	seg, rest := segs[0], segs[1:]
+	candidates := []interface{}{doc}
+	if seg.recursive {
+		candidates = descendants(doc, candidates)
+	}
+	for _, node := range candidates {
+		forEachChild(ctx, node, seg, func(loc location, child interface{}) {
+			if len(rest) == 0 {
+				visit(loc)
+				return
+			}
+			resolvePath(ctx, child, rest, visit)
+		})
+	}
+}
+
+// descendants appends every container nested in v to acc.
+func descendants(v interface{}, acc []interface{}) []interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, child := range v {
+			if isContainer(child) {
+				acc = append(acc, child)
+				acc = descendants(child, acc)
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if isContainer(child) {
+				acc = append(acc, child)
+				acc = descendants(child, acc)
+			}
+		}
+	}
+	return acc
+}
+
+func isContainer(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return true
+	}
+	return false
+}
+
+// forEachChild calls fn for every child of node selected by seg.
+func forEachChild(ctx context.Context, node interface{}, seg segment, fn func(location, interface{})) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		switch seg.kind {
+		case segKey:
+			if child, ok := n[seg.key]; ok {
+				fn(location{n, seg.key}, child)
+			}
+		case segWildcard, segFilter:
+			keys := make([]string, 0, len(n))
+			for k := range n {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if seg.kind == segWildcard || matchesFilter(ctx, seg.filter, n[k]) {
+					fn(location{n, k}, n[k])
+				}
+			}
+		}
+	case []interface{}:
+		switch seg.kind {
+		case segIndex:
+			i := seg.index
+			if i < 0 {
+				i += len(n)
+			}
+			if i >= 0 && i < len(n) {
+				fn(location{n, i}, n[i])
+			}
+		case segWildcard, segFilter:
+			for i, child := range n {
+				if seg.kind == segWildcard || matchesFilter(ctx, seg.filter, child) {
+					fn(location{n, i}, child)
+				}
+			}
+		}
+	}
+}
+
+// matchesFilter reports whether v satisfies the compiled filter.
+func matchesFilter(ctx context.Context, filter gval.Evaluable, v interface{}) bool {
+	result, err := filter(ctx, []interface{}{v})
+	if err != nil {
+		return false
+	}
+	matches, ok := result.([]interface{})
+	return ok && len(matches) > 0
+}
+
+// removePaths deletes every node matched by any of paths from doc and
+// returns the resulting document.
+func removePaths(ctx context.Context, doc interface{}, paths [][]segment) interface{} {
+	// Collect all matches first so that removals don't shift the indexes
+	// of later matches.
+	drop := make(map[uintptr]map[int]bool)
+	for _, segs := range paths {
+		resolvePath(ctx, doc, segs, func(loc location) {
+			switch parent := loc.parent.(type) {
+			case map[string]interface{}:
+				delete(parent, loc.key.(string))
+			case []interface{}:
+				ptr := reflect.ValueOf(parent).Pointer()
+				if drop[ptr] == nil {
+					drop[ptr] = make(map[int]bool)
+				}
+				drop[ptr][loc.key.(int)] = true
+			}
+		})
+	}
+	if len(drop) == 0 {
+		return doc
+	}
+	return dropIndexes(doc, drop)
+}
+
+// removeKeys deletes the given keys from every object in v, in place.
+func removeKeys(v interface{}, keys map[string]struct{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if _, ok := keys[k]; ok {
+				delete(v, k)
+				continue
+			}
+			removeKeys(child, keys)
+		}
+	case []interface{}:
+		for _, child := range v {
+			removeKeys(child, keys)
+		}
+	}
+}
+
+// dropIndexes rebuilds the arrays in v, leaving out the elements marked in
+// drop, which is keyed by the arrays' data pointers.
+func dropIndexes(v interface{}, drop map[uintptr]map[int]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = dropIndexes(child, drop)
+		}
+		return v
+	case []interface{}:
+		marked := drop[reflect.ValueOf(v).Pointer()]
+		kept := v[:0:0]
+		for i, child := range v {
+			if !marked[i] {
+				kept = append(kept, dropIndexes(child, drop))
+			}
+		}
+		return kept
+	default:
+		return v
+	}
+}
+
+// hasPathPrefix reports whether the JSONPath expr starts with the
+// segments of one of prefixes, as parsed by parsePath, so that it only
+// selects within what the prefix selects. expr must parse and must not
+// refer to the root other than at its start, as filters could otherwise
+// test values outside the prefix.
+func hasPathPrefix(expr string, prefixes [][]segment) bool {
+	if len(prefixes) == 0 || refersToRoot(expr) {
+		return false
+	}
+	segs, err := parsePath(expr)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if len(segs) < len(prefix) {
+			continue
+		}
+		matched := true
+		for i, seg := range prefix {
+			got := segs[i]
+			if got.kind != seg.kind || got.recursive != seg.recursive || got.key != seg.key || got.index != seg.index {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// refersToRoot reports whether expr contains $ outside string literals
+// anywhere but at its start.
+func refersToRoot(expr string) bool {
+	var quote byte
+	escaped := false
+	for i := 1; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '$':
+			return true
+		}
+	}
+	return false
+}
+
+// hasRecursiveDescent reports whether expr, in JSONPath or jq syntax,
+// contains the recursive descent operator outside string literals.
+func hasRecursiveDescent(expr string) bool {
+	var quote byte
+	escaped := false
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '.' && i+1 < len(expr) && expr[i+1] == '.':
+			return true
+		}
+	}
+	return false
+}
+
+// exceedsDepth reports whether v nests objects and arrays deeper than max.
+func exceedsDepth(v interface{}, max int) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if max == 0 {
+			return true
+		}
+		for _, child := range v {
+			if exceedsDepth(child, max-1) {
+				return true
+			}
+		}
+	case []interface{}:
+		if max == 0 {
+			return true
+		}
+		for _, child := range v {
+			if exceedsDepth(child, max-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isAmbiguous reports whether segs may match more than one node.
+func isAmbiguous(segs []segment) bool {
+	for _, seg := range segs {
+		if seg.recursive || seg.kind == segWildcard || seg.kind == segFilter {
+			return true
+		}
+	}
+	return false
+}
+
+// compilePathMap compiles JSONPath expressions for the include_paths mode:
+// ambiguous expressions that parsePath supports yield an object mapping
+// the normalized path of every match to its value, all others are
+// compiled with jsonpath.New.
+func compilePathMap(expr string) (gval.Evaluable, error) {
+	segs, err := parsePath(expr)
+	if err != nil || !isAmbiguous(segs) {
+		return jsonpath.New(expr)
+	}
+	return func(ctx context.Context, data interface{}) (interface{}, error) {
+		matches := make(map[string]interface{})
+		matchPaths(ctx, "$", data, segs, func(path string, v interface{}) {
+			matches[path] = v
+		})
+		return matches, nil
+	}, nil
+}
+
+// matchPaths calls visit with the normalized path, such as
+// $['items'][0], and the value of every node below node matched by segs.
+// path is the normalized path of node.
+func matchPaths(ctx context.Context, path string, node interface{}, segs []segment, visit func(string, interface{})) {
+	if len(segs) == 0 {
+		visit(path, node)
+		return
+	}
+	seg, rest := segs[0], segs[1:]
+	forEachChild(ctx, node, seg, func(loc location, child interface{}) {
+		matchPaths(ctx, path+pathElement(loc.key), child, rest, visit)
+	})
+	if !seg.recursive {
+		return
+	}
+	all := segment{kind: segWildcard}
+	forEachChild(ctx, node, all, func(loc location, child interface{}) {
+		if isContainer(child) {
+			matchPaths(ctx, path+pathElement(loc.key), child, segs, visit)
+		}
+	})
+}
+
+// pathElement returns the normalized path element for an object key or
+// array index.
+func pathElement(key interface{}) string {
+	switch k := key.(type) {
+	case int:
+		return "[" + strconv.Itoa(k) + "]"
+	default:
+		escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(k.(string))
+		return "['" + escaped + "']"
+	}
+}
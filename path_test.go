@@ -0,0 +1,116 @@
+package jsonpathfilter
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRemove(t *testing.T) {
+	const doc = `{"password":"x","user":{"name":"a","token":"t"},"items":[{"id":1},{"id":2},{"id":3}]}`
+	tests := []struct {
+		name   string
+		remove []string
+		target string
+		want   string
+	}{
+		{"top-level key", []string{"$.password"}, "/", `{"items":[{"id":1},{"id":2},{"id":3}],"user":{"name":"a","token":"t"}}`},
+		{"nested key", []string{"$.user.token"}, "/?jsonpath_filter=$.user", `{"name":"a"}`},
+		{"array element", []string{"$.items[1]"}, "/?jsonpath_filter=$.items", `[{"id":1},{"id":3}]`},
+		{"recursive", []string{"$..id"}, "/?jsonpath_filter=$.items", `[{},{},{}]`},
+		{"several", []string{"$.password", "$.user", "$.items[*]"}, "/", `{"items":[]}`},
+		{"predicate", []string{"$.items[?(@.id == 2)]"}, "/?jsonpath_filter=$.items", `[{"id":1},{"id":3}]`},
+		{"missing", []string{"$.nothing"}, "/?jsonpath_filter=$.user.name", `"a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Remove: tt.remove}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncludePaths(t *testing.T) {
+	const doc = `{"items":[{"id":1,"tags":["a"]},{"id":2}],"meta":{"id":3}}`
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"recursive", "/?jsonpath_filter=$..id", `{"$['items'][0]['id']":1,"$['items'][1]['id']":2,"$['meta']['id']":3}`},
+		{"wildcard", "/?jsonpath_filter=$.items[*].id", `{"$['items'][0]['id']":1,"$['items'][1]['id']":2}`},
+		{"filter", "/?jsonpath_filter=" + url.QueryEscape(`$.items[?(@.id == 2)]`), `{"$['items'][1]":{"id":2}}`},
+		{"single node", "/?jsonpath_filter=$.meta.id", "3"},
+		{"no match", "/?jsonpath_filter=$..missing", "{}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{IncludePaths: true}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveKeys(t *testing.T) {
+	const doc = `{"user":{"name":"a","password":"x","profile":{"ssn":"1","city":"b"}},` +
+		`"items":[{"id":1,"password":"y"},[{"ssn":"2","id":2}]],"password":"z"}`
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"whole document", "/", `{"items":[{"id":1},[{"id":2}]],"user":{"name":"a","profile":{"city":"b"}}}`},
+		{"nested", "/?jsonpath_filter=$.user.profile", `{"city":"b"}`},
+		{"in arrays", "/?jsonpath_filter=$.items", `[{"id":1},[{"id":2}]]`},
+		{"removed before filtering", "/?jsonpath_filter=$.password", "null"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{RemoveKeys: []string{"password", "ssn"}}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	// A depth of 5: {"a":{"b":{"c":{"d":{"x":1}}}}}
+	const doc = `{"a":{"b":{"c":{"d":{"x":1}}}},"x":0}`
+	tests := []struct {
+		name     string
+		maxDepth int
+		expr     string
+		status   int
+		want     string
+	}{
+		{"below limit", 5, "$..x", http.StatusOK, "[0,1]"},
+		{"above limit", 4, "$..x", http.StatusBadRequest, ""},
+		{"no recursive descent", 1, "$.a.b.c.d.x", http.StatusOK, "1"},
+		{"quoted dots", 1, `$["a..b"]`, http.StatusOK, "null"},
+		{"unlimited", 0, "$..x", http.StatusOK, "[0,1]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{MaxDepth: tt.maxDepth}
+			provision(t, m)
+			rr := serve(t, m, "/?jsonpath_filter="+url.QueryEscape(tt.expr), respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Body.String(); tt.want != "" && got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package jsonpathfilter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// filterRequest applies the request's expressions to a JSON request body
+// before handing the request to next. Requests without a JSON body or
+// without an expression are passed on untouched.
+func (m *ResponseFilter) filterRequest(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if r.Body == nil || !m.isJSONContentType(r.Header.Get("Content-Type")) {
+		return m.proxy(w, r, next)
+	}
+	exprs, fromClient := m.expressions(r)
+	if len(exprs) == 0 && len(m.removePaths) == 0 && len(m.removeKeys) == 0 {
+		return m.proxy(w, r, next)
+	}
+	if err := m.checkEngine(r, exprs, fromClient); err != nil {
+		return m.writeError(w, r, http.StatusBadRequest, err)
+	}
+	if fromClient {
+		for _, expr := range exprs {
+			if err := m.checkLength(expr); err != nil {
+				return m.writeError(w, r, http.StatusBadRequest, err)
+			}
+			if !m.isAllowed(r, expr) {
+				return m.writeError(w, r, http.StatusForbidden, withCode(codeNotAllowed, &exprError{expr, errors.New("expression not allowed")}))
+			}
+			if err := m.checkSyntax(m.engine(r.Context()), expr); err != nil && m.OnError == "fail" && !m.partial(exprs) {
+				return m.writeError(w, r, http.StatusUnprocessableEntity, err)
+			}
+		}
+	}
+
+	// Read one byte past the limit to tell bodies over it apart
+	var body []byte
+	var err error
+	if m.MaxBodySize > 0 {
+		body, err = io.ReadAll(io.LimitReader(r.Body, m.MaxBodySize+1))
+	} else {
+		body, err = io.ReadAll(r.Body)
+	}
+	if err != nil {
+		r.Body.Close()
+		return err
+	}
+	if m.MaxBodySize > 0 && int64(len(body)) > m.MaxBodySize {
+		if m.RejectLargeBody {
+			r.Body.Close()
+			return m.writeError(w, r, http.StatusRequestEntityTooLarge, withCode(codeTooLarge, errors.New("request body too large to filter")))
+		}
+		// Pass the body on unfiltered without buffering the rest of it
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return m.proxy(w, r, next)
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	data, order, err := decodeJSON(trimBody(body), m.PreserveOrder)
+	if err != nil || !m.matchesWhen(r, data) {
+		return m.proxy(w, r, next)
+	}
+	result, err := m.transform(r.Context(), exprs, data)
+	if err != nil && !errors.Is(err, errNoMatch) {
+		m.logEvalError(r, exprs, err)
+		switch m.OnError {
+		case "passthrough":
+			return m.proxy(w, r, next)
+		case "empty":
+			result = nil
+		default:
+			return m.writeError(w, r, evalStatus(err), err)
+		}
+	}
+	filtered, err := marshalJSON(result, order, false, m.escapeHTML())
+	if err != nil {
+		return err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(filtered))
+	r.ContentLength = int64(len(filtered))
+	r.Header.Set("Content-Length", strconv.Itoa(len(filtered)))
+	return m.proxy(w, r, next)
+}
+
+// readCloser reads from Reader and closes Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,62 @@
+package jsonpathfilter
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestFilterRequest(t *testing.T) {
+	const doc = `{"a":{"b":1},"c":2}`
+	tests := []struct {
+		name        string
+		max         int64
+		reject      bool
+		contentType string
+		body        string
+		status      int
+		want        string
+	}{
+		{"json", 0, false, "application/json", doc, http.StatusOK, `{"b":1}`},
+		{"charset", 0, false, "application/json; charset=utf-8", doc, http.StatusOK, `{"b":1}`},
+		{"byte order mark", 0, false, "application/json", "\xef\xbb\xbf" + doc, http.StatusOK, `{"b":1}`},
+		{"not json", 0, false, "text/plain", doc, http.StatusOK, doc},
+		{"at limit", int64(len(doc)), false, "application/json", doc, http.StatusOK, `{"b":1}`},
+		{"over limit", int64(len(doc)) - 1, false, "application/json", doc, http.StatusOK, doc},
+		{"over limit rejecting", int64(len(doc)) - 1, true, "application/json", doc, http.StatusRequestEntityTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{Direction: "request", MaxBodySize: tt.max, RejectLargeBody: tt.reject}
+			provision(t, m)
+			var got, contentType string
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				b, err := io.ReadAll(r.Body)
+				got, contentType = string(b), r.Header.Get("Content-Type")
+				return err
+			})
+			req := httptest.NewRequest(http.MethodPost, "/?jsonpath_filter=$.a", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			if err := m.ServeHTTP(rr, req, next); err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("upstream body = %q, want %q", got, tt.want)
+			}
+			if contentType != tt.contentType {
+				t.Errorf("upstream Content-Type = %q, want %q", contentType, tt.contentType)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package jsonpathfilter
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	defaultResultTTL        = caddy.Duration(time.Minute)
+	defaultResultMaxEntries = 1000
+)
+
+// ResultCache configures caching of filtered responses. Entries are keyed
+// by request path and query string, by whether the Accept header asks for
+// MessagePack, and, if configured, by the expression header, the tenant
+// header, the expanded placeholder expression, the filter named by
+// placeholder, the engine in effect with AllowEngineOverride and, with
+// RangeItems, the Range header. They are only stored for GET requests
+// without an Authorization or Cookie header whose filtered response has a
+// 2xx status, does not set cookies and does not vary on request headers
+// other than those and Accept-Encoding, and whose upstream response is
+// not marked private, no-store or no-cache; requests with credentials are
+// not served from the cache either. Responses with a content encoding are
+// keyed by the Accept-Encoding header, too. Requests for a debug diff
+// are neither served from the cache nor stored.
+//
+// By default the upstream is still asked on every request and a cached
+// entry is only used if the upstream ETag, or Last-Modified if there is
+// no ETag, is unchanged; responses without either are not cached. With
+// CacheTTL, fresh entries are served without calling the upstream at all.
+//
+// To bypass the cache, send "Cache-Control: no-cache"; the response is
+// filtered anew and replaces the cached entry. Changing the query string,
+// e.g. with an unused parameter, also yields a separate entry.
+type ResultCache struct {
+	// TTL is how long an entry is kept. Defaults to 1m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// MaxEntries bounds the number of cached responses; the least
+	// recently used are evicted first. Defaults to 1000.
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// CacheTTL is how long an entry is served without revalidating it
+	// with the upstream. It must not exceed TTL. Zero, the default,
+	// always revalidates.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+}
+
+// cachedResult is a filtered response held in the result cache.
+type cachedResult struct {
+	key       string
+	validator string
+	stored    time.Time
+	status    int
+	header    http.Header
+	body      []byte
+}
+
+// resultCache is a size-bounded LRU cache of filtered responses with
+// expiry. It is safe for concurrent use.
+type resultCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	max   int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newResultCache(ttl time.Duration, max int) *resultCache {
+	return &resultCache{
+		ttl:   ttl,
+		max:   max,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the unexpired entry for key together with its age, or nil.
+func (c *resultCache) get(key string) (*cachedResult, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, 0
+	}
+	e := el.Value.(*cachedResult)
+	age := time.Now().Sub(e.stored)
+	if age >= c.ttl {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil, 0
+	}
+	c.ll.MoveToFront(el)
+	return e, age
+}
+
+// put stores e, replacing any entry with the same key.
+func (c *resultCache) put(e *cachedResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.stored = time.Now()
+	if el, ok := c.items[e.key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[e.key] = c.ll.PushFront(e)
+	for c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedResult).key)
+	}
+}
+
+// resultKey returns the result cache key for r, or "" if the response to r
+// must not be cached or served from the cache.
+func (m *ResponseFilter) resultKey(r *http.Request) string {
+	if m.results == nil || r.Method != http.MethodGet {
+		return ""
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		// Credentialed responses may be specific to the user
+		return ""
+	}
+	if m.debugDiff(r) {
+		// Diffs are only for the clients AllowDebugDiff permits
+		return ""
+	}
+	key := r.URL.Path + "?" + r.URL.RawQuery
+	if m.Header != "" {
+		key += "\n" + r.Header.Get(m.Header)
+	}
+	if m.TenantHeader != "" {
+		key += "\n" + r.Header.Get(m.TenantHeader)
+	}
+	if m.FilterPlaceholder != "" {
+		key += "\n" + m.filterName(r)
+	}
+	if m.Expression != "" {
+		key += "\n" + m.expandExpression(r)
+	}
+	if m.AllowEngineOverride {
+		key += "\n" + m.engine(r.Context()).name
+	}
+	if m.RangeItems {
+		key += "\n" + r.Header.Get("Range")
+	}
+	if m.prefersMsgpack(r.Header.Values("Accept")) {
+		key += "\nmsgpack"
+	}
+	if m.Compress && acceptsGzip(r) {
+		key += "\ngzip"
+	}
+	return key
+}
+
+// cachedResponse returns the cached response for key that may be served
+// without calling the upstream, or nil if there is none.
+func (m *ResponseFilter) cachedResponse(r *http.Request, key string) *cachedResult {
+	if key == "" || m.ResultCache.CacheTTL <= 0 || noCache(r) {
+		return nil
+	}
+	e, age := m.lookupResult(r, key)
+	if e == nil || age >= time.Duration(m.ResultCache.CacheTTL) {
+		return nil
+	}
+	return e
+}
+
+// validatedResponse returns the cached response for key if it was filtered
+// from an upstream response with the same validator as hdr, or nil.
+func (m *ResponseFilter) validatedResponse(r *http.Request, key string, hdr http.Header) *cachedResult {
+	if key == "" || noCache(r) {
+		return nil
+	}
+	validator := responseValidator(hdr)
+	if validator == "" || !storable(hdr) {
+		return nil
+	}
+	e, _ := m.lookupResult(r, key)
+	if e == nil || e.validator != validator {
+		return nil
+	}
+	return e
+}
+
+// lookupResult returns the entry for key that may be served for r,
+// preferring one with a content encoding, and its age.
+func (m *ResponseFilter) lookupResult(r *http.Request, key string) (*cachedResult, time.Duration) {
+	if e, age := m.results.get(encodedKey(r, key)); e != nil {
+		return e, age
+	}
+	return m.results.get(key)
+}
+
+// encodedKey returns the key under which the entries for key whose body
+// has a content encoding are stored, as they are only valid for requests
+// with the same Accept-Encoding header as r.
+func encodedKey(r *http.Request, key string) string {
+	return key + "\nencoding " + r.Header.Get("Accept-Encoding")
+}
+
+// storeResult caches a filtered response to r with header hdr and the
+// encoded body. validator identifies the upstream response it was
+// filtered from.
+func (m *ResponseFilter) storeResult(r *http.Request, key, validator string, status int, hdr http.Header, body []byte) {
+	if key == "" || status < 200 || status > 299 || hdr.Get("Set-Cookie") != "" {
+		return
+	}
+	if validator == "" && m.ResultCache.CacheTTL <= 0 || !m.keysVary(hdr) {
+		return
+	}
+	if enc := normalizeEncoding(hdr.Get("Content-Encoding")); enc != "" && enc != "identity" {
+		key = encodedKey(r, key)
+	}
+	header := hdr.Clone()
+	header.Del("Date")
+	m.results.put(&cachedResult{
+		key:       key,
+		validator: validator,
+		status:    status,
+		header:    header,
+		body:      body,
+	})
+}
+
+// storable reports whether the upstream response with header hdr may be
+// stored in the result cache: it must not set cookies, and its
+// Cache-Control header must allow shared caches to store and reuse it.
+func storable(hdr http.Header) bool {
+	if hdr.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, value := range hdr.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(directive, "=")
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "private", "no-store", "no-cache":
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// keysVary reports whether the result cache key covers every request
+// header named by the Vary header in hdr. Accept-Encoding is covered as
+// entries with a content encoding are keyed by it.
+func (m *ResponseFilter) keysVary(hdr http.Header) bool {
+	for _, value := range hdr.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			switch {
+			case name == "", strings.EqualFold(name, "Accept-Encoding"):
+			case m.Header != "" && strings.EqualFold(name, m.Header):
+			case m.TenantHeader != "" && strings.EqualFold(name, m.TenantHeader):
+			case m.RangeItems && strings.EqualFold(name, "Range"):
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// writeCached writes the cached response e to w. Upstream headers already
+// on w describing the original body are replaced.
+func (m *ResponseFilter) writeCached(w http.ResponseWriter, r *http.Request, e *cachedResult) error {
+	hdr := w.Header()
+	for _, name := range bodyHeaders {
+		hdr.Del(name)
+	}
+	for name, values := range e.header {
+		hdr[name] = values
+	}
+	m.setDebugHeader(hdr, "applied; cached")
+	m.setHeaders(r, hdr, true)
+	traceOutcome(r, "cached")
+	if m.ETag && e.status == http.StatusOK && notModified(r, hdr.Get("Etag")) {
+		return writeNotModified(w, hdr)
+	}
+	if ce := m.logger.Check(zapcore.DebugLevel, "response served from result cache"); ce != nil {
+		ce.Write(
+			zap.String("uri", r.RequestURI),
+			zap.Int("size", len(e.body)))
+	}
+	w.WriteHeader(e.status)
+	_, err := w.Write(e.body)
+	return m.abortBody(err)
+}
+
+// responseValidator returns the upstream ETag, or Last-Modified if there
+// is no ETag.
+func responseValidator(hdr http.Header) string {
+	if etag := hdr.Get("Etag"); etag != "" {
+		return "etag " + etag
+	}
+	if lastModified := hdr.Get("Last-Modified"); lastModified != "" {
+		return "last-modified " + lastModified
+	}
+	return ""
+}
+
+// noCache reports whether r asks to bypass cached responses.
+func noCache(r *http.Request) bool {
+	for _, value := range r.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+				return true
+			}
+		}
+	}
+	return strings.EqualFold(r.Header.Get("Pragma"), "no-cache")
+}
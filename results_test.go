@@ -0,0 +1,320 @@
+package jsonpathfilter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// countingUpstream returns an upstream handler writing the JSON body with
+// the headers hdr, counting its calls in n.
+func countingUpstream(n *int, hdr map[string]string, body []byte) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		*n++
+		w.Header().Set("Content-Type", "application/json")
+		for name, value := range hdr {
+			w.Header().Set(name, value)
+		}
+		_, err := w.Write(body)
+		return err
+	})
+}
+
+func newCachingFilter(tb testing.TB, m *ResponseFilter) *ResponseFilter {
+	tb.Helper()
+	m.ResultCache = &ResultCache{CacheTTL: caddy.Duration(time.Minute)}
+	provision(tb, m)
+	return m
+}
+
+func TestResultCacheVary(t *testing.T) {
+	tests := []struct {
+		name  string
+		vary  string
+		calls int
+	}{
+		{"none", "", 1},
+		{"accept encoding", "Accept-Encoding", 1},
+		{"expression header", "X-Jsonpath", 1},
+		{"other", "Accept-Language", 2},
+		{"other in list", "X-Jsonpath, Accept-Language", 2},
+		{"any", "*", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newCachingFilter(t, &ResponseFilter{Header: "X-Jsonpath"})
+			var calls int
+			hdr := map[string]string{}
+			if tt.vary != "" {
+				hdr["Vary"] = tt.vary
+			}
+			next := countingUpstream(&calls, hdr, []byte(`{"a":1}`))
+			for i := 0; i < 2; i++ {
+				if rr := serve(t, m, "/?jsonpath_filter=$.a", next); rr.Body.String() != "1" {
+					t.Fatalf("body = %q, want %q", rr.Body.String(), "1")
+				}
+			}
+			if calls != tt.calls {
+				t.Errorf("upstream calls = %d, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestResultCacheContentEncoding(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"a":1}`))
+	zw.Close()
+
+	m := newCachingFilter(t, new(ResponseFilter))
+	var calls int
+	next := countingUpstream(&calls, map[string]string{"Content-Encoding": "gzip"}, buf.Bytes())
+	for i, tt := range []struct {
+		acceptEncoding string
+		calls          int
+	}{
+		{"gzip", 1},
+		{"gzip", 1},
+		{"br", 2},
+		{"", 3},
+		{"gzip", 3},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.a", nil)
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		serveRequest(t, m, req, next)
+		if calls != tt.calls {
+			t.Errorf("request %d with Accept-Encoding %q: upstream calls = %d, want %d", i, tt.acceptEncoding, calls, tt.calls)
+		}
+	}
+}
+
+func TestResultCacheEngineOverride(t *testing.T) {
+	m := newCachingFilter(t, &ResponseFilter{
+		AllowEngineOverride: true,
+		EngineOverrideCIDRs: []string{"10.0.0.0/8"},
+	})
+	var calls int
+	next := countingUpstream(&calls, nil, []byte(`{"a":1}`))
+	for i, tt := range []struct {
+		remoteAddr string
+		status     int
+		calls      int
+	}{
+		{"10.0.0.1:1234", http.StatusOK, 1},
+		{"192.0.2.1:1234", http.StatusUnprocessableEntity, 2},
+		{"10.0.0.2:1234", http.StatusOK, 2},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?engine=jq&jsonpath_filter=.a", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rr := serveRequest(t, m, req, next)
+		if rr.Code != tt.status {
+			t.Errorf("request %d from %s: status = %d, want %d", i, tt.remoteAddr, rr.Code, tt.status)
+		}
+		if calls != tt.calls {
+			t.Errorf("request %d from %s: upstream calls = %d, want %d", i, tt.remoteAddr, calls, tt.calls)
+		}
+	}
+}
+
+func TestResultCacheDebugDiff(t *testing.T) {
+	m := newCachingFilter(t, &ResponseFilter{
+		AllowDebugDiff: true,
+		DebugDiffCIDRs: []string{"10.0.0.0/8"},
+	})
+	var calls int
+	next := countingUpstream(&calls, nil, []byte(`{"a":1,"b":2}`))
+	var diff string
+	for i, tt := range []struct {
+		remoteAddr string
+		calls      int
+		diff       bool
+	}{
+		{"10.0.0.1:1234", 1, true},
+		{"192.0.2.1:1234", 2, false},
+		{"10.0.0.2:1234", 3, true},
+		{"192.0.2.2:1234", 3, false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?debug_diff=1&jsonpath_filter=$.a", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rr := serveRequest(t, m, req, next)
+		if calls != tt.calls {
+			t.Errorf("request %d from %s: upstream calls = %d, want %d", i, tt.remoteAddr, calls, tt.calls)
+		}
+		if i == 0 {
+			diff = rr.Body.String()
+		}
+		if got := rr.Body.String() == diff; got != tt.diff {
+			t.Errorf("request %d from %s: body = %s, want diff %t", i, tt.remoteAddr, rr.Body.String(), tt.diff)
+		}
+	}
+}
+
+func TestResultCacheCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		hdr    map[string]string
+		cookie bool
+		calls  int
+	}{
+		{"shared", nil, false, 1},
+		{"cookie", nil, true, 2},
+		{"private", map[string]string{"Cache-Control": "private, max-age=60"}, false, 2},
+		{"no-store", map[string]string{"Cache-Control": "no-store"}, false, 2},
+		{"no-cache", map[string]string{"Cache-Control": "No-Cache"}, false, 2},
+		{"private field", map[string]string{"Cache-Control": `private="X-User"`}, false, 2},
+		{"set cookie", map[string]string{"Set-Cookie": "session=x"}, false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newCachingFilter(t, &ResponseFilter{CacheControl: "public, max-age=60"})
+			var calls int
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				calls++
+				w.Header().Set("Content-Type", "application/json")
+				for name, value := range tt.hdr {
+					w.Header().Set(name, value)
+				}
+				user := "anonymous"
+				if c, err := r.Cookie("session"); err == nil {
+					user = c.Value
+				}
+				_, err := w.Write([]byte(`{"user":"` + user + `"}`))
+				return err
+			})
+			var bodies []string
+			for _, user := range []string{"alice", "bob"} {
+				req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.user", nil)
+				if tt.cookie {
+					req.Header.Set("Cookie", "session="+user)
+				}
+				bodies = append(bodies, serveRequest(t, m, req, next).Body.String())
+			}
+			if calls != tt.calls {
+				t.Errorf("upstream calls = %d, want %d", calls, tt.calls)
+			}
+			if tt.cookie && bodies[1] != `"bob"` {
+				t.Errorf("second user got %s, want %q", bodies[1], `"bob"`)
+			}
+		})
+	}
+}
+
+func TestResultCacheTenant(t *testing.T) {
+	m := newCachingFilter(t, &ResponseFilter{
+		TenantHeader: "X-Tenant",
+		TenantAllow:  map[string][]string{"acme": {"$.a"}, "globex": {"$.b"}},
+	})
+	var calls int
+	next := countingUpstream(&calls, nil, []byte(`{"a":1,"b":2}`))
+	for i, tt := range []struct {
+		tenant string
+		status int
+		calls  int
+	}{
+		{"acme", http.StatusOK, 1},
+		{"acme", http.StatusOK, 1},
+		{"globex", http.StatusForbidden, 2},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.a", nil)
+		req.Header.Set("X-Tenant", tt.tenant)
+		rr := serveRequest(t, m, req, next)
+		if rr.Code != tt.status {
+			t.Errorf("request %d for %s: status = %d, want %d", i, tt.tenant, rr.Code, tt.status)
+		}
+		if calls != tt.calls {
+			t.Errorf("request %d for %s: upstream calls = %d, want %d", i, tt.tenant, calls, tt.calls)
+		}
+	}
+}
+
+func TestResultCacheFilterPlaceholder(t *testing.T) {
+	m := newCachingFilter(t, &ResponseFilter{
+		Filters:           map[string]string{"summary": "$.name", "details": "$.details"},
+		FilterPlaceholder: "{http.request.header.X-View}",
+	})
+	var calls int
+	next := countingUpstream(&calls, nil, []byte(`{"name":"a","details":{"x":2}}`))
+	for i, tt := range []struct {
+		view  string
+		want  string
+		calls int
+	}{
+		{"summary", `"a"`, 1},
+		{"details", `{"x":2}`, 2},
+		{"summary", `"a"`, 2},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-View", tt.view)
+		rr := httptest.NewRecorder()
+		req = caddyhttp.PrepareRequest(req, caddy.NewReplacer(), rr, nil)
+		if err := m.ServeHTTP(rr, req, next); err != nil {
+			t.Fatalf("ServeHTTP: %v", err)
+		}
+		if got := rr.Body.String(); got != tt.want {
+			t.Errorf("request %d for %s: body = %s, want %s", i, tt.view, got, tt.want)
+		}
+		if calls != tt.calls {
+			t.Errorf("request %d for %s: upstream calls = %d, want %d", i, tt.view, calls, tt.calls)
+		}
+	}
+}
+
+func TestResultCacheRange(t *testing.T) {
+	m := newCachingFilter(t, &ResponseFilter{RangeItems: true})
+	var calls int
+	next := countingUpstream(&calls, nil, []byte(`{"a":[1,2,3]}`))
+	for i, tt := range []struct {
+		rng   string
+		want  string
+		calls int
+	}{
+		{"items=0-0", "[1]", 1},
+		{"items=1-", "[2,3]", 2},
+		{"items=0-0", "[1]", 2},
+		{"", "[1,2,3]", 3},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.a", nil)
+		if tt.rng != "" {
+			req.Header.Set("Range", tt.rng)
+		}
+		rr := serveRequest(t, m, req, next)
+		if got := rr.Body.String(); got != tt.want {
+			t.Errorf("request %d with Range %q: body = %s, want %s", i, tt.rng, got, tt.want)
+		}
+		if calls != tt.calls {
+			t.Errorf("request %d with Range %q: upstream calls = %d, want %d", i, tt.rng, calls, tt.calls)
+		}
+	}
+}
+
+func TestResultCacheSetHeaders(t *testing.T) {
+	m := newCachingFilter(t, &ResponseFilter{
+		SetHeaders: map[string]string{"X-User": "{http.request.header.X-Name}"},
+	})
+	var calls int
+	next := countingUpstream(&calls, nil, []byte(`{"a":1}`))
+	for i, name := range []string{"alice", "bob"} {
+		req := httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.a", nil)
+		req.Header.Set("X-Name", name)
+		rr := httptest.NewRecorder()
+		req = caddyhttp.PrepareRequest(req, caddy.NewReplacer(), rr, nil)
+		if err := m.ServeHTTP(rr, req, next); err != nil {
+			t.Fatalf("ServeHTTP: %v", err)
+		}
+		if got := rr.Header().Get("X-User"); got != name {
+			t.Errorf("request %d: X-User = %q, want %q", i, got, name)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("upstream calls = %d, want 1", calls)
+	}
+}
@@ -0,0 +1,322 @@
+package jsonpathfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// schema is a compiled JSON Schema. It supports the type, enum, const,
+// properties, required, additionalProperties, items, minItems, maxItems,
+// minLength, maxLength, pattern, minimum, maximum, allOf, anyOf and oneOf
+// keywords and boolean schemas; other annotations such as title are
+// ignored, and references are rejected at load time.
+type schema struct {
+	allow *bool // set for the boolean schemas true and false
+
+	Ref                  string             `json:"$ref"`
+	Type                 schemaTypes        `json:"type"`
+	Enum                 []json.RawMessage  `json:"enum"`
+	Const                json.RawMessage    `json:"const"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Pattern              string             `json:"pattern"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	AllOf                []*schema          `json:"allOf"`
+	AnyOf                []*schema          `json:"anyOf"`
+	OneOf                []*schema          `json:"oneOf"`
+
+	enum    []string // canonical encodings of Enum
+	konst   string   // canonical encoding of Const
+	pattern *regexp.Regexp
+}
+
+// schemaTypes is the type keyword, a single type name or a list of them.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*t = schemaTypes{name}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+func (s *schema) UnmarshalJSON(b []byte) error {
+	var allow bool
+	if err := json.Unmarshal(b, &allow); err == nil {
+		s.allow = &allow
+		return nil
+	}
+	type plain schema
+	return json.Unmarshal(b, (*plain)(s))
+}
+
+// loadSchema reads and compiles the JSON Schema in the file path.
+func loadSchema(path string) (*schema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := new(schema)
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if err := s.compile(); err != nil {
+		return nil, fmt.Errorf("compiling %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// compile checks s and its subschemas and prepares them for validation.
+func (s *schema) compile() error {
+	if s == nil || s.allow != nil {
+		return nil
+	}
+	if s.Ref != "" {
+		return fmt.Errorf("unsupported $ref %q", s.Ref)
+	}
+	for _, name := range s.Type {
+		switch name {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return fmt.Errorf("unrecognized type %q", name)
+		}
+	}
+	for _, value := range s.Enum {
+		enc, err := canonicalJSON(value)
+		if err != nil {
+			return fmt.Errorf("enum: %v", err)
+		}
+		s.enum = append(s.enum, enc)
+	}
+	if s.Const != nil {
+		enc, err := canonicalJSON(s.Const)
+		if err != nil {
+			return fmt.Errorf("const: %v", err)
+		}
+		s.konst = enc
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern: %v", err)
+		}
+		s.pattern = re
+	}
+	subs := []*schema{s.AdditionalProperties, s.Items}
+	for _, sub := range s.Properties {
+		subs = append(subs, sub)
+	}
+	subs = append(subs, s.AllOf...)
+	subs = append(subs, s.AnyOf...)
+	subs = append(subs, s.OneOf...)
+	for _, sub := range subs {
+		if err := sub.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canonicalJSON returns the encoding of the JSON value b normalized the
+// way results are decoded, for comparing values.
+func canonicalJSON(b []byte) (string, error) {
+	v, _, err := decodeJSON(b, false)
+	if err != nil {
+		return "", err
+	}
+	return encodeCanonical(v)
+}
+
+func encodeCanonical(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// validate reports the first violation of s by v, located by a JSONPath
+// relative to the document root, or nil if v conforms.
+func (s *schema) validate(v interface{}) error {
+	return s.check("$", v)
+}
+
+func (s *schema) check(at string, v interface{}) error {
+	if s == nil {
+		return nil
+	}
+	if s.allow != nil {
+		if !*s.allow {
+			return fmt.Errorf("%s: no value is allowed", at)
+		}
+		return nil
+	}
+	if len(s.Type) > 0 && !s.hasType(v) {
+		return fmt.Errorf("%s: expected %s, got %s", at, strings.Join(s.Type, " or "), schemaType(v))
+	}
+	if s.enum != nil || s.Const != nil {
+		enc, err := encodeCanonical(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", at, err)
+		}
+		if s.Const != nil && enc != s.konst {
+			return fmt.Errorf("%s: expected %s", at, s.konst)
+		}
+		if s.enum != nil && !containsString(s.enum, enc) {
+			return fmt.Errorf("%s: %s is not one of %s", at, enc, strings.Join(s.enum, ", "))
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required member %q", at, name)
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			sub, ok := s.Properties[key]
+			if !ok {
+				sub = s.AdditionalProperties
+				if sub != nil && sub.allow != nil && !*sub.allow {
+					return fmt.Errorf("%s: unexpected member %q", at, key)
+				}
+			}
+			if err := sub.check(memberPath(at, key), v[key]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: expected at least %d items, got %d", at, *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: expected at most %d items, got %d", at, *s.MaxItems, len(v))
+		}
+		for i, elem := range v {
+			if err := s.Items.check(at+"["+strconv.Itoa(i)+"]", elem); err != nil {
+				return err
+			}
+		}
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: expected at least %d characters, got %d", at, *s.MinLength, n)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: expected at most %d characters, got %d", at, *s.MaxLength, n)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("%s: %q does not match %q", at, v, s.Pattern)
+		}
+	default:
+		if f, ok := schemaNumber(v); ok {
+			if s.Minimum != nil && f < *s.Minimum {
+				return fmt.Errorf("%s: %v is less than the minimum %v", at, f, *s.Minimum)
+			}
+			if s.Maximum != nil && f > *s.Maximum {
+				return fmt.Errorf("%s: %v is greater than the maximum %v", at, f, *s.Maximum)
+			}
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		if err := sub.check(at, v); err != nil {
+			return err
+		}
+	}
+	if len(s.AnyOf) > 0 && s.matching(s.AnyOf, at, v) == 0 {
+		return fmt.Errorf("%s: matches none of anyOf", at)
+	}
+	if len(s.OneOf) > 0 {
+		if n := s.matching(s.OneOf, at, v); n != 1 {
+			return fmt.Errorf("%s: matches %d of oneOf, not exactly one", at, n)
+		}
+	}
+	return nil
+}
+
+// matching returns how many of subs v conforms to.
+func (s *schema) matching(subs []*schema, at string, v interface{}) int {
+	n := 0
+	for _, sub := range subs {
+		if sub.check(at, v) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// hasType reports whether v has one of the types of s.
+func (s *schema) hasType(v interface{}) bool {
+	actual := schemaType(v)
+	for _, name := range s.Type {
+		if name == actual || name == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaType returns the JSON Schema type name of the decoded value v:
+// its JSON type, or "integer" for numbers without a fractional part.
+func schemaType(v interface{}) string {
+	if f, ok := schemaNumber(v); ok && f == math.Trunc(f) && !math.IsInf(f, 0) {
+		return "integer"
+	}
+	return jsonType(v)
+}
+
+// schemaNumber returns the decoded number v as a float64.
+func schemaNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil || errors.Is(err, strconv.ErrRange)
+	}
+	return 0, false
+}
+
+// memberName matches member names that need no brackets in a JSONPath.
+var memberName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// memberPath returns the JSONPath of the member key of the value at at.
+func memberPath(at, key string) string {
+	if memberName.MatchString(key) {
+		return at + "." + key
+	}
+	return at + "[" + strconv.Quote(key) + "]"
+}
+
+func containsString(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
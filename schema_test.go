@@ -0,0 +1,150 @@
+package jsonpathfilter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestSchemaCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		err    string
+	}{
+		{"type", `{"type":"string"}`, `"a"`, ""},
+		{"wrong type", `{"type":"string"}`, `1`, "$: expected string, got integer"},
+		{"type list", `{"type":["string","null"]}`, `null`, ""},
+		{"integer is a number", `{"type":"number"}`, `2`, ""},
+		{"fraction is no integer", `{"type":"integer"}`, `2.5`, "$: expected integer, got number"},
+		{"large integer", `{"type":"integer","minimum":0}`, `9007199254740993`, ""},
+		{"enum", `{"enum":["a",{"b":[1]}]}`, `{"b":[1]}`, ""},
+		{"not in enum", `{"enum":["a","b"]}`, `"c"`, `$: "c" is not one of "a", "b"`},
+		{"const", `{"const":1}`, `1`, ""},
+		{"not const", `{"const":1}`, `2`, "$: expected 1"},
+		{"required", `{"required":["id"]}`, `{"id":1}`, ""},
+		{"missing required", `{"required":["id"]}`, `{}`, `$: missing required member "id"`},
+		{"property", `{"properties":{"id":{"type":"integer"}}}`, `{"id":"x"}`, "$.id: expected integer, got string"},
+		{"quoted property", `{"properties":{"a-b":{"type":"integer"}}}`, `{"a-b":"x"}`, `$["a-b"]: expected integer, got string`},
+		{"additional properties", `{"properties":{"id":{}},"additionalProperties":false}`, `{"id":1,"x":2}`, `$: unexpected member "x"`},
+		{"additional properties schema", `{"additionalProperties":{"type":"string"}}`, `{"x":2}`, "$.x: expected string, got integer"},
+		{"items", `{"items":{"type":"integer"}}`, `[1,"a"]`, "$[1]: expected integer, got string"},
+		{"min items", `{"minItems":2}`, `[1]`, "$: expected at least 2 items, got 1"},
+		{"max items", `{"maxItems":1}`, `[1,2]`, "$: expected at most 1 items, got 2"},
+		{"min length", `{"minLength":2}`, `"é"`, "$: expected at least 2 characters, got 1"},
+		{"max length", `{"maxLength":1}`, `"ab"`, "$: expected at most 1 characters, got 2"},
+		{"pattern", `{"pattern":"^a"}`, `"ba"`, `$: "ba" does not match "^a"`},
+		{"minimum", `{"minimum":1}`, `0.5`, "$: 0.5 is less than the minimum 1"},
+		{"maximum", `{"maximum":1}`, `2`, "$: 2 is greater than the maximum 1"},
+		{"all of", `{"allOf":[{"type":"integer"},{"minimum":3}]}`, `2`, "$: 2 is less than the minimum 3"},
+		{"any of", `{"anyOf":[{"type":"string"},{"minimum":3}]}`, `2`, "$: matches none of anyOf"},
+		{"one of", `{"oneOf":[{"type":"integer"},{"minimum":1}]}`, `2`, "$: matches 2 of oneOf, not exactly one"},
+		{"true", `true`, `{"a":1}`, ""},
+		{"false", `{"properties":{"a":false}}`, `{"a":1}`, "$.a: no value is allowed"},
+		{"annotations ignored", `{"title":"x","description":"y","type":"object"}`, `{}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := new(schema)
+			if err := json.Unmarshal([]byte(tt.schema), s); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.compile(); err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			v, _, err := decodeJSON([]byte(tt.value), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if err := s.validate(v); err != nil {
+				got = err.Error()
+			}
+			if got != tt.err {
+				t.Errorf("validate(%s) = %q, want %q", tt.value, got, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	const doc = `{"items":[{"id":1,"name":"a"},{"id":"2","name":"b"}]}`
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(path, []byte(`{"type":"array","items":{"type":"object","required":["id"],"properties":{"id":{"type":"integer"}}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		passThrough bool
+		target      string
+		status      int
+		want        string
+	}{
+		{"conforming", false, "/?jsonpath_filter=$.items[0:1]", http.StatusOK, `[{"id":1,"name":"a"}]`},
+		{"not conforming", false, "/?jsonpath_filter=$.items", http.StatusInternalServerError, ""},
+		{"wrong type", false, "/?jsonpath_filter=$.items[0]", http.StatusInternalServerError, ""},
+		{"pass-through", true, "/?jsonpath_filter=$.items", http.StatusOK, doc},
+		{"described", false, "/?jsonpath_filter=$.items&count=true", http.StatusOK, `{"count":2}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{ValidateSchema: path, SchemaPassThrough: tt.passThrough}
+			provision(t, m)
+			rr := serve(t, m, tt.target, respond(http.StatusOK, "application/json", doc))
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if tt.status == http.StatusInternalServerError {
+				var body errorBody
+				if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+					t.Fatalf("decoding %s: %v", rr.Body, err)
+				}
+				if body.Code != codeSchemaMismatch || !strings.HasPrefix(body.Error, "result does not match schema: $") {
+					t.Errorf("body = %+v, want a schema_mismatch error", body)
+				}
+				return
+			}
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSchema(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name   string
+		schema string
+		err    string
+	}{
+		{"reference", `{"items":{"$ref":"#/definitions/x"}}`, `validate_schema: compiling `},
+		{"unknown type", `{"type":"text"}`, `validate_schema: compiling `},
+		{"invalid pattern", `{"pattern":"("}`, `validate_schema: compiling `},
+		{"malformed", `{"type":`, `validate_schema: parsing `},
+		{"missing", "", "validate_schema: open "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "_")+".json")
+			if tt.schema != "" {
+				if err := os.WriteFile(path, []byte(tt.schema), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			m := &ResponseFilter{ValidateSchema: path}
+			if err := m.Provision(ctx); err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("Provision = %v, want %s...", err, tt.err)
+			}
+		})
+	}
+}
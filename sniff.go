@@ -0,0 +1,112 @@
+package jsonpathfilter
+
+import (
+	"net/http"
+)
+
+// sniffWriter sits between the upstream and the response recorder and
+// holds back the final response header of responses that would be
+// buffered until the first non-whitespace byte of the body arrives. If
+// that byte cannot start a JSON value, nonJSON is set before the header
+// is passed on, so that the recorder streams the response instead. A
+// leading UTF-8 byte order mark is skipped, as trimBody strips it.
+type sniffWriter struct {
+	rec http.ResponseWriter
+
+	// sniffs reports whether the response with status and hdr is to be
+	// sniffed.
+	sniffs func(status int, hdr http.Header) bool
+
+	status  int
+	held    bool
+	bom     int // bytes of the byte order mark seen
+	pending []byte
+	nonJSON bool
+}
+
+func (s *sniffWriter) Header() http.Header { return s.rec.Header() }
+
+func (s *sniffWriter) WriteHeader(status int) {
+	if s.status != 0 || s.held {
+		return
+	}
+	if status >= 100 && status <= 199 || !s.sniffs(status, s.rec.Header()) {
+		s.rec.WriteHeader(status)
+		if status < 100 || status > 199 {
+			s.status = status
+		}
+		return
+	}
+	s.status, s.held = status, true
+}
+
+func (s *sniffWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.WriteHeader(http.StatusOK)
+	}
+	if !s.held {
+		return s.rec.Write(p)
+	}
+	for _, c := range p {
+		if s.bom < len(utf8BOM) {
+			if c == utf8BOM[s.bom] {
+				s.bom++
+				continue
+			}
+			if s.bom > 0 {
+				c = 0 // a truncated byte order mark
+			}
+			s.bom = len(utf8BOM)
+		}
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		case '{', '[', '"', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 't', 'f', 'n':
+		default:
+			s.nonJSON = true
+		}
+		if err := s.release(); err != nil {
+			return 0, err
+		}
+		return s.rec.Write(p)
+	}
+	// Only whitespace and the byte order mark so far
+	s.pending = append(s.pending, p...)
+	return len(p), nil
+}
+
+// release passes the held header and whitespace on to the recorder.
+func (s *sniffWriter) release() error {
+	s.held = false
+	s.rec.WriteHeader(s.status)
+	if len(s.pending) == 0 {
+		return nil
+	}
+	_, err := s.rec.Write(s.pending)
+	s.pending = nil
+	return err
+}
+
+// FlushError passes a held header on, as the body cannot be sniffed
+// without waiting for it, and flushes the recorder.
+func (s *sniffWriter) FlushError() error {
+	if s.held {
+		if err := s.release(); err != nil {
+			return err
+		}
+	}
+	//nolint:bodyclose
+	return http.NewResponseController(s.rec).Flush()
+}
+
+// Unwrap returns the recorder, for http.ResponseController.
+func (s *sniffWriter) Unwrap() http.ResponseWriter { return s.rec }
+
+// finish passes a header still held back when the upstream is done, for
+// empty and whitespace-only bodies, on to the recorder.
+func (s *sniffWriter) finish() error {
+	if !s.held {
+		return nil
+	}
+	return s.release()
+}
@@ -0,0 +1,44 @@
+package jsonpathfilter
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestSniffBody(t *testing.T) {
+	const bom = "\xef\xbb\xbf"
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"json", []string{`{"a":1}`}, "1"},
+		{"whitespace", []string{" \n", `{"a":1}`}, "1"},
+		{"byte order mark", []string{bom + `{"a":1}`}, "1"},
+		{"split byte order mark", []string{bom[:1], bom[1:2], bom[2:] + ` {"a":1}`}, "1"},
+		{"html", []string{"<html></html>"}, "<html></html>"},
+		{"truncated byte order mark", []string{bom[:2] + `{"a":1}`}, bom[:2] + `{"a":1}`},
+		{"late byte order mark", []string{" " + bom + `{"a":1}`}, " " + bom + `{"a":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ResponseFilter{SniffBody: true}
+			provision(t, m)
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "application/json")
+				for _, chunk := range tt.chunks {
+					if _, err := w.Write([]byte(chunk)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			rr := serve(t, m, "/?jsonpath_filter=$.a", next)
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
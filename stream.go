@@ -0,0 +1,121 @@
+package jsonpathfilter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// writeStream writes the array result element by element, restoring the
+// upstream content encoding or gzipping it as configured with Compress,
+// so that neither the encoded nor the compressed array is ever held in
+// memory as a whole. The output is identical to that of marshalJSON, but
+// the response has no Content-Length and is not stored in the result
+// cache.
+func (m *ResponseFilter) writeStream(w http.ResponseWriter, r *http.Request, rec caddyhttp.ResponseRecorder, status int, encoding string, exprs []string, result []interface{}, order keyOrder, pretty bool) error {
+	upstreamType := rec.Header().Get("Content-Type")
+	hdr := w.Header()
+	for _, name := range bodyHeaders {
+		hdr.Del(name)
+	}
+	for _, name := range m.StripHeaders {
+		hdr.Del(name)
+	}
+	trailers := takeTrailers(hdr)
+	m.setDebugHeader(hdr, "applied; streamed")
+	m.setCacheControl(hdr, true)
+	m.setHeaders(r, hdr, true)
+	hdr.Del("Content-Length")
+	hdr.Set("Content-Type", m.OutputContentType)
+	if m.shouldCompress(r, encoding, -1) {
+		encoding = "gzip"
+		hdr.Set("Content-Encoding", encoding)
+		hdr.Add("Vary", "Accept-Encoding")
+	}
+
+	bw := bufio.NewWriter(w)
+	enc, err := newEncoder(encoding, bw)
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(status)
+
+	size, err := m.streamArray(enc, result, order, pretty)
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	setTrailers(hdr, trailers)
+	if err != nil {
+		return m.abortBody(err)
+	}
+
+	m.metrics.filtered.Inc()
+	m.metrics.filteredSize.Observe(float64(size))
+	traceOutcome(r, "applied", attribute.Int("jsonpath_filter.result_size", size))
+	if ce := m.logger.Check(zapcore.DebugLevel, "response filtered"); ce != nil {
+		ce.Write(
+			zap.Strings("expressions", exprs),
+			zap.String("content_type", upstreamType),
+			zap.Bool("applied", true),
+			zap.Bool("streamed", true),
+			zap.Int("size", size))
+	}
+	return nil
+}
+
+// streamArray writes the encoded array result to enc and returns the
+// number of bytes written before encoding.
+func (m *ResponseFilter) streamArray(enc io.Writer, result []interface{}, order keyOrder, pretty bool) (int, error) {
+	size := 0
+	write := func(b []byte) error {
+		size += len(b)
+		_, err := enc.Write(b)
+		return err
+	}
+	if err := write([]byte("[")); err != nil {
+		return size, err
+	}
+	var indented bytes.Buffer
+	for i, elem := range result {
+		sep := ","
+		if i == 0 {
+			sep = ""
+		}
+		if pretty {
+			sep += "\n  "
+		}
+		if err := write([]byte(sep)); err != nil {
+			return size, err
+		}
+		b, err := marshalJSON(elem, order, false, m.escapeHTML())
+		if err != nil {
+			return size, err
+		}
+		if pretty {
+			indented.Reset()
+			if err := json.Indent(&indented, b, "  ", "  "); err != nil {
+				return size, err
+			}
+			b = indented.Bytes()
+		}
+		if err := write(b); err != nil {
+			return size, err
+		}
+	}
+	end := "]"
+	if pretty && len(result) > 0 {
+		end = "\n]"
+	}
+	err := write([]byte(end))
+	return size, err
+}
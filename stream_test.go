@@ -0,0 +1,58 @@
+package jsonpathfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	object, _ := largeDocument(t, 10000)
+	tests := []struct {
+		name           string
+		m              ResponseFilter
+		target         string
+		acceptEncoding string
+		streamed       bool
+	}{
+		{"array", ResponseFilter{}, "/?jsonpath_filter=$.items", "", true},
+		{"pretty", ResponseFilter{Pretty: true}, "/?jsonpath_filter=$.items", "", true},
+		{"preserve order", ResponseFilter{PreserveOrder: true}, "/?jsonpath_filter=$.items", "", true},
+		{"compressed", ResponseFilter{Compress: true}, "/?jsonpath_filter=$.items", "gzip", true},
+		{"compressed pretty", ResponseFilter{Compress: true, Pretty: true}, "/?jsonpath_filter=$.items", "gzip", true},
+		{"compressed preserve order", ResponseFilter{Compress: true, PreserveOrder: true}, "/?jsonpath_filter=$.items", "gzip", true},
+		{"object", ResponseFilter{}, "/?jsonpath_filter=$.items[3]", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var bodies [2]string
+			for i, stream := range []bool{false, true} {
+				m := tt.m
+				m.Stream = stream
+				provision(t, &m)
+				req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+				if tt.acceptEncoding != "" {
+					req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+				}
+				rr := serveRequest(t, &m, req, respond(http.StatusOK, "application/json", string(object)))
+				if rr.Code != http.StatusOK {
+					t.Fatalf("stream %t: status = %d, want %d", stream, rr.Code, http.StatusOK)
+				}
+				if got := rr.Header().Get("Content-Length") == ""; got != (stream && tt.streamed) {
+					t.Errorf("stream %t: Content-Length = %q", stream, rr.Header().Get("Content-Length"))
+				}
+				if got := rr.Header().Get("Content-Encoding"); got != tt.acceptEncoding {
+					t.Errorf("stream %t: Content-Encoding = %q, want %q", stream, got, tt.acceptEncoding)
+				}
+				body, err := decodeBody(rr.Header().Get("Content-Encoding"), rr.Body.Bytes(), 0)
+				if err != nil {
+					t.Fatalf("stream %t: decoding body: %v", stream, err)
+				}
+				bodies[i] = string(body)
+			}
+			if bodies[0] != bodies[1] {
+				t.Errorf("streamed body differs from buffered body (%d and %d bytes)", len(bodies[1]), len(bodies[0]))
+			}
+		})
+	}
+}
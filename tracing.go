@@ -0,0 +1,56 @@
+package jsonpathfilter
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/pebosi/caddy-jsonpath-filter"
+
+// spanKey is the request context key of the filter span.
+type spanKey struct{}
+
+// startSpan starts a "jsonpath_filter" span as a child of the span in the
+// context of r, e.g. the one started by Caddy's tracing handler, and
+// returns r with the new span in its context. If the parent span is not
+// recorded, no span is started and r and a nil span are returned, so
+// untraced requests pay no more than a context lookup.
+func (m *ResponseFilter) startSpan(r *http.Request) (*http.Request, trace.Span) {
+	parent := trace.SpanFromContext(r.Context())
+	if !parent.IsRecording() {
+		return r, nil
+	}
+	exprs, _ := m.expressions(r)
+	ctx, span := parent.TracerProvider().Tracer(tracerName).Start(r.Context(), "jsonpath_filter",
+		trace.WithAttributes(attribute.StringSlice("jsonpath_filter.expressions", exprs)))
+	ctx = context.WithValue(ctx, spanKey{}, span)
+	return r.WithContext(ctx), span
+}
+
+// filterSpan returns the filter span of r, or nil if there is none.
+func filterSpan(r *http.Request) trace.Span {
+	span, _ := r.Context().Value(spanKey{}).(trace.Span)
+	return span
+}
+
+// traceOutcome records the outcome of filtering r, such as "applied" or
+// "skipped", on its filter span.
+func traceOutcome(r *http.Request, outcome string, attrs ...attribute.KeyValue) {
+	if span := filterSpan(r); span != nil {
+		span.SetAttributes(attribute.String("jsonpath_filter.outcome", outcome))
+		span.SetAttributes(attrs...)
+	}
+}
+
+// traceError records err on the filter span of r.
+func traceError(r *http.Request, err error) {
+	if span := filterSpan(r); span != nil {
+		span.SetAttributes(attribute.String("jsonpath_filter.outcome", "error"))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
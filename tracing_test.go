@@ -0,0 +1,131 @@
+package jsonpathfilter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// spanRecorder is an in-memory trace.TracerProvider keeping the spans
+// started by its tracers.
+type spanRecorder struct {
+	noop.TracerProvider
+	spans []*recordedSpan
+}
+
+func (p *spanRecorder) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return recordingTracer{p: p}
+}
+
+type recordingTracer struct {
+	noop.Tracer
+	p *spanRecorder
+}
+
+func (t recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	span := &recordedSpan{p: t.p, name: name, attrs: map[attribute.Key]attribute.Value{}}
+	cfg := trace.NewSpanStartConfig(opts...)
+	span.SetAttributes(cfg.Attributes()...)
+	t.p.spans = append(t.p.spans, span)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+type recordedSpan struct {
+	noop.Span
+	p      *spanRecorder
+	name   string
+	attrs  map[attribute.Key]attribute.Value
+	errs   []error
+	status codes.Code
+	ended  bool
+}
+
+func (s *recordedSpan) IsRecording() bool { return true }
+
+func (s *recordedSpan) SetAttributes(attrs ...attribute.KeyValue) {
+	for _, kv := range attrs {
+		s.attrs[kv.Key] = kv.Value
+	}
+}
+
+func (s *recordedSpan) RecordError(err error, _ ...trace.EventOption) { s.errs = append(s.errs, err) }
+
+func (s *recordedSpan) SetStatus(code codes.Code, _ string) { s.status = code }
+
+func (s *recordedSpan) End(...trace.SpanEndOption) { s.ended = true }
+
+func (s *recordedSpan) TracerProvider() trace.TracerProvider { return s.p }
+
+func TestTracing(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		outcome     string
+		status      codes.Code
+		attrs       map[attribute.Key]attribute.Value
+	}{
+		{"applied", "/?jsonpath_filter=$.a", "application/json", "applied", codes.Unset, map[attribute.Key]attribute.Value{
+			"jsonpath_filter.expressions": attribute.StringSliceValue([]string{"$.a"}),
+			"jsonpath_filter.result_size": attribute.IntValue(1),
+		}},
+		{"skipped", "/?jsonpath_filter=$.a", "text/plain", "skipped", codes.Unset, map[attribute.Key]attribute.Value{
+			"jsonpath_filter.reason": attribute.StringValue("non-json"),
+		}},
+		{"error", "/?jsonpath_filter=$[", "application/json", "error", codes.Error, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(ResponseFilter)
+			provision(t, m)
+			p := new(spanRecorder)
+			_, parent := p.Tracer("").Start(context.Background(), "request")
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req = req.WithContext(trace.ContextWithSpan(req.Context(), parent))
+			serveRequest(t, m, req, respond(http.StatusOK, tt.contentType, `{"a":1}`))
+
+			if len(p.spans) != 2 {
+				t.Fatalf("started %d spans, want 2", len(p.spans))
+			}
+			span := p.spans[1]
+			if span.name != "jsonpath_filter" || !span.ended {
+				t.Errorf("span %q ended = %t, want jsonpath_filter ended", span.name, span.ended)
+			}
+			if got := span.attrs["jsonpath_filter.outcome"].AsString(); got != tt.outcome {
+				t.Errorf("outcome = %q, want %q", got, tt.outcome)
+			}
+			for key, want := range tt.attrs {
+				if got := span.attrs[key]; got != want {
+					t.Errorf("%s = %v, want %v", key, got.Emit(), want.Emit())
+				}
+			}
+			if span.status != tt.status {
+				t.Errorf("status = %v, want %v", span.status, tt.status)
+			}
+			if got, want := len(span.errs) > 0, tt.status == codes.Error; got != want {
+				t.Errorf("recorded errors = %v, want errors %t", span.errs, want)
+			}
+		})
+	}
+}
+
+func TestTracingUnrecorded(t *testing.T) {
+	m := new(ResponseFilter)
+	provision(t, m)
+	var traced bool
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		traced = filterSpan(r) != nil
+		return nil
+	})
+	serveRequest(t, m, httptest.NewRequest(http.MethodGet, "/?jsonpath_filter=$.a", nil), next)
+	if traced {
+		t.Error("started a span without a recording parent")
+	}
+}